@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/adrg/xdg"
 	"github.com/gotk3/gotk3/gdk"
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
 	ircStyle "github.com/mnakama/flexim-go/pkg/irc-style"
+	"github.com/mnakama/flexim-go/pkg/launcher"
+	"github.com/mnakama/flexim-go/pkg/transfer"
 	"github.com/mnakama/flexim-go/proto"
 	"gopkg.in/yaml.v2"
 	"mvdan.cc/xurls/v2"
@@ -22,8 +33,82 @@ import (
 
 type tagAttrs map[string]interface{}
 
+// peerHandler receives datums from our chat partner
+type peerHandler struct {
+	proto.BaseHandler
+}
+
 const defaultPeerNick = "them" // Used if we do not have chat partner's nick
 
+// How long to wait for our messages to be acknowledged
+const ackTimeout = 30 * time.Second
+
+// How many received message IDs to remember, to drop duplicates
+const maxSeenIDs = 1000
+
+// How many messages can still be edited or retracted
+const maxLines = 1000
+
+// How much of a message is quoted above a reply
+const maxExcerpt = 60
+
+// Thumbnails in attachment and embed cards
+const (
+	thumbnailSize    = 240 // longest side, in pixels
+	maxThumbnailData = 4 << 20
+	thumbnailTimeout = 10 * time.Second
+)
+
+// Typing notifications, following the timings of the IRCv3 typing spec
+const (
+	typingThrottle   = 3 * time.Second // how often an active state is repeated
+	typingPauseAfter = 5 * time.Second // how long without a keypress before we're paused
+	typingExpire     = 6 * time.Second // how long a peer's active state lasts
+)
+
+// Markers shown after our own messages, when the peer supports receipts
+const (
+	markerPending   = "…"
+	markerSent      = "✓"
+	markerDelivered = "✓✓"
+	markerRead      = "✓✓ read"
+	markerFailed    = "✗ not sent"
+)
+
+// msgLine is a message in the chat that Edit and Retract can refer to
+type msgLine struct {
+	from      string
+	own       bool
+	text      string
+	start     *gtk.TextMark // start of the text
+	tag       *gtk.TextTag  // covers the text, to find its end
+	retracted bool
+
+	reactions map[string]*reaction // by emoji
+	reactTag  *gtk.TextTag         // covers the line of reactions under the message
+}
+
+// reaction is everyone's reactions to a message with one emoji
+type reaction struct {
+	users map[string]bool
+	total int // from Reaction.Count, for networks that only tell totals
+}
+
+func (r *reaction) count() int {
+	if r.total > len(r.users) {
+		return r.total
+	}
+
+	return len(r.users)
+}
+
+// sentMsg is one of our messages waiting for receipts
+type sentMsg struct {
+	line   *msgLine // the marker follows its text
+	marker string
+	timer  *time.Timer
+}
+
 // User config variables
 var config struct {
 	Nickname string
@@ -37,125 +122,1515 @@ var (
 	peerNick      string
 	peerName      = flag.String("to", "", "Name of chat partner")
 	unixAddress   = flag.String("unix", "", "Unix socket address to connect")
+	keepalive     = flag.Duration("keepalive", 30*time.Second, "interval between keepalive pings; 0 disables them")
+	useTLS        = flag.Bool("tls", false, "connect with TLS")
+	extFraming    = flag.Bool("extframing", false, "use extended datum framing when connecting (the peer must support it)")
+	tlsAccept     = flag.Bool("tls-accept", false, "perform the server side of a TLS handshake on --fd")
+	tlsOpts       = proto.TLSFlags(flag.CommandLine)
+	e2eFlag       = flag.Bool("e2e", false, "start an encrypted session once connected")
+	loadImages    = flag.Bool("load-images", true, "download the thumbnails of attachments and links")
+	identityFile  = flag.String("identity", "", "Ed25519 identity key file, created if missing (default $XDG_CONFIG_HOME/flexim/identity-<user>.pem)")
+
+	// encryption state, only touched from the GTK main loop
+	identity  *proto.Identity
+	session   *proto.Session // established encrypted session
+	pending   *proto.Session // our offer, waiting for a reply
+	untrusted *proto.Session // established, but the peer's key waits for /trust
+
+	// receipt state, only touched from the GTK main loop
+	sentMsgs  = make(map[string]*sentMsg)
+	seenIDs   = make(map[string]bool)
+	seenOrder []string
+	unread    []string // IDs of received messages not seen yet
+
+	// edit state, only touched from the GTK main loop
+	msgLines  = make(map[string]*msgLine)
+	lineOrder []string
+	lastSent  string // ID of our last message, for /edit and /delete
+
+	peerPresence int8           // last presence state shown, only touched from the GTK main loop
+	profiles     proto.Profiles // of the users the bridge or server told about
+
+	// reply state, only touched from the GTK main loop
+	replyTo   string // ID of the message our next one answers
+	popupLine string // ID of the message the context menu was opened on
+
+	// typing state, only touched from the GTK main loop
+	typingSent       int8 // the last state we sent
+	typingSentAt     time.Time
+	typingPauseTimer glib.SourceHandle
+	typers           = make(map[string]time.Time) // peers typing, and when that expires
+	typersTicking    bool
+
+	// file transfers. incoming is also used by the socket's goroutine, which
+	// writes the chunks; everything else is only touched from the GTK main loop.
+	transferMu   sync.Mutex
+	incoming     = make(map[string]*transfer.Incoming)
+	outgoing     = make(map[string]*transfer.Outgoing)
+	offers       []*proto.FileOffer // waiting for /accept or /reject
+	progressBars = make(map[string]*gtk.ProgressBar)
+
+	thumbnails int // for naming the marks of thumbnails being downloaded
+
+	chat        *gtk.TextView
+	chatBuffer  *gtk.TextBuffer
+	chatScroll  *gtk.ScrolledWindow
+	entry       *gtk.Entry
+	e2eLabel    *gtk.Label
+	headerLabel *gtk.Label
+	typingLabel *gtk.Label
+	replyLabel  *gtk.Label
+	transferBox *gtk.Box
+	window      *gtk.Window
+
+	tagNick   *gtk.TextTag
+	tagMono   *gtk.TextTag
+	tagURL    *gtk.TextTag
+	tagMark   *gtk.TextTag
+	tagStrike *gtk.TextTag
+	tagReact  *gtk.TextTag
+	tagCard   *gtk.TextTag
+	tagQuote  *gtk.TextTag
+	tagJoin   *gtk.TextTag
+	tagPart   *gtk.TextTag
+)
+
+func timestamp(t time.Time) string {
+	return t.Format("15:04")
+}
+
+func (peerHandler) Message(msg *proto.Message) {
+	// called when we receive a message
+
+	if msg.From != "" {
+		peerNick = msg.From
+	}
+
+	var msgTime time.Time
+
+	if msg.Date != 0 {
+		msgTime = time.Unix(msg.Date, 0)
+	} else {
+		msgTime = time.Now()
+	}
+
+	glib.IdleAdd(func() bool {
+		if msg.ID != "" && seenMessage(msg.ID) {
+			return false
+		}
+
+		if len(msg.Encrypted) > 0 {
+			if session == nil && untrusted != nil {
+				appendText("Received an encrypted message from a key that is not trusted. Use /trust to accept it")
+				return false
+			} else if session == nil {
+				appendText("Received an encrypted message, but there is no encrypted session")
+				return false
+			}
+
+			if err := session.Decrypt(msg); err != nil {
+				appendText("Could not decrypt message: " + err.Error())
+				return false
+			}
+		} else if session != nil {
+			appendWithTag("The next message was not encrypted", tagPart)
+		}
+
+		if msg.ReplyTo != "" {
+			appendQuote(msg.ReplyTo)
+		}
+		start := appendMsg(msgTime, msg.From, msg.Msg)
+		trackLine(msg.ID, msg.From, false, start, msg.Msg)
+		appendCards(msg.Attachments, msg.Embeds)
+		peerTyping(msg.From, proto.TypingDone)
+
+		if msg.ID != "" {
+			sendReceipt(proto.ReceiptDelivered, msg.ID)
+			unread = append(unread, msg.ID)
+			if window.IsActive() {
+				sendReadReceipts()
+			}
+		}
+
+		return false
+	})
+}
+
+func (peerHandler) Typing(typing *proto.Typing) {
+	glib.IdleAdd(func() bool {
+		peerTyping(typing.From, typing.State)
+		return false
+	})
+}
+
+func (peerHandler) Ack(ack *proto.Ack) {
+	glib.IdleAdd(func() bool {
+		if sm, ok := sentMsgs[ack.ID]; ok && (sm.marker == markerPending || sm.marker == markerFailed) {
+			sm.timer.Stop()
+			setMarker(sm, markerSent)
+		}
+		return false
+	})
+}
+
+func (peerHandler) Receipt(receipt *proto.Receipt) {
+	glib.IdleAdd(func() bool {
+		for _, id := range receipt.IDs {
+			sm, ok := sentMsgs[id]
+			if !ok {
+				continue
+			}
+
+			sm.timer.Stop()
+			switch receipt.Status {
+			case proto.ReceiptDelivered:
+				if sm.marker != markerRead {
+					setMarker(sm, markerDelivered)
+				}
+			case proto.ReceiptRead:
+				setMarker(sm, markerRead)
+
+				// nothing more can happen to this message
+				delete(sentMsgs, id)
+			}
+		}
+		return false
+	})
+}
+
+func (peerHandler) Edit(edit *proto.Edit) {
+	glib.IdleAdd(func() bool {
+		text := edit.Msg
+		if len(edit.Encrypted) > 0 {
+			if session == nil {
+				appendText("Received an encrypted edit, but there is no encrypted session")
+				return false
+			}
+
+			var err error
+			text, err = session.Open(edit.Encrypted)
+			if err != nil {
+				appendText("Could not decrypt edit: " + err.Error())
+				return false
+			}
+		}
+
+		ml, ok := msgLines[edit.ID]
+		if !ok || ml.own || ml.from != edit.From || ml.retracted {
+			appendText(fmt.Sprintf("%s edited a message that is not shown: %s", nickOf(edit.From), text))
+			return false
+		}
+
+		editLine(ml, text)
+		return false
+	})
+}
+
+func (peerHandler) Retract(retract *proto.Retract) {
+	glib.IdleAdd(func() bool {
+		ml, ok := msgLines[retract.ID]
+		if !ok || ml.own || ml.from != retract.From {
+			return false
+		}
+
+		retractLine(ml, retract.Reason)
+		return false
+	})
+}
+
+func (peerHandler) Reaction(reaction *proto.Reaction) {
+	glib.IdleAdd(func() bool {
+		if ml, ok := msgLines[reaction.ID]; ok {
+			react(ml, reaction.From, reaction.Emoji, reaction.Remove, reaction.Count)
+		}
+		return false
+	})
+}
+
+func (peerHandler) KeyExchange(kx *proto.KeyExchange) {
+	glib.IdleAdd(func() bool {
+		keyExchange(kx)
+		return false
+	})
+}
+
+func (peerHandler) Hello(hello *proto.Hello) {
+	fmt.Printf("Peer is %s, protocol version %d, capabilities: %v\n",
+		hello.Agent, hello.Version, sock.Caps())
+
+	if *e2eFlag {
+		glib.IdleAdd(func() bool {
+			startE2E()
+			return false
+		})
+	}
+}
+
+func (peerHandler) Text(txt string) {
+	fmt.Println(txt)
+	glib.IdleAdd(func() bool {
+		appendText(txt)
+		return false
+	})
+}
+
+func (peerHandler) FileOffer(offer *proto.FileOffer) {
+	glib.IdleAdd(func() bool {
+		offers = append(offers, offer)
+		appendText(fmt.Sprintf("%s offers the file %s (%s). Use /accept to save it in %s, or /reject",
+			nickOf(offer.From), offer.Name, formatSize(offer.Size), transfer.DownloadDir()))
+		return false
+	})
+}
+
+func (peerHandler) FileAccept(accept *proto.FileAccept) {
+	glib.IdleAdd(func() bool {
+		o, ok := outgoing[accept.ID]
+		if !ok {
+			return false
+		}
+
+		offer := o.Offer()
+		if accept.Reject {
+			delete(outgoing, accept.ID)
+			appendText(fmt.Sprintf("%s declined %s", nickOf(peerNick), offer.Name))
+			return false
+		}
+
+		sendFileData(o, accept.Offset)
+		return false
+	})
+}
+
+func (peerHandler) FileChunk(chunk *proto.FileChunk) {
+	transferMu.Lock()
+	in, ok := incoming[chunk.ID]
+	transferMu.Unlock()
+	if !ok {
+		return
+	}
+
+	offer := in.Offer()
+	before := in.Received()
+	received, err := in.Write(chunk)
+	if err != nil {
+		endIncoming(chunk.ID, in, err)
+		return
+	}
+
+	// only redraw when the percentage changes
+	if percent(before, offer.Size) != percent(received, offer.Size) {
+		glib.IdleAdd(func() bool {
+			showProgress(chunk.ID, "Receiving "+offer.Name, received, offer.Size)
+			return false
+		})
+	}
+}
+
+func (peerHandler) FileComplete(done *proto.FileComplete) {
+	transferMu.Lock()
+	in, ok := incoming[done.ID]
+	delete(incoming, done.ID)
+	transferMu.Unlock()
+
+	if ok {
+		offer := in.Offer()
+		if done.Error != "" {
+			in.Close()
+			glib.IdleAdd(func() bool {
+				removeProgress(done.ID)
+				appendText(fmt.Sprintf("%s stopped sending %s: %s", nickOf(peerNick), offer.Name, done.Error))
+				return false
+			})
+			return
+		}
+
+		path, err := in.Finish()
+		reply := proto.FileComplete{
+			ID:   done.ID,
+			To:   offer.From,
+			From: config.Nickname,
+		}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		if err := sock.Send(&reply); err != nil {
+			log.Print(err)
+		}
+
+		glib.IdleAdd(func() bool {
+			removeProgress(done.ID)
+			if err != nil {
+				appendText("Could not receive a file: " + err.Error())
+			} else {
+				appendText("Saved " + path)
+			}
+			return false
+		})
+		return
+	}
+
+	glib.IdleAdd(func() bool {
+		o, ok := outgoing[done.ID]
+		if !ok {
+			return false
+		}
+
+		delete(outgoing, done.ID)
+		o.Cancel()
+		removeProgress(done.ID)
+
+		if done.Error != "" {
+			appendText(fmt.Sprintf("Sending %s failed: %s", o.Offer().Name, done.Error))
+		} else {
+			appendText(fmt.Sprintf("%s received %s", nickOf(peerNick), o.Offer().Name))
+		}
+		return false
+	})
+}
+
+func (peerHandler) Disconnect() {
+	// TODO: disable message sending
+
+	// partial files are kept, so offering them again resumes
+	transferMu.Lock()
+	for id, in := range incoming {
+		in.Close()
+		delete(incoming, id)
+	}
+	transferMu.Unlock()
+
+	glib.IdleAdd(func() bool {
+		for id, o := range outgoing {
+			o.Cancel()
+			delete(outgoing, id)
+		}
+		for id := range progressBars {
+			removeProgress(id)
+		}
+		return false
+	})
+}
+
+func (peerHandler) Auth(auth *proto.Auth) {
+	// TODO: something
+	fmt.Printf("Received Auth packet for some reason? %s\n", auth)
+}
+
+func (peerHandler) Status(status *proto.Status) {
+	glib.IdleAdd(func() bool {
+		// a notice, or a presence state this window doesn't know
+		if status.Presence() == "" {
+			appendText(status.Payload)
+		} else {
+			showPresence(status)
+		}
+		return false
+	})
+}
+
+func (peerHandler) User(user *proto.User) {
+	glib.IdleAdd(func() bool {
+		showProfile(user)
+		return false
+	})
+}
+
+func (peerHandler) Roster(roster *proto.Roster) {
+	txt := ""
+	for _, user := range *roster {
+		txt += fmt.Sprintf("User: %s %x\n", user.Aliases, user.Key)
+	}
+
+	glib.IdleAdd(func() bool {
+		appendText(txt)
+		return false
+	})
+}
+
+func (peerHandler) Command(cmd *proto.Command) {
+	switch cmd.Cmd {
+	case "NICK":
+		if cmd.Payload != nil {
+			oldNick := peerNick
+			peerNick = cmd.Payload[0]
+			glib.IdleAdd(func() bool {
+				appendText(fmt.Sprintf("%s is now known as %s", oldNick, cmd.Payload))
+				return false
+			})
+		} else {
+			peerNick = defaultPeerNick
+		}
+	default:
+		glib.IdleAdd(func() bool {
+			appendMsg(time.Now(), peerNick, cmd.Cmd)
+			return false
+		})
+	}
+
+}
 
-	chat       *gtk.TextView
-	chatBuffer *gtk.TextBuffer
-	chatScroll *gtk.ScrolledWindow
-	entry      *gtk.Entry
+func (peerHandler) RoomMemberJoin(member *proto.RoomMemberJoin) {
+	glib.IdleAdd(func() bool {
+		appendWithTag(fmt.Sprintf("%s joined the channel", *member), tagJoin)
+		return false
+	})
+}
+
+func (peerHandler) RoomMemberPart(msg *proto.RoomMemberPart) {
+	glib.IdleAdd(func() bool {
+		var desc string
+		if msg.HasQuit {
+			desc = "has quit"
+		} else {
+			desc = "left the channel"
+		}
+
+		appendWithTag(fmt.Sprintf("%s %s (%s)",
+			msg.Member, desc, msg.Msg), tagPart)
+
+		return false
+	})
+}
+
+// setTyping tells the peer whether we're typing
+func setTyping(state int8) {
+	if state == typingSent && state != proto.TypingActive {
+		return
+	}
+
+	if !sock.HasCap(proto.CapTyping) {
+		return
+	}
+
+	typing := proto.Typing{
+		To:    *peerName,
+		From:  config.Nickname,
+		State: state,
+	}
+
+	err := sock.Send(&typing)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	typingSent = state
+	typingSentAt = time.Now()
+}
+
+func stopTypingTimer() {
+	if typingPauseTimer != 0 {
+		glib.SourceRemove(typingPauseTimer)
+		typingPauseTimer = 0
+	}
+}
+
+// entryChanged sends typing notifications as the user edits the entry
+func entryChanged() {
+	text, err := entry.GetText()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	stopTypingTimer()
+
+	// commands aren't messages
+	if text == "" || strings.HasPrefix(text, "/") {
+		setTyping(proto.TypingDone)
+		return
+	}
+
+	if typingSent != proto.TypingActive || time.Since(typingSentAt) >= typingThrottle {
+		setTyping(proto.TypingActive)
+	}
+
+	typingPauseTimer = glib.TimeoutAdd(uint(typingPauseAfter/time.Millisecond), func() bool {
+		typingPauseTimer = 0
+		if typingSent == proto.TypingActive {
+			setTyping(proto.TypingPaused)
+		}
+		return false
+	})
+}
+
+// peerTyping updates the typing state of who and the label showing it
+func peerTyping(who string, state int8) {
+	who = nickOf(who)
+
+	if state == proto.TypingActive {
+		typers[who] = time.Now().Add(typingExpire)
+	} else {
+		delete(typers, who)
+	}
+
+	updateTypingLabel()
+
+	// expire typers that stop without telling us
+	if len(typers) > 0 && !typersTicking {
+		typersTicking = true
+		glib.TimeoutAdd(1000, func() bool {
+			updateTypingLabel()
+			typersTicking = len(typers) > 0
+			return typersTicking
+		})
+	}
+}
+
+func updateTypingLabel() {
+	var names []string
+	for who, expires := range typers {
+		if time.Now().After(expires) {
+			delete(typers, who)
+		} else {
+			names = append(names, who)
+		}
+	}
+	sort.Strings(names)
+
+	switch len(names) {
+	case 0:
+		typingLabel.SetText("")
+	case 1:
+		typingLabel.SetText(names[0] + " is typing…")
+	case 2:
+		typingLabel.SetText(names[0] + " and " + names[1] + " are typing…")
+	default:
+		typingLabel.SetText("Several people are typing…")
+	}
+}
+
+// seenMessage remembers a received message ID, and reports whether it was
+// seen before.
+func seenMessage(id string) bool {
+	if seenIDs[id] {
+		return true
+	}
+
+	seenIDs[id] = true
+	seenOrder = append(seenOrder, id)
+	if len(seenOrder) > maxSeenIDs {
+		delete(seenIDs, seenOrder[0])
+		seenOrder = seenOrder[1:]
+	}
+
+	return false
+}
+
+func sendReceipt(status int8, ids ...string) {
+	if !sock.HasCap(proto.CapReceipts) {
+		return
+	}
+
+	receipt := proto.Receipt{
+		To:     *peerName,
+		From:   config.Nickname,
+		IDs:    ids,
+		Status: status,
+		Date:   time.Now().Unix(),
+	}
+
+	err := sock.Send(&receipt)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// sendReadReceipts tells the peer we've seen everything they sent
+func sendReadReceipts() {
+	if len(unread) == 0 {
+		return
+	}
+
+	sendReceipt(proto.ReceiptRead, unread...)
+	unread = nil
+}
+
+// trackSent shows a marker after one of our messages, and updates it as
+// receipts for id come in.
+func trackSent(id string, ml *msgLine) {
+	if ml == nil || !sock.HasCap(proto.CapReceipts) {
+		return
+	}
+
+	sm := &sentMsg{line: ml}
+	sentMsgs[id] = sm
+	setMarker(sm, markerPending)
+
+	sm.timer = time.AfterFunc(ackTimeout, func() {
+		glib.IdleAdd(func() bool {
+			if sm.marker == markerPending {
+				setMarker(sm, markerFailed)
+				appendText(fmt.Sprintf("A message was not acknowledged within %s and may not have been sent", ackTimeout))
+			}
+			return false
+		})
+	})
+}
+
+// setMarker replaces the marker of a sent message
+func setMarker(sm *sentMsg, marker string) {
+	start := lineEnd(sm.line)
+
+	if sm.marker != "" {
+		end := *start
+		end.ForwardChars(utf8.RuneCountInString(sm.marker) + 1)
+		chatBuffer.Delete(start, &end)
+	}
+
+	chatBuffer.InsertWithTag(start, " "+marker, tagMark)
+	sm.marker = marker
+}
+
+// nickOf returns how to show a sender: the display name in their profile, or
+// else the sender without an IRC style user and host
+func nickOf(who string) string {
+	if who == "" {
+		who = peerNick
+	}
+	if user, ok := profiles.Get(who); ok && user.DisplayName != "" {
+		return user.DisplayName
+	}
+	if idx := strings.Index(who, "!"); idx > -1 {
+		who = who[:idx]
+	}
+
+	return profiles.DisplayName(who)
+}
+
+// trackLine remembers where the text of the message just added to the chat
+// starts, so Edit and Retract can find it by id.
+func trackLine(id string, from string, own bool, start int, text string) *msgLine {
+	if id == "" || msgLines[id] != nil {
+		return nil
+	}
+
+	startIter := chatBuffer.GetIterAtOffset(start)
+	end := chatBuffer.GetEndIter()
+	if startIter.Equal(end) {
+		// an empty text has no tag to find its end by
+		return nil
+	}
+
+	ml := &msgLine{
+		from:  from,
+		own:   own,
+		text:  text,
+		start: chatBuffer.CreateMark("msg-"+id, startIter, true),
+		tag:   chatBuffer.CreateTag("", nil),
+	}
+	chatBuffer.ApplyTag(ml.tag, startIter, end)
+
+	msgLines[id] = ml
+	lineOrder = append(lineOrder, id)
+	if len(lineOrder) > maxLines {
+		forgetLine(lineOrder[0])
+		lineOrder = lineOrder[1:]
+	}
+
+	return ml
+}
+
+func forgetLine(id string) {
+	ml := msgLines[id]
+	delete(msgLines, id)
+
+	if sm, ok := sentMsgs[id]; ok {
+		sm.timer.Stop()
+		delete(sentMsgs, id)
+	}
+
+	chatBuffer.DeleteMark(ml.start)
+	if table, err := chatBuffer.GetTagTable(); err == nil {
+		table.Remove(ml.tag)
+		if ml.reactTag != nil {
+			table.Remove(ml.reactTag)
+		}
+	}
+}
+
+// lineEnd returns the end of a message's text
+func lineEnd(ml *msgLine) *gtk.TextIter {
+	end := chatBuffer.GetIterAtMark(ml.start)
+	end.ForwardToTagToggle(ml.tag)
+	return end
+}
+
+// editLine replaces the text of a message
+func editLine(ml *msgLine, text string) {
+	chatBuffer.Delete(chatBuffer.GetIterAtMark(ml.start), lineEnd(ml))
+
+	end := chatBuffer.GetIterAtMark(ml.start)
+	insertText(end, text)
+	chatBuffer.InsertWithTag(end, " (edited)", tagMark)
+	chatBuffer.ApplyTag(ml.tag, chatBuffer.GetIterAtMark(ml.start), end)
+
+	ml.text = text
+}
+
+// retractLine strikes through the text of a message
+func retractLine(ml *msgLine, reason string) {
+	if ml.retracted {
+		return
+	}
+
+	note := " (deleted)"
+	if reason != "" {
+		note = fmt.Sprintf(" (deleted: %s)", reason)
+	}
+
+	end := lineEnd(ml)
+	chatBuffer.ApplyTag(tagStrike, chatBuffer.GetIterAtMark(ml.start), end)
+	chatBuffer.InsertWithTag(end, note, tagMark)
+	chatBuffer.ApplyTag(ml.tag, chatBuffer.GetIterAtMark(ml.start), end)
+
+	ml.retracted = true
+}
+
+// react records who's reaction to a message, and redraws the reactions under
+// it.
+func react(ml *msgLine, who string, emoji string, remove bool, count int) {
+	if ml.reactions == nil {
+		ml.reactions = make(map[string]*reaction)
+	}
+
+	r, ok := ml.reactions[emoji]
+	if !ok {
+		r = &reaction{users: make(map[string]bool)}
+		ml.reactions[emoji] = r
+	}
+
+	if remove {
+		delete(r.users, who)
+		if count == 0 && r.total > 0 {
+			r.total--
+		}
+	} else {
+		r.users[who] = true
+	}
+
+	if count != 0 {
+		r.total = count
+	}
+
+	if r.count() == 0 {
+		delete(ml.reactions, emoji)
+	}
+
+	drawReactions(ml)
+}
+
+// drawReactions replaces the line of reactions under a message
+func drawReactions(ml *msgLine) {
+	if ml.reactTag == nil {
+		ml.reactTag = chatBuffer.CreateTag("", nil)
+	} else if start := lineEnd(ml); start.ForwardToTagToggle(ml.reactTag) {
+		end := *start
+		end.ForwardToTagToggle(ml.reactTag)
+		chatBuffer.Delete(start, &end)
+	}
+
+	if len(ml.reactions) == 0 {
+		return
+	}
+
+	var emojis []string
+	for emoji := range ml.reactions {
+		emojis = append(emojis, emoji)
+	}
+	sort.Strings(emojis)
+
+	text := "\n     "
+	for _, emoji := range emojis {
+		part := fmt.Sprintf("%s %d", emoji, ml.reactions[emoji].count())
+		if ml.reactions[emoji].users[config.Nickname] {
+			part = "[" + part + "]"
+		}
+		text += " " + part
+	}
+
+	// after the receipt marker, at the end of the message's last line
+	end := lineEnd(ml)
+	if !end.EndsLine() {
+		end.ForwardToLineEnd()
+	}
+
+	start := end.GetOffset()
+	chatBuffer.InsertWithTag(end, text, tagReact)
+	chatBuffer.ApplyTag(ml.reactTag, chatBuffer.GetIterAtOffset(start), end)
+}
+
+// toggleReaction adds our reaction to the last message, or removes it if it
+// is already there.
+func toggleReaction(emoji string) {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" {
+		appendText("Usage: /react {emoji}")
+		return
+	}
+
+	if !sock.HasCap(proto.CapReactions) {
+		appendText(nickOf(peerNick) + " can't show reactions")
+		return
+	}
+
+	if len(lineOrder) == 0 {
+		appendText("There is no message to react to")
+		return
+	}
+
+	id := lineOrder[len(lineOrder)-1]
+	ml := msgLines[id]
+	r, ok := ml.reactions[emoji]
+	remove := ok && r.users[config.Nickname]
+
+	reaction := proto.Reaction{
+		ID:     id,
+		To:     *peerName,
+		From:   config.Nickname,
+		Emoji:  emoji,
+		Remove: remove,
+	}
+
+	err := sock.Send(&reaction)
+	if err != nil {
+		appendText("Error sending reaction: " + err.Error())
+		return
+	}
+
+	react(ml, config.Nickname, emoji, remove, 0)
+}
+
+// offerFile hashes the file at path and offers it to the peer
+func offerFile(path string) {
+	if !sock.HasCap(proto.CapFiles) {
+		appendText(nickOf(peerNick) + " can't receive files")
+		return
+	}
+
+	// hashing a large file takes a while
+	go func() {
+		o, err := transfer.NewOutgoing(path, *peerName, config.Nickname)
+
+		glib.IdleAdd(func() bool {
+			if err != nil {
+				appendText("Could not send file: " + err.Error())
+				return false
+			}
+
+			offer := o.Offer()
+			if err := sock.Send(offer); err != nil {
+				appendText("Error offering file: " + err.Error())
+				return false
+			}
+
+			outgoing[offer.ID] = o
+			appendText(fmt.Sprintf("Offering %s (%s) to %s", offer.Name, formatSize(offer.Size), nickOf(peerNick)))
+			if session != nil {
+				appendWithTag("Files are not encrypted, even in an encrypted session", tagPart)
+			}
+			return false
+		})
+	}()
+}
+
+// sendFileData sends an accepted file on its own goroutine
+func sendFileData(o *transfer.Outgoing, offset int64) {
+	offer := o.Offer()
+	label := "Sending " + offer.Name
+	showProgress(offer.ID, label, offset, offer.Size)
+
+	go func() {
+		last := percent(offset, offer.Size)
+		err := o.Send(&sock, offset, func(sent int64) {
+			if p := percent(sent, offer.Size); p != last {
+				last = p
+				glib.IdleAdd(func() bool {
+					showProgress(offer.ID, label, sent, offer.Size)
+					return false
+				})
+			}
+		})
+		if err == nil || errors.Is(err, transfer.ErrCanceled) {
+			return
+		}
+
+		sock.Send(&proto.FileComplete{
+			ID:    offer.ID,
+			To:    offer.To,
+			From:  offer.From,
+			Error: err.Error(),
+		})
+
+		glib.IdleAdd(func() bool {
+			delete(outgoing, offer.ID)
+			removeProgress(offer.ID)
+			appendText(fmt.Sprintf("Sending %s failed: %s", offer.Name, err))
+			return false
+		})
+	}()
+}
+
+// answerOffer accepts or rejects the oldest file offer
+func answerOffer(accept bool) {
+	if len(offers) == 0 {
+		appendText("No file has been offered")
+		return
+	}
+
+	offer := offers[0]
+	offers = offers[1:]
+
+	answer := proto.FileAccept{
+		ID:     offer.ID,
+		To:     offer.From,
+		From:   config.Nickname,
+		Reject: true,
+	}
+
+	var in *transfer.Incoming
+	if accept {
+		var err error
+		in, err = transfer.NewIncoming(offer, transfer.DownloadDir())
+		if err != nil {
+			appendText("Could not receive file: " + err.Error())
+		} else {
+			answer = *in.Accept(config.Nickname)
+		}
+	}
+
+	if in != nil {
+		transferMu.Lock()
+		incoming[offer.ID] = in
+		transferMu.Unlock()
+	}
+
+	err := sock.Send(&answer)
+	if err != nil {
+		appendText("Error answering file offer: " + err.Error())
+		return
+	}
+
+	if in == nil {
+		return
+	}
+
+	if received := in.Received(); received > 0 {
+		appendText(fmt.Sprintf("Resuming %s after %s", offer.Name, formatSize(received)))
+	}
+	showProgress(offer.ID, "Receiving "+offer.Name, in.Received(), offer.Size)
+}
+
+// endIncoming stops a transfer that failed on our side
+func endIncoming(id string, in *transfer.Incoming, err error) {
+	transferMu.Lock()
+	delete(incoming, id)
+	transferMu.Unlock()
+
+	in.Close()
+	offer := in.Offer()
+
+	sock.Send(&proto.FileComplete{
+		ID:    id,
+		To:    offer.From,
+		From:  config.Nickname,
+		Error: err.Error(),
+	})
+
+	glib.IdleAdd(func() bool {
+		removeProgress(id)
+		appendText("Could not receive file: " + err.Error())
+		return false
+	})
+}
+
+// dropFiles offers the files dropped on the chat
+func dropFiles(uris []string) {
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme != "file" {
+			appendText("Only local files can be sent: " + uri)
+			continue
+		}
+
+		offerFile(u.Path)
+	}
+}
+
+func percent(done, size int64) int {
+	if size <= 0 {
+		return 100
+	}
+
+	return int(done * 100 / size)
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(size)/(1<<10))
+	}
+
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// showProgress adds or updates the progress bar of a transfer
+func showProgress(id string, label string, done, size int64) {
+	bar, ok := progressBars[id]
+	if !ok {
+		var err error
+		bar, err = gtk.ProgressBarNew()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		bar.SetShowText(true)
+		transferBox.PackStart(bar, false, false, 1)
+		bar.Show()
+		progressBars[id] = bar
+	}
+
+	bar.SetFraction(float64(percent(done, size)) / 100)
+	bar.SetText(fmt.Sprintf("%s: %d%%", label, percent(done, size)))
+}
+
+func removeProgress(id string) {
+	if bar, ok := progressBars[id]; ok {
+		bar.Destroy()
+		delete(progressBars, id)
+	}
+}
+
+// excerpt shortens a message to one line for quoting
+func excerpt(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) > maxExcerpt {
+		text = string([]rune(text)[:maxExcerpt]) + "…"
+	}
+
+	return text
+}
+
+// appendQuote shows the message a reply answers, above the reply
+func appendQuote(id string) {
+	ml, ok := msgLines[id]
+	if !ok {
+		appendWithTag("↪ in reply to an earlier message", tagQuote)
+		return
+	}
+
+	text := excerpt(ml.text)
+	if ml.retracted {
+		text = "(deleted)"
+	}
+	appendWithTag("↪ "+nickOf(ml.from)+": "+text, tagQuote)
+}
+
+// lineAt returns the ID of the message shown at iter, or "" if none is
+func lineAt(iter *gtk.TextIter) string {
+	for i := len(lineOrder) - 1; i >= 0; i-- {
+		id := lineOrder[i]
+		ml := msgLines[id]
+		if iter.HasTag(ml.tag) || chatBuffer.GetIterAtMark(ml.start).GetLine() == iter.GetLine() {
+			return id
+		}
+	}
+
+	return ""
+}
+
+// setReply makes our next message answer the message with id. An empty id
+// cancels the reply.
+func setReply(id string) {
+	ml, ok := msgLines[id]
+	if !ok {
+		replyTo = ""
+		replyLabel.SetText("")
+		return
+	}
+
+	replyTo = id
+	replyLabel.SetText("Replying to " + nickOf(ml.from) + ": " + excerpt(ml.text) + " (Esc to cancel)")
+	entry.GrabFocus()
+}
+
+// populatePopup adds Reply to the chat's context menu
+func populatePopup(_ *gtk.TextView, menu *gtk.Menu) {
+	ml, ok := msgLines[popupLine]
+	if !ok || ml.retracted || !sock.HasCap(proto.CapReplies) {
+		return
+	}
+
+	sep, err := gtk.SeparatorMenuItemNew()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	item, err := gtk.MenuItemNewWithLabel("Reply")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	id := popupLine
+	item.Connect("activate", func() {
+		setReply(id)
+	})
+
+	menu.Append(sep)
+	menu.Append(item)
+	sep.Show()
+	item.Show()
+}
+
+// chatButtonPress notes which message a right click is on, for populatePopup
+func chatButtonPress(_ *gtk.TextView, event *gdk.Event) bool {
+	button := gdk.EventButtonNewFromEvent(event)
+	if button.Button() != gdk.BUTTON_SECONDARY {
+		return false
+	}
+
+	x, y := chat.WindowToBufferCoords(gtk.TEXT_WINDOW_WIDGET, int(button.X()), int(button.Y()))
+	popupLine = lineAt(chat.GetIterAtLocation(x, y))
+
+	return false
+}
+
+// lastLine returns our last message, if it can still be changed
+func lastLine() *msgLine {
+	ml, ok := msgLines[lastSent]
+	if !ok || ml.retracted {
+		appendText("There is no message to change")
+		return nil
+	}
+
+	if !sock.HasCap(proto.CapEdit) {
+		appendText(nickOf(peerNick) + " can't edit or delete messages")
+		return nil
+	}
+
+	return ml
+}
+
+// editLast replaces the text of our last message. Without a text, the entry
+// is filled with the old one to edit.
+func editLast(text string) {
+	ml := lastLine()
+	if ml == nil {
+		return
+	}
+
+	if text == "" {
+		entry.SetText("/edit " + ml.text)
+		entry.SetPosition(-1)
+		return
+	}
+
+	edit := proto.Edit{
+		ID:   lastSent,
+		To:   *peerName,
+		From: config.Nickname,
+		Date: time.Now().Unix(),
+		Msg:  text,
+	}
+
+	if session != nil {
+		sealed, err := session.Seal(text)
+		if err != nil {
+			appendText(err.Error())
+			return
+		}
+
+		edit.Encrypted = sealed
+		edit.Msg = ""
+	}
+
+	err := sock.Send(&edit)
+	if err != nil {
+		appendText("Error sending edit: " + err.Error())
+		return
+	}
+
+	editLine(ml, text)
+}
+
+// retractLast withdraws our last message
+func retractLast(reason string) {
+	ml := lastLine()
+	if ml == nil {
+		return
+	}
+
+	retract := proto.Retract{
+		ID:     lastSent,
+		To:     *peerName,
+		From:   config.Nickname,
+		Date:   time.Now().Unix(),
+		Reason: reason,
+	}
+
+	err := sock.Send(&retract)
+	if err != nil {
+		appendText("Error sending retraction: " + err.Error())
+		return
+	}
+
+	retractLine(ml, reason)
+}
+
+func loadIdentity() error {
+	if identity != nil {
+		return nil
+	}
+
+	path := *identityFile
+	if path == "" {
+		path = proto.DefaultIdentityFile(config.Nickname)
+	}
+
+	var err error
+	identity, err = proto.LoadOrCreateIdentity(path)
+	return err
+}
+
+// showPresence shows the peer's presence in the header, and notes changes of
+// it in the chat
+func showPresence(status *proto.Status) {
+	text := nickOf(status.User) + " is " + status.Presence()
+	if status.Since != 0 {
+		since := time.Unix(status.Since, 0)
+		if time.Since(since) < 24*time.Hour {
+			text += " since " + timestamp(since)
+		} else {
+			text += " since " + since.Format("2006/01/02")
+		}
+	}
+	if status.Payload != "" {
+		text += ": " + status.Payload
+	}
+
+	changed := status.Status != peerPresence
+	peerPresence = status.Status
+
+	headerLabel.SetText(text)
+	updateTitle()
+
+	if changed {
+		appendWithTag(text, tagJoin)
+	}
+}
+
+// updateTitle shows who the chat is with, and their presence, in the title
+func updateTitle() {
+	title := profiles.DisplayName(*peerName)
+
+	presence := proto.Status{Status: peerPresence}
+	if name := presence.Presence(); name != "" {
+		title += " (" + name + ")"
+	}
+
+	window.SetTitle(title)
+}
+
+// showProfile remembers a user's profile. The peer's is shown in the title,
+// and in the header's tooltip.
+func showProfile(user *proto.User) {
+	if user.Name == "" {
+		return
+	}
+
+	profile := profiles.Update(user)
+
+	nick, _, _ := strings.Cut(peerNick, "!")
+	if !strings.EqualFold(user.Name, *peerName) && !strings.EqualFold(user.Name, nick) {
+		return
+	}
+
+	updateTitle()
+
+	lines := []string{profile.Name}
+	if profile.DisplayName != "" {
+		lines[0] = fmt.Sprintf("%s (%s)", profile.DisplayName, profile.Name)
+	}
+	if len(profile.Aliases) > 0 {
+		lines = append(lines, "Also known as "+strings.Join(profile.Aliases, ", "))
+	}
+	if len(profile.Key) > 0 {
+		lines = append(lines, fmt.Sprintf("Key %x", profile.Key))
+	}
+	if profile.LastSeen != 0 {
+		lines = append(lines, "Last seen "+time.Unix(profile.LastSeen, 0).Format("2006/01/02 15:04"))
+	}
+	if profile.Avatar != "" {
+		lines = append(lines, "Avatar "+profile.Avatar)
+	}
+
+	headerLabel.SetTooltipText(strings.Join(lines, "\n"))
+}
+
+func setE2EStatus(status string) {
+	e2eLabel.SetText(status)
+}
+
+// startE2E offers the peer an encrypted session
+func startE2E() {
+	if !sock.HasCap(proto.CapE2E) {
+		appendText(nickOf(peerNick) + " does not support encryption")
+		return
+	}
+
+	if err := loadIdentity(); err != nil {
+		appendText("Could not load identity: " + err.Error())
+		return
+	}
+
+	sess, err := proto.NewSession(identity, config.Nickname, false)
+	if err != nil {
+		appendText("Could not start encryption: " + err.Error())
+		return
+	}
 
-	tagNick *gtk.TextTag
-	tagMono *gtk.TextTag
-	tagURL  *gtk.TextTag
-	tagJoin *gtk.TextTag
-	tagPart *gtk.TextTag
-)
+	if err := sendKeyExchange(sess); err != nil {
+		return
+	}
 
-func timestamp(t time.Time) string {
-	return t.Format("15:04")
+	pending = sess
+	setE2EStatus("Negotiating encryption...")
 }
 
-func cb_Message(msg *proto.Message) {
-	// called when we receive a message
-
-	if msg.From != "" {
-		peerNick = msg.From
+func sendKeyExchange(sess *proto.Session) error {
+	err := sock.Send(sess.Offer(*peerName, config.Nickname))
+	if err != nil {
+		appendText("Error sending key exchange: " + err.Error())
 	}
 
-	var msgTime time.Time
+	return err
+}
 
-	if msg.Date != 0 {
-		msgTime = time.Unix(msg.Date, 0)
-	} else {
-		msgTime = time.Now()
+// pinName returns the name the key in kx is remembered under: who this window
+// talks to, or for windows opened by a listener, the name the peer signed as
+func pinName(kx *proto.KeyExchange) string {
+	if *peerName != "" {
+		return *peerName
 	}
 
-	glib.IdleAdd(func() bool {
-		appendMsg(msgTime, msg.From, msg.Msg)
-		return false
-	})
+	return kx.From
 }
 
-func cb_Text(txt string) {
-	fmt.Println(txt)
-	glib.IdleAdd(func() bool {
-		appendText(txt)
-		return false
-	})
-}
+// keyExchange handles the peer's half of a key exchange
+func keyExchange(kx *proto.KeyExchange) {
+	if err := proto.VerifyKeyExchange(kx); err != nil {
+		appendText(err.Error())
+		return
+	}
 
-func cb_Disconnect() {
-	// TODO: disable message sending
-}
+	for _, s := range []*proto.Session{session, untrusted} {
+		if s != nil && bytes.Equal(s.Peer().Ephemeral, kx.Ephemeral) {
+			appendText("Ignoring a replayed key exchange")
+			return
+		}
+	}
 
-func cb_Auth(auth *proto.Auth) {
-	// TODO: something
-	fmt.Printf("Received Auth packet for some reason? %s\n", auth)
-}
+	sess := pending
+	if !kx.Reply {
+		// if both sides offered at once, only one answers
+		if pending != nil && !pending.Yields(kx) {
+			return
+		}
 
-func cb_Status(status *proto.Status) {
-	txt := fmt.Sprintf("%d: %s", status.Status, status.Payload)
+		if err := loadIdentity(); err != nil {
+			appendText("Could not load identity: " + err.Error())
+			return
+		}
 
-	glib.IdleAdd(func() bool {
-		appendText(txt)
-		return false
-	})
-}
+		var err error
+		sess, err = proto.NewSession(identity, config.Nickname, true)
+		if err != nil {
+			appendText("Could not start encryption: " + err.Error())
+			return
+		}
+	} else if pending == nil {
+		appendText("Ignoring a key exchange reply that was not asked for")
+		return
+	}
 
-func cb_Roster(roster *proto.Roster) {
-	txt := ""
-	for _, user := range *roster {
-		txt += fmt.Sprintf("User: %s %x\n", user.Aliases, user.Key)
+	if err := sess.Complete(kx); err != nil {
+		appendText("Key exchange failed: " + err.Error())
+		return
 	}
 
-	glib.IdleAdd(func() bool {
-		appendText(txt)
-		return false
-	})
-}
+	if !kx.Reply {
+		if err := sendKeyExchange(sess); err != nil {
+			return
+		}
+	}
 
-func cb_Command(cmd *proto.Command) {
-	switch cmd.Cmd {
-	case "NICK":
-		if cmd.Payload != nil {
-			oldNick := peerNick
-			peerNick = cmd.Payload[0]
-			glib.IdleAdd(func() bool {
-				appendText(fmt.Sprintf("%s is now known as %s", oldNick, cmd.Payload))
-				return false
-			})
+	pending = nil
+	session = nil
+	untrusted = nil
+
+	name := pinName(kx)
+	status := proto.KeyUnknown
+	var err error
+	if name == "" {
+		err = errors.New("The peer has no name to remember their key by")
+	} else {
+		status, err = proto.CheckPeerKey(proto.DefaultKnownKeysFile(), name, kx.Identity)
+	}
+
+	switch status {
+	case proto.KeyNew:
+		session = sess
+		if err != nil {
+			appendText(fmt.Sprintf("Encrypted session started. Could not remember %s's key %x: %s", name, kx.Identity, err))
 		} else {
-			peerNick = defaultPeerNick
+			appendText(fmt.Sprintf("Encrypted session started. Remembering %s's key %x", name, kx.Identity))
 		}
+		setE2EStatus("Encrypted (new key)")
+	case proto.KeyKnown:
+		session = sess
+		appendText("Encrypted session started")
+		setE2EStatus("Encrypted")
+	case proto.KeyChanged:
+		untrusted = sess
+		appendWithTag(fmt.Sprintf("WARNING: %s's key has changed to %x! "+
+			"Someone may be impersonating them. Use /trust to accept the new key.", name, kx.Identity), tagPart)
+		setE2EStatus("Not encrypted: the peer's key CHANGED")
 	default:
-		glib.IdleAdd(func() bool {
-			appendMsg(time.Now(), peerNick, cmd.Cmd)
-			return false
-		})
+		untrusted = sess
+		appendWithTag(fmt.Sprintf("Could not check the peer's key %x (%s). Use /trust to accept it.",
+			kx.Identity, err), tagPart)
+		setE2EStatus("Not encrypted: the peer's key is unchecked")
 	}
-
 }
 
-func cb_RoomMemberJoin(member *proto.RoomMemberJoin) {
-	glib.IdleAdd(func() bool {
-		appendWithTag(fmt.Sprintf("%s joined the channel", *member), tagJoin)
-		return false
-	})
-}
+// trustPeer accepts the key of a session that is waiting for it, and starts
+// using the session
+func trustPeer() {
+	if untrusted == nil {
+		appendText("There is no key waiting to be trusted")
+		return
+	}
 
-func cb_RoomMemberPart(msg *proto.RoomMemberPart) {
-	glib.IdleAdd(func() bool {
-		var desc string
-		if msg.HasQuit {
-			desc = "has quit"
-		} else {
-			desc = "left the channel"
+	kx := untrusted.Peer()
+	if name := pinName(kx); name != "" {
+		if err := proto.TrustPeerKey(proto.DefaultKnownKeysFile(), name, kx.Identity); err != nil {
+			appendText("Could not save key: " + err.Error())
+			return
 		}
+	}
 
-		appendWithTag(fmt.Sprintf("%s %s (%s)",
-			msg.Member, desc, msg.Msg), tagPart)
+	session = untrusted
+	untrusted = nil
 
-		return false
-	})
+	appendText(fmt.Sprintf("Now trusting the key %x", kx.Identity))
+	setE2EStatus("Encrypted")
 }
 
 func scrollToBottom() {
@@ -197,6 +1672,146 @@ func appendWithTag(text string, tag *gtk.TextTag) {
 	chatBuffer.InsertWithTag(end, str, tag)
 }
 
+// appendCard adds a line of an attachment or embed card
+func appendCard(text string, tag *gtk.TextTag) {
+	end := chatBuffer.GetEndIter()
+	start := end.GetOffset()
+
+	chatBuffer.InsertWithTag(end, "\n│ ", tagMark)
+	if tag != nil {
+		chatBuffer.InsertWithTag(end, text, tag)
+	} else {
+		chatBuffer.Insert(end, text)
+	}
+
+	chatBuffer.ApplyTag(tagCard, chatBuffer.GetIterAtOffset(start), end)
+}
+
+// appendCards shows the attachments and embeds of a message below its text
+func appendCards(attachments []proto.Attachment, embeds []proto.Embed) {
+	for _, a := range attachments {
+		var details []string
+		if a.Type != "" {
+			details = append(details, a.Type)
+		}
+		if a.Size > 0 {
+			details = append(details, formatSize(a.Size))
+		}
+
+		name := "📎 " + a.Name
+		if len(details) > 0 {
+			name += " (" + strings.Join(details, ", ") + ")"
+		}
+
+		appendCard(name, tagNick)
+		if a.URL != "" {
+			appendCard(a.URL, tagURL)
+			if strings.HasPrefix(a.Type, "image/") {
+				appendThumbnail(a.URL)
+			}
+		}
+	}
+
+	for _, e := range embeds {
+		if e.Title != "" {
+			appendCard(e.Title, tagNick)
+		}
+		if e.Description != "" {
+			for _, line := range strings.Split(e.Description, "\n") {
+				appendCard(line, nil)
+			}
+		}
+		if e.URL != "" {
+			appendCard(e.URL, tagURL)
+		}
+		if e.Thumbnail != "" {
+			appendThumbnail(e.Thumbnail)
+		}
+	}
+}
+
+// appendThumbnail adds a line for an image, which is shown once downloaded
+func appendThumbnail(imageURL string) {
+	if !*loadImages || !(strings.HasPrefix(imageURL, "https://") || strings.HasPrefix(imageURL, "http://")) {
+		return
+	}
+
+	appendCard("", nil)
+	thumbnails++
+	mark := chatBuffer.CreateMark(fmt.Sprintf("thumbnail-%d", thumbnails), chatBuffer.GetEndIter(), true)
+
+	go func() {
+		pixbuf, err := fetchThumbnail(imageURL)
+
+		glib.IdleAdd(func() bool {
+			if err != nil {
+				log.Printf("thumbnail %s: %s", imageURL, err)
+			} else {
+				chatBuffer.InsertPixbuf(chatBuffer.GetIterAtMark(mark), pixbuf)
+			}
+			chatBuffer.DeleteMark(mark)
+			return false
+		})
+	}()
+}
+
+// fetchThumbnail downloads an image and scales it down to thumbnailSize
+func fetchThumbnail(imageURL string) (*gdk.Pixbuf, error) {
+	client := http.Client{Timeout: thumbnailTimeout}
+	res, err := client.Get(imageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %s", res.Status)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "image/") {
+		return nil, fmt.Errorf("Not an image: %s", res.Header.Get("Content-Type"))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxThumbnailData+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxThumbnailData {
+		return nil, fmt.Errorf("Image is larger than %s", formatSize(maxThumbnailData))
+	}
+
+	loader, err := gdk.PixbufLoaderNew()
+	if err != nil {
+		return nil, err
+	}
+
+	pixbuf, err := loader.WriteAndReturnPixbuf(data)
+	if err != nil {
+		return nil, err
+	}
+
+	w, h := pixbuf.GetWidth(), pixbuf.GetHeight()
+	if w <= thumbnailSize && h <= thumbnailSize {
+		return pixbuf, nil
+	}
+
+	if w > h {
+		h = h * thumbnailSize / w
+		w = thumbnailSize
+	} else {
+		w = w * thumbnailSize / h
+		h = thumbnailSize
+	}
+
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	return pixbuf.ScaleSimple(w, h, gdk.INTERP_BILINEAR)
+}
+
 func escapePango(msg string) string {
 	msg = strings.ReplaceAll(msg, "&", "&amp;")
 	msg = strings.ReplaceAll(msg, "<", "&lt;")
@@ -205,7 +1820,9 @@ func escapePango(msg string) string {
 	return msg
 }
 
-func appendMsg(t time.Time, who string, msg string) {
+// appendMsg adds a message to the chat, returning the offset its text starts
+// at.
+func appendMsg(t time.Time, who string, msg string) int {
 	end := chatBuffer.GetEndIter()
 
 	timestampText := timestamp(t) + " "
@@ -218,14 +1835,18 @@ func appendMsg(t time.Time, who string, msg string) {
 
 	chatBuffer.InsertWithTag(end, timestampText, tagMono)
 
-	if idx := strings.Index(who, "!"); idx > -1 {
-		who = who[:idx]
-	}
-
 	end = chatBuffer.GetEndIter()
-	chatBuffer.InsertWithTag(end, who, tagNick)
+	chatBuffer.InsertWithTag(end, nickOf(who), tagNick)
 	chatBuffer.InsertWithTag(end, " ", tagMono)
 
+	start := end.GetOffset()
+	insertText(end, msg)
+
+	return start
+}
+
+// insertText inserts a message's text with its formatting and links
+func insertText(end *gtk.TextIter, msg string) {
 	urlSearch := xurls.Relaxed()
 	indices := urlSearch.FindAllStringIndex(msg, -1)
 	if indices != nil {
@@ -283,31 +1904,61 @@ func sendCommand(cmdText string) {
 	switch strings.ToLower(cmd.Cmd) {
 	case "nick":
 		cmd.Cmd = "NICK"
-		err := sock.SendCommand(&cmd)
-		if err != nil {
-			log.Panic(err)
-		}
 	case "bye":
 		cmd.Cmd = "BYE "
-		err := sock.SendCommand(&cmd)
-		if err != nil {
-			log.Panic(err)
+	case "lag":
+		if rtt := sock.RTT(); rtt > 0 {
+			appendText(fmt.Sprintf("Round-trip time: %s", rtt))
+		} else {
+			appendText("No round-trip time measured yet")
 		}
-	case "msgpack":
-		sock.SetSendMode(proto.ModeMsgpack)
-	case "text":
-		sock.SetSendMode(proto.ModeText)
+		return
+	case "e2e":
+		startE2E()
+		return
+	case "trust":
+		trustPeer()
+		return
+	case "edit":
+		editLast(strings.Join(cmd.Payload, " "))
+		return
+	case "delete":
+		retractLast(strings.Join(cmd.Payload, " "))
+		return
+	case "react":
+		toggleReaction(strings.Join(cmd.Payload, " "))
+		return
+	case "send":
+		if len(cmd.Payload) == 0 {
+			appendText("Usage: /send {file}")
+			return
+		}
+		offerFile(cmd.Payload[0])
+		return
+	case "accept":
+		answerOffer(true)
+		return
+	case "reject":
+		answerOffer(false)
+		return
+	case "msgpack", "text":
+		if !sock.AcceptsCommand("TEXT") {
+			appendText(nickOf(peerNick) + " can't switch protocol modes")
+			return
+		}
+
+		if strings.ToLower(cmd.Cmd) == "text" {
+			sock.SetSendMode(proto.ModeText)
+		} else {
+			sock.SetSendMode(proto.ModeMsgpack)
+		}
+		return
 	case "roster":
 		cmd.Cmd = "ROSTER"
-		sock.SendCommand(&cmd)
 
 	// IRC commands
-	case "query":
-		cmd.Cmd = "QUERY"
-		sock.SendCommand(&cmd)
-	case "q":
+	case "query", "q":
 		cmd.Cmd = "QUERY"
-		sock.SendCommand(&cmd)
 	case "msg":
 		cmd.Cmd = "PRIVMSG"
 		if len(cmd.Payload) <= 0 {
@@ -316,27 +1967,33 @@ func sendCommand(cmdText string) {
 		}
 		params := strings.SplitN(cmd.Payload[0], " ", 2)
 		cmd.Payload = params
-		sock.SendCommand(&cmd)
 	case "whois":
 		cmd.Cmd = "WHOIS"
-		sock.SendCommand(&cmd)
 	case "ping":
 		cmd.Cmd = "PING"
-		sock.SendCommand(&cmd)
 	case "join":
 		cmd.Cmd = "JOIN"
-		sock.SendCommand(&cmd)
 	case "part":
 		cmd.Cmd = "PART"
-		sock.SendCommand(&cmd)
 	case "quit":
 		cmd.Cmd = "QUIT"
-		sock.SendCommand(&cmd)
 	case "raw":
 		cmd.Cmd = "RAW"
-		sock.SendCommand(&cmd)
+	case "status":
+		cmd.Cmd = "STATUS"
 	default:
 		appendText("Unknown Command")
+		return
+	}
+
+	if !sock.AcceptsCommand(strings.TrimSpace(cmd.Cmd)) {
+		appendText(fmt.Sprintf("%s is not supported by %s", cmd.Cmd, nickOf(peerNick)))
+		return
+	}
+
+	err := sock.SendCommand(&cmd)
+	if err != nil {
+		appendText("Error sending command: " + err.Error())
 	}
 }
 
@@ -347,6 +2004,18 @@ func sendMessage(msgText string) {
 		Flags: []string{},
 		Date:  time.Now().Unix(),
 		Msg:   msgText,
+		ID:    proto.NewMessageID(),
+	}
+
+	if replyTo != "" && sock.HasCap(proto.CapReplies) {
+		msg.ReplyTo = replyTo
+	}
+
+	if session != nil {
+		if err := session.Encrypt(&msg); err != nil {
+			appendText(err.Error())
+			return
+		}
 	}
 
 	err := sock.SendMessage(&msg)
@@ -354,7 +2023,18 @@ func sendMessage(msgText string) {
 		log.Print(err)
 		appendText(err.Error())
 	} else {
-		appendMsg(time.Now(), config.Nickname, msgText)
+		if msg.ReplyTo != "" {
+			appendQuote(msg.ReplyTo)
+		}
+		setReply("")
+
+		start := appendMsg(time.Now(), config.Nickname, msgText)
+		trackSent(msg.ID, trackLine(msg.ID, config.Nickname, true, start, msgText))
+		lastSent = msg.ID
+
+		// the message itself ends typing, no need to send it
+		stopTypingTimer()
+		typingSent = proto.TypingDone
 		entry.SetText("")
 	}
 }
@@ -399,6 +2079,7 @@ func chatWindow() {
 	if err != nil {
 		log.Panic(err)
 	}
+	window = win
 
 	win.SetTitle(*peerName)
 	win.Connect("destroy", func() {
@@ -406,6 +2087,10 @@ func chatWindow() {
 	})
 
 	win.SetDefaultSize(400, 600)
+	win.Connect("focus-in-event", func() bool {
+		sendReadReceipts()
+		return false
+	})
 
 	box, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 2)
 	if err != nil {
@@ -425,6 +2110,17 @@ func chatWindow() {
 	chat.SetEditable(false)
 	chat.SetWrapMode(gtk.WRAP_WORD)
 	chat.Connect("size-allocate", scrollToBottom)
+	chat.Connect("button-press-event", chatButtonPress)
+	chat.Connect("populate-popup", populatePopup)
+
+	uriList, err := gtk.TargetEntryNew("text/uri-list", gtk.TARGET_OTHER_APP, 0)
+	if err != nil {
+		log.Panic(err)
+	}
+	chat.DragDestSet(gtk.DEST_DEFAULT_ALL, []gtk.TargetEntry{*uriList}, gdk.ACTION_COPY)
+	chat.Connect("drag-data-received", func(_ *gtk.TextView, _ *gdk.DragContext, _, _ int, data *gtk.SelectionData) {
+		dropFiles(data.GetURIs())
+	})
 	chatScroll.Add(chat)
 
 	chatBuffer, err = chat.GetBuffer()
@@ -436,6 +2132,11 @@ func chatWindow() {
 	tagMono = chatBuffer.CreateTag("", tagAttrs{"family": "Monospace"})
 	tagJoin = chatBuffer.CreateTag("", tagAttrs{"foreground": "brown"})
 	tagPart = tagJoin
+	tagMark = chatBuffer.CreateTag("", tagAttrs{"foreground": "gray"})
+	tagStrike = chatBuffer.CreateTag("", tagAttrs{"strikethrough": true})
+	tagReact = chatBuffer.CreateTag("", tagAttrs{"foreground": "#666"})
+	tagCard = chatBuffer.CreateTag("", tagAttrs{"left-margin": 24})
+	tagQuote = chatBuffer.CreateTag("", tagAttrs{"foreground": "gray", "left-margin": 12})
 
 	tagURL = chatBuffer.CreateTag("", tagAttrs{"foreground": "#88F"})
 	tagURL.Connect("event", urlEvent)
@@ -468,6 +2169,7 @@ func chatWindow() {
 	}*/
 
 	entry.Connect("activate", sendEntry)
+	entry.Connect("changed", entryChanged)
 
 	// taken from
 	// https://github.com/jimmykarily/fuzzygui/blob/7ddb72ad712e7afa5bfcb2d06b435b74caeb8140/main.go#L88
@@ -481,6 +2183,10 @@ func chatWindow() {
 		keyEvent := gdk.EventKeyNewFromEvent(event)
 		keyval := keyEvent.KeyVal()
 		state := keyEvent.State()
+		if keyval == gdk.KEY_Escape && replyTo != "" {
+			setReply("")
+			return true
+		}
 		if (state & 0x4) != 0 {
 			switch keyval {
 			case gdk.KeyvalFromName("b"):
@@ -510,20 +2216,71 @@ func chatWindow() {
 		return false
 	})
 
+	e2eLabel, err = gtk.LabelNew("Not encrypted")
+	if err != nil {
+		log.Panic(err)
+	}
+	e2eLabel.SetHAlign(gtk.ALIGN_START)
+
+	headerLabel, err = gtk.LabelNew("")
+	if err != nil {
+		log.Panic(err)
+	}
+	headerLabel.SetHAlign(gtk.ALIGN_START)
+
+	typingLabel, err = gtk.LabelNew("")
+	if err != nil {
+		log.Panic(err)
+	}
+	typingLabel.SetHAlign(gtk.ALIGN_START)
+
+	replyLabel, err = gtk.LabelNew("")
+	if err != nil {
+		log.Panic(err)
+	}
+	replyLabel.SetHAlign(gtk.ALIGN_START)
+
+	transferBox, err = gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 1)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	box.PackStart(headerLabel, false, false, 1)
 	box.PackStart(chatScroll, true, true, 1)
+	box.PackStart(transferBox, false, false, 1)
+	box.PackStart(typingLabel, false, false, 1)
+	box.PackStart(e2eLabel, false, false, 1)
+	box.PackStart(replyLabel, false, false, 1)
 	box.PackStart(entry, false, false, 1)
 
 	win.ShowAll()
 	entry.GrabFocus()
 }
 
+// attachHost starts a copy of this program for each window handed over on
+// the attach socket at addr
+func attachHost(addr string) {
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Fatal(launcher.ListenAttach(addr, &launcher.Launcher{Program: self}))
+}
+
 func main() {
 	socketFd := flag.Int("fd", -1, "file descriptor of established socket")
 	modeFlag := flag.String("mode", "msgpack", "protocol mode ('text' or 'msgpack')")
 	myNick := flag.String("user", "", "Your username")
+	attachListen := flag.String("attach-listen", "", "instead of showing a chat, take the windows bridges hand over with --chat-attach on this unix socket, and start them")
 
 	flag.Parse()
 
+	if *attachListen != "" {
+		attachHost(*attachListen)
+		return
+	}
+
 	yconfig, err := ioutil.ReadFile(xdg.ConfigHome + "/flexim/chat.yaml")
 	if err != nil {
 		log.Print(err)
@@ -551,15 +2308,31 @@ func main() {
 		fmt.Println("Invalid protocol mode:", *modeFlag)
 		os.Exit(1)
 	}
+	if *extFraming {
+		sock.SetFraming(proto.FramingVarint)
+	}
+
+	sock.SetAgent("flexim-chat")
+	sock.AddCaps(proto.CapRoomMembers, proto.CapE2E, proto.CapReceipts, proto.CapTyping, proto.CapEdit,
+		proto.CapReactions, proto.CapFiles, proto.CapReplies)
+	sock.SetCommands("NICK")
 
 	if *socketFd >= 0 {
-		err = sock.UseFD(*socketFd)
+		if *tlsAccept {
+			err = sock.UseFDTLS(*socketFd, tlsOpts)
+		} else {
+			err = sock.UseFD(*socketFd)
+		}
 		if err != nil {
 			log.Panic(err)
 		}
 	} else if *unixAddress != "" {
 		fmt.Println("Connecting to:", *unixAddress)
-		err = sock.Dial("unix", *unixAddress)
+		if *useTLS {
+			err = sock.DialTLS("unix", *unixAddress, tlsOpts)
+		} else {
+			err = sock.Dial("unix", *unixAddress)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -571,7 +2344,11 @@ func main() {
 	} else {
 		dest := flag.Arg(0)
 		fmt.Println(dest)
-		err = sock.Dial("tcp", dest)
+		if *useTLS {
+			err = sock.DialTLS("tcp", dest, tlsOpts)
+		} else {
+			err = sock.Dial("tcp", dest)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -584,9 +2361,8 @@ func main() {
 
 	chatWindow()
 
-	sock.SetCallbacks(cb_Message, cb_Command, cb_Text, cb_Disconnect, cb_Status, cb_Roster, cb_Auth)
-	sock.CB_RoomMemberJoin = cb_RoomMemberJoin
-	sock.CB_RoomMemberPart = cb_RoomMemberPart
+	sock.SetKeepalive(*keepalive, 0)
+	go sock.Serve(context.Background(), peerHandler{})
 
 	gtk.Main()
 }
@@ -1,24 +1,17 @@
 package main
 
-// Notes:
-// - the clientMap needs a mutex
-// - the server socket probably needs a mutex
-// - maybe the client sockets need mutexes?
-
 import (
-	"encoding/hex"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/adrg/xdg"
+	"github.com/mnakama/flexim-go/pkg/bridge"
 	"github.com/mnakama/flexim-go/proto"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
-	"net"
-	"os"
-	"os/signal"
 	"strings"
-	"syscall"
 	"time"
 )
 
@@ -30,250 +23,413 @@ var config struct {
 
 var (
 	server        proto.Socket
-	lastClient    *proto.Socket
-	clientMap     = make(map[string]*proto.Socket, 1)
 	serverAddress = flag.String("server", "hive.nullcorp.org:8000", "fleximd server to connect to")
 	username      = flag.String("user", "", "login name")
+	identityFile  = flag.String("identity", "", "Ed25519 identity key file, created if missing (default $XDG_CONFIG_HOME/flexim/identity-<user>.pem)")
+	identity      *proto.Identity
 	pubkey        string
-	tcplisten     = flag.String("tcplisten", "", "bind address for TCP clients")
-	unixlisten    = flag.String("listen", "", "bind address for local clients")
-
-	// X.org crashes at about 50+ visible windows with dwm
-	chatLimit = flag.Int("chatlimit", 30, "flood protection: maximum amount of open chats")
+	profiles      proto.Profiles  // of the users the server told about
+	requests      bridge.Requests // commands from chat windows, by name, waiting for a reply
+	extFraming    = flag.Bool("extframing", false, "use extended datum framing with the server (fleximd must support it)")
+	keepalive     = flag.Duration("keepalive", 30*time.Second, "interval between keepalive pings to the server; 0 disables them")
+	keepaliveWait = flag.Duration("keepalive-timeout", 0, "reconnect when nothing is received from the server for this long (default 3 keepalive intervals)")
+	keepaliveAll  = flag.Bool("keepalive-always", false, "ping the server even if it doesn't advertise keepalive (it must answer pings)")
+	useTLS        = flag.Bool("tls", false, "connect to the server with TLS")
+	tlsOpts       = proto.TLSFlags(flag.CommandLine)
+	bridgeOpts    = bridge.Flags(flag.CommandLine)
+	chats         = bridge.New(backend{}, bridgeOpts)
 )
 
-func login() error {
-	var err error
+// serverHandler receives datums from fleximd
+type serverHandler struct {
+	proto.BaseHandler
+}
 
-	server.SetMode(proto.ModeMsgpack)
+func (serverHandler) Message(msg *proto.Message) {
+	fmt.Printf("From: %s Msg: %s\n", msg.From, msg.Msg)
 
-	err = server.Dial("tcp", *serverAddress)
-	if err != nil {
-		return err
+	// Unsigned messages come from clients without identities, which go by
+	// names. A sender that is a key must have signed, and a bad signature
+	// means someone is impersonating the sender.
+	_, keyErr := proto.ParseKey(msg.From)
+	if len(msg.Signature) > 0 || keyErr == nil {
+		if err := proto.VerifyMessage(msg); err != nil {
+			log.Printf("Dropping message: %s", err)
+			return
+		}
 	}
 
-	err = server.SendHeader()
-	if err != nil {
-		log.Panic(err)
+	client, exists := chats.Window(msg.From)
+	fmt.Printf("Client: %v Exists: %v\n", client, exists)
+	if exists {
+		bridge.Send(client, msg)
+	} else {
+		fmt.Println("No chat window open for this conversation")
+		newChatIn(msg)
 	}
+}
 
-	server.SetCallbacks(func(msg *proto.Message) { // msg
-		fmt.Printf("From: %s Msg: %s\n", msg.From, msg.Msg)
+func (serverHandler) KeyExchange(kx *proto.KeyExchange) {
+	if !chats.Relay(kx.From, kx) {
+		log.Printf("Key exchange from %s, who has no chat window open", kx.From)
+	}
+}
 
-		client, exists := clientMap[msg.From]
-		fmt.Printf("Client: %v Exists: %v\n", client, exists)
-		if exists {
-			client.SendMessage(msg)
-		} else {
-			fmt.Println("No chat window open for this conversation")
-			// TODO: open chat client for incoming message
-			newChatIn(msg)
-		}
+func (serverHandler) Receipt(receipt *proto.Receipt) {
+	chats.Relay(receipt.From, receipt)
+}
 
-	}, func(cmd *proto.Command) { // cmd
-		fmt.Println(cmd)
-
-	}, func(txt string) { // txt
-		fmt.Println(txt)
-	}, func() { // disconnect
-		fmt.Println("Disconnected from server")
-		go reconnect()
-	}, func(status *proto.Status) { // status
-		if lastClient != nil {
-			lastClient.SendStatus(status)
-		}
-	}, func(roster *proto.Roster) { // roster
-		if lastClient != nil {
-			lastClient.SendRoster(roster)
-		}
-	}, func(auth *proto.Auth) { // auth
-		fmt.Printf("Challenge received: %s\n", auth.Challenge)
+func (serverHandler) Edit(edit *proto.Edit) {
+	if err := proto.VerifyEdit(edit); err != nil {
+		log.Printf("Dropping edit: %s", err)
+		return
+	}
 
-		resp := proto.AuthResponse{Challenge: auth.Challenge}
-		err := server.SendAuthResponse(&resp)
-		if err != nil {
-			log.Print(err)
-		}
-	})
+	chats.Relay(edit.From, edit)
+}
 
-	auth := proto.Command{
-		Cmd:     "AUTH",
-		Payload: []string{pubkey, *username},
+func (serverHandler) Retract(retract *proto.Retract) {
+	if err := proto.VerifyRetract(retract); err != nil {
+		log.Printf("Dropping retraction: %s", err)
+		return
 	}
-	server.SendCommand(&auth)
 
-	return nil
+	chats.Relay(retract.From, retract)
 }
 
-func reconnect() {
-	for {
-		time.Sleep(time.Second)
-		err := login()
-		if err != nil {
-			log.Println(err)
-		} else {
-			return
+func (serverHandler) Reaction(reaction *proto.Reaction) {
+	chats.Relay(reaction.From, reaction)
+}
+
+func (serverHandler) FileOffer(offer *proto.FileOffer) {
+	chats.Relay(offer.From, offer)
+}
+
+func (serverHandler) FileAccept(accept *proto.FileAccept) {
+	chats.Relay(accept.From, accept)
+}
+
+func (serverHandler) FileChunk(chunk *proto.FileChunk) {
+	chats.Relay(chunk.From, chunk)
+}
+
+func (serverHandler) FileComplete(done *proto.FileComplete) {
+	chats.Relay(done.From, done)
+}
+
+func (serverHandler) Command(cmd *proto.Command) {
+	fmt.Println(cmd)
+}
+
+func (serverHandler) Text(txt string) {
+	fmt.Println(txt)
+}
+
+func (serverHandler) Disconnect() {
+	fmt.Println("Disconnected from server")
+	go reconnect()
+}
+
+// Status goes to the chat window with the user whose presence it is. fleximd
+// doesn't say what a notice answers, so it goes to the window of the oldest
+// command waiting for a reply, or else to the status window.
+func (serverHandler) Status(status *proto.Status) {
+	if status.User != "" {
+		chats.Relay(status.User, status)
+	} else {
+		chats.Reply(requests.DoneAny(), status)
+	}
+}
+
+func (serverHandler) Roster(roster *proto.Roster) {
+	for i := range *roster {
+		if user := &(*roster)[i]; user.Name != "" {
+			profiles.Update(user)
 		}
 	}
+
+	chats.Reply(requests.Done("ROSTER"), roster)
 }
 
-func cb_Status(status *proto.Status) {
-	log.Println(status)
+// User is remembered for chat windows opened later, and goes to the chat
+// window with the user now.
+func (serverHandler) User(user *proto.User) {
+	if user.Name == "" {
+		return
+	}
+
+	profiles.Update(user)
+	chats.Relay(user.Name, user)
+}
+
+// sendProfile sends a new chat window the profile of the user it is with
+func sendProfile(client *proto.Socket, name string) {
+	if user, ok := profiles.Get(name); ok {
+		bridge.Send(client, &user)
+	}
 }
 
-func cb_Roster(roster *proto.Roster) {
-	log.Println(roster)
+func (serverHandler) Auth(auth *proto.Auth) {
+	fmt.Printf("Challenge received: %s\n", auth.Challenge)
+
+	err := server.SendAuthResponse(identity.SignAuth(auth))
+	if err != nil {
+		log.Print(err)
+	}
 }
 
-func cb_Auth(auth *proto.Auth) {
-	log.Println(auth)
+// chatHandler receives datums from a chat window
+type chatHandler struct {
+	proto.BaseHandler
+	sock *proto.Socket
+	to   string
 }
 
-func newChatIn(msg *proto.Message) {
-	if len(clientMap) >= *chatLimit {
-		fmt.Printf("Too many open chats! (%d)\nMessage: %v\n\n", len(clientMap), *msg)
+func (h *chatHandler) Message(msg *proto.Message) {
+	log.Printf("client -> server: %+v\n", msg)
+	if h.to == "" && msg.To != "" {
+		h.to = msg.To
+		chats.Register(h.to, h.sock)
+	}
+
+	if chats.IsStatus(h.to) {
+		bridge.Send(h.sock, &proto.Status{Payload: "This window shows what the server says; only commands can be sent from it"})
 		return
 	}
 
-	partner := msg.From
-	fd, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	// override From with pubkey
+	msg.From = pubkey
+	identity.SignMessage(msg)
+	err := server.SendMessage(msg)
 	if err != nil {
-		log.Panic(err)
+		log.Print(err)
+	} else if err = h.sock.SendAck(msg); err != nil {
+		log.Print(err)
 	}
 
-	var sock proto.Socket
-	sock.SetMode(proto.ModeMsgpack)
+	chats.SetLast(h.sock)
+}
 
-	err = sock.UseFD(fd[0])
-	if err != nil {
-		log.Panic(err)
+func (h *chatHandler) KeyExchange(kx *proto.KeyExchange) {
+	if h.to == "" && kx.To != "" {
+		h.to = kx.To
+		chats.Register(h.to, h.sock)
 	}
 
-	err = sock.SendHeader()
+	kx.From = pubkey
+	identity.SignKeyExchange(kx)
+	err := server.Send(kx)
 	if err != nil {
-		log.Panic(err)
+		log.Print(err)
 	}
-	err = sock.SendMessage(msg)
+
+	chats.SetLast(h.sock)
+}
+
+func (h *chatHandler) Receipt(receipt *proto.Receipt) {
+	if !server.HasCap(proto.CapReceipts) {
+		return
+	}
+
+	receipt.From = pubkey
+	err := server.Send(receipt)
 	if err != nil {
-		log.Panic(err)
+		log.Print(err)
+	}
+}
+
+func (h *chatHandler) Edit(edit *proto.Edit) {
+	if !server.HasCap(proto.CapEdit) {
+		return
 	}
 
-	clientFile := os.NewFile(uintptr(fd[1]), "")
-	if clientFile == nil {
-		log.Panicln("Could not get file from file descriptor:", fd[1])
+	edit.From = pubkey
+	identity.SignEdit(edit)
+	err := server.Send(edit)
+	if err != nil {
+		log.Print(err)
 	}
-	defer clientFile.Close()
+}
 
-	// exec
-	pattr := os.ProcAttr{
-		Files: []*os.File{nil, os.Stdout, os.Stderr, clientFile},
+func (h *chatHandler) Retract(retract *proto.Retract) {
+	if !server.HasCap(proto.CapEdit) {
+		return
 	}
 
-	proc, err := os.StartProcess("flexim-chat", []string{"flexim-chat", "--fd", "3", "--mode", "msgpack", "--to", partner, "--user", *username}, &pattr)
+	retract.From = pubkey
+	identity.SignRetract(retract)
+	err := server.Send(retract)
 	if err != nil {
 		log.Print(err)
+	}
+}
+
+func (h *chatHandler) Reaction(reaction *proto.Reaction) {
+	if !server.HasCap(proto.CapReactions) {
 		return
 	}
 
-	log.Printf("Pid: %v", proc.Pid)
+	reaction.From = pubkey
+	err := server.Send(reaction)
+	if err != nil {
+		log.Print(err)
+	}
+}
 
-	clientMap[partner] = &sock
+func (h *chatHandler) FileOffer(offer *proto.FileOffer) {
+	offer.From = pubkey
+	h.relayFile(offer)
+}
 
-	sock.SetCallbacks(func(msg *proto.Message) { //msg
-		log.Printf("client -> server: %+v\n", msg)
-		// override From with pubkey
-		msg.From = pubkey
-		server.SendMessage(msg)
+func (h *chatHandler) FileAccept(accept *proto.FileAccept) {
+	accept.From = pubkey
+	h.relayFile(accept)
+}
 
-		lastClient = &sock
-	}, func(cmd *proto.Command) { // cmd
-		log.Println(cmd)
+func (h *chatHandler) FileChunk(chunk *proto.FileChunk) {
+	chunk.From = pubkey
+	h.relayFile(chunk)
+}
+
+func (h *chatHandler) FileComplete(done *proto.FileComplete) {
+	done.From = pubkey
+	h.relayFile(done)
+}
+
+// relayFile passes a file transfer datum on to the server. Chunks wait for
+// room in the queue rather than being dropped, which would end the transfer.
+func (h *chatHandler) relayFile(datum interface{}) {
+	if !server.HasCap(proto.CapFiles) {
+		return
+	}
 
-		server.SendCommand(cmd)
-		lastClient = &sock
-	}, func(txt string) { // text
-		log.Println(txt)
+	err := server.Send(datum)
+	for errors.Is(err, proto.ErrQueueFull) {
+		time.Sleep(10 * time.Millisecond)
+		err = server.Send(datum)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
 
-	}, func() { // disconnect
-		log.Println("Chat window disconnected")
-		delete(clientMap, partner)
+func (h *chatHandler) Command(cmd *proto.Command) {
+	log.Println(cmd)
+	requests.Add(cmd.Cmd, h.sock)
+	server.SendCommand(cmd)
 
-	},
-		cb_Status, // status
-		cb_Roster, // roster
-		cb_Auth)   // auth
+	chats.SetLast(h.sock)
 }
 
-func newChatOut(conn net.Conn) {
-	sock := proto.FromConn(conn, proto.ModeMsgpack)
-	to := ""
+func (h *chatHandler) Text(txt string) {
+	log.Println(txt)
+}
 
-	sock.SetCallbacks(func(msg *proto.Message) { //msg
-		log.Printf("client -> server: %+v\n", msg)
-		if to == "" && msg.To != "" {
-			to = msg.To
-			clientMap[to] = sock
-		}
+func (h *chatHandler) Disconnect() {
+	log.Println("Chat window disconnected")
+	if h.to != "" {
+		chats.Unregister(h.to, h.sock)
+	}
+}
 
-		// override From with pubkey
-		msg.From = pubkey
-		server.SendMessage(msg)
+func login() error {
+	var err error
 
-		lastClient = sock
-	}, func(cmd *proto.Command) { // cmd
-		log.Println(cmd)
-		server.SendCommand(cmd)
+	server.SetMode(proto.ModeMsgpack)
+	if *extFraming {
+		server.SetFraming(proto.FramingVarint)
+	}
+	server.SetKeepalive(*keepalive, *keepaliveWait)
+	server.SetKeepaliveAlways(*keepaliveAll)
+	server.SetAgent("flexim-client")
+	server.AddCaps(proto.CapE2E, proto.CapReceipts, proto.CapEdit, proto.CapReactions, proto.CapFiles,
+		proto.CapReplies)
+
+	if *useTLS {
+		err = server.DialTLS("tcp", *serverAddress, tlsOpts)
+	} else {
+		err = server.Dial("tcp", *serverAddress)
+	}
+	if err != nil {
+		return err
+	}
 
-		lastClient = sock
-	}, func(txt string) { // text
-		log.Println(txt)
+	err = server.SendHeader()
+	if err != nil {
+		log.Panic(err)
+	}
 
-	}, func() { // disconnect
-		log.Println("Chat window disconnected")
-		if to != "" {
-			delete(clientMap, to)
-		}
+	go server.Serve(context.Background(), serverHandler{})
 
-	},
-		cb_Status, // status
-		cb_Roster, // roster
-		cb_Auth)   // auth
+	auth := proto.Command{
+		Cmd:     "AUTH",
+		Payload: []string{pubkey, *username},
+	}
+	server.SendCommand(&auth)
+
+	return nil
 }
 
-func listenLoop(ln net.Listener) {
+func reconnect() {
 	for {
-		conn, err := ln.Accept()
+		time.Sleep(time.Second)
+		err := login()
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
+		} else {
+			return
 		}
-
-		newChatOut(conn)
 	}
 }
 
-// Catch interrupt signal
-func waitSignal() {
-	c := make(chan os.Signal)
-
-	signal.Notify(c, os.Interrupt)
-	s := <-c
-	log.Println("Received signal:", s)
+func newChatIn(msg *proto.Message) {
+	client, err := chats.Spawn(msg.From)
+	if err != nil {
+		fmt.Printf("%s\nMessage: %v\n\n", err, *msg)
+		return
+	}
 
-	quit(0)
+	bridge.Send(client, msg)
 }
 
-// do cleanup
-func quit(ret int) {
-	fmt.Println("Closing down...")
-	os.Remove(*unixlisten)
+// backend connects chat windows to fleximd
+type backend struct{}
+
+// Hello advertises what the client does to a chat window. Commands are
+// relayed to the server, which decides what to do with them.
+func (backend) Hello(sock *proto.Socket) {
+	sock.SetAgent("flexim-client")
+	sock.SetCommands(proto.CommandAny)
+	sock.AddCaps(proto.CapReceipts)
 
-	for _, sock := range clientMap {
-		sock.Close()
+	// key exchanges are relayed as they are, if the server passes them on
+	if server.HasCap(proto.CapE2E) {
+		sock.AddCaps(proto.CapE2E)
+	}
+	if server.HasCap(proto.CapEdit) {
+		sock.AddCaps(proto.CapEdit)
+	}
+	if server.HasCap(proto.CapReactions) {
+		sock.AddCaps(proto.CapReactions)
 	}
+	if server.HasCap(proto.CapFiles) {
+		sock.AddCaps(proto.CapFiles)
+	}
+	if server.HasCap(proto.CapReplies) {
+		sock.AddCaps(proto.CapReplies)
+	}
+}
 
-	os.Exit(ret)
+func (backend) Handler(sock *proto.Socket, to string) proto.Handler {
+	return &chatHandler{sock: sock, to: to}
 }
 
+func (backend) Opened(sock *proto.Socket, to string) {
+	sendProfile(sock, to)
+}
+
+func (backend) Closed(to string) {}
+
 func main() {
 	flag.Parse()
 
@@ -293,43 +449,27 @@ func main() {
 		*username = config.Nickname
 	}
 
-	// placeholder: replace with actual pubkey when implemented
-	pubkey = hex.EncodeToString([]byte(*username))
-
-	login()
+	if *identityFile == "" {
+		*identityFile = proto.DefaultIdentityFile(*username)
+	}
 
-	if *tcplisten != "" {
-		ln, err := net.Listen("tcp", *tcplisten)
-		if err != nil {
-			log.Fatal(err)
-		}
-		go listenLoop(ln)
+	identity, err = proto.LoadOrCreateIdentity(*identityFile)
+	if err != nil {
+		log.Fatal(err)
 	}
+	pubkey = identity.KeyString()
+	chats.User = *username
+	chats.Status = *serverAddress
+
+	login()
 
 	// listen to a unix socket for clients
-	if *unixlisten == "" {
-		var err error
-		*unixlisten, err = xdg.RuntimeFile("flexim/" + strings.ReplaceAll(*serverAddress, "/", "_"))
+	if bridgeOpts.UnixListen == "" {
+		bridgeOpts.UnixListen, err = xdg.RuntimeFile("flexim/" + strings.ReplaceAll(*serverAddress, "/", "_"))
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	os.Remove(*unixlisten)
-	ln, err := net.Listen("unix", *unixlisten)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer func() {
-		r := recover()
-		if r != nil {
-			fmt.Println("Panic:", r)
-		}
-
-		quit(1)
-	}()
-
-	go listenLoop(ln)
-
-	waitSignal()
+	chats.Run()
 }
@@ -1,29 +1,26 @@
 package main
 
-// Notes:
-// - the clientMap needs a mutex
-// - the server socket probably needs a mutex
-// - maybe the client sockets need mutexes?
-
 import (
 	"bufio"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/adrg/xdg"
 	"github.com/emersion/go-sasl"
 	"github.com/gen2brain/beeep"
+	"github.com/mnakama/flexim-go/pkg/bridge"
 	"github.com/mnakama/flexim-go/proto"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"os"
-	"os/signal"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -53,17 +50,22 @@ var config struct {
 }
 
 var (
+	// mu guards the IRC connection state below. The IRC reader goroutine
+	// and every chat window's goroutine use it.
+	mu         sync.Mutex
 	irc        net.Conn
-	lastClient *proto.Socket
 	channels   = make(map[string]Channel)
-	clientMap  = make(map[string]*proto.Socket, 1)
 	myHostname string
-	tcplisten  = flag.String("tcplisten", "", "bind address for TCP clients")
-	unixlisten = flag.String("listen", "", "bind address for local clients")
-	configFile = flag.String("c", xdg.ConfigHome+"/flexim/irc.yaml", "config file")
+	ircCaps    = make(map[string]bool) // IRCv3 capabilities the server acknowledged
+	canMonitor bool                    // the server has MONITOR, see monitor
 
-	// X.org crashes at about 50+ visible windows with dwm
-	chatLimit = flag.Int("chatlimit", 30, "flood protection: maximum amount of open chats")
+	profiles   proto.Profiles                 // from WHOIS
+	whois      = make(map[string]*proto.User) // profiles being gathered from WHOIS replies
+	requests   bridge.Requests                // chat windows waiting for replies, see sendRequest
+	labelSeq   atomic.Uint64                  // last labeled-response label
+	configFile = flag.String("c", xdg.ConfigHome+"/flexim/irc.yaml", "config file")
+	bridgeOpts = bridge.Flags(flag.CommandLine)
+	chats      = bridge.New(backend{}, bridgeOpts)
 )
 
 // Send a desktop notification.
@@ -84,50 +86,82 @@ func connectToServer(cErr chan error) {
 	listenServer(irc)
 
 	backoff := time.Second
+	wait := time.Second
 	for {
-		time.Sleep(time.Second)
+		statusNotice(fmt.Sprintf("Reconnecting in %s", wait))
+		time.Sleep(wait)
 		if err := login(); err != nil {
 			log.Println(err)
-			time.Sleep(backoff)
+			setConnState(proto.StatusOffline, err.Error())
+			wait = time.Second + backoff
 			if backoff < (time.Minute * 10) {
 				backoff += time.Second
 			}
 		} else {
 			backoff = time.Second
+			wait = time.Second
 			listenServer(irc)
 		}
 	}
 }
 
+// statusNotice shows a line about the connection in the status window
+func statusNotice(text string) {
+	chats.LogStatus(&proto.Status{Payload: text})
+}
+
+// setConnState shows the state of the connection in the status window
+func setConnState(state int8, text string) {
+	chats.LogStatus(&proto.Status{
+		Status:  state,
+		User:    config.Address,
+		Payload: text,
+		Since:   time.Now().Unix(),
+	})
+}
+
 func login() (err error) {
+	statusNotice("Connecting to " + config.Address)
+
+	var conn net.Conn
 	if !config.UseTLS {
 		if strings.HasPrefix(config.Address, "/") {
-			irc, err = net.Dial("unix", config.Address)
+			conn, err = net.Dial("unix", config.Address)
 		} else {
-			irc, err = net.Dial("tcp", config.Address)
+			conn, err = net.Dial("tcp", config.Address)
 		}
 	} else {
 		tlsConfig := tls.Config{}
 		if config.TLSNoVerify {
 			tlsConfig.InsecureSkipVerify = true
 		}
-		irc, err = tls.Dial("tcp", config.Address, &tlsConfig)
+		conn, err = tls.Dial("tcp", config.Address, &tlsConfig)
 	}
 	if err != nil {
 		return
 	}
 
+	mu.Lock()
+	irc = conn
+	ircCaps = make(map[string]bool)
+	mu.Unlock()
+
 	//sendIRCCmd("CAP LS 302")
-	capReq := "server-time"
+	// request capabilities one by one, so that one the server lacks doesn't
+	// get the others refused too
+	capReq := []string{"server-time", "message-tags", "draft/message-redaction", "away-notify",
+		"batch", "labeled-response"}
 	if config.SASL.Username != "" {
-		capReq += " sasl"
+		capReq = append(capReq, "sasl")
+	}
+	for _, c := range capReq {
+		sendIRCCmd(fmt.Sprintf("CAP REQ :%s", c))
 	}
-	sendIRCCmd(fmt.Sprintf("CAP REQ :%s", capReq))
 
 	if config.ServerPassword != "" {
 		// don't echo the password
 		fmt.Println("PASS :********")
-		fmt.Fprintf(irc, "PASS :%s\r\n", config.ServerPassword)
+		fmt.Fprintf(conn, "PASS :%s\r\n", config.ServerPassword)
 	}
 	sendIRCCmd(fmt.Sprintf("NICK %s", config.Nickname))
 	sendIRCCmd(fmt.Sprintf("USER %s 0 * :%s", config.Username, config.Realname))
@@ -144,7 +178,7 @@ func login() (err error) {
 
 		b64 := base64.StdEncoding.EncodeToString(ir)
 		fmt.Printf("AUTHENTICATE base64(%s ********)\n", config.SASL.Username)
-		fmt.Fprintf(irc, "AUTHENTICATE %s\r\n", b64)
+		fmt.Fprintf(conn, "AUTHENTICATE %s\r\n", b64)
 	}
 
 	sendIRCCmd("CAP END")
@@ -164,15 +198,110 @@ func login() (err error) {
 	return
 }
 
+// monitor asks the server to tell when nick comes online or goes offline, or
+// to stop telling.
+func monitor(nick string, watch bool) {
+	mu.Lock()
+	can := canMonitor
+	mu.Unlock()
+
+	if !can || isChannel(nick) {
+		return
+	}
+
+	op := "+"
+	if !watch {
+		op = "-"
+	}
+	sendIRCCmd(fmt.Sprintf("MONITOR %s %s", op, nick))
+}
+
+// sendPresence tells the chat window for a nick about their presence, and
+// returns whether there is one. Only a private chat shows presence, so no
+// window is opened for it.
+func sendPresence(mask string, status int8, payload string, since time.Time) bool {
+	client, exists := chats.Window(strings.ToLower(nickFromMask(mask)))
+	if !exists {
+		return false
+	}
+
+	presence := proto.Status{
+		Status:  status,
+		Payload: payload,
+		User:    mask,
+	}
+	if !since.IsZero() {
+		presence.Since = since.Unix()
+	}
+	bridge.Send(client, &presence)
+
+	return true
+}
+
+// whoisProfile gathers a profile from WHOIS replies, and passes it on to the
+// nick's chat window at the end of them
+func whoisProfile(verb string, params []string) {
+	if len(params) < 2 {
+		return
+	}
+
+	nick := params[1]
+	key := strings.ToLower(nick)
+	user, ok := whois[key]
+	if !ok {
+		user = &proto.User{Name: nick}
+		whois[key] = user
+	}
+
+	switch verb {
+	case "311":
+		if len(params) >= 6 {
+			user.Aliases = append(user.Aliases, fmt.Sprintf("%s!%s@%s", nick, params[2], params[3]))
+			if params[5] != nick {
+				user.DisplayName = params[5]
+			}
+		}
+	case "330": // account
+		if len(params) >= 3 {
+			user.Aliases = append(user.Aliases, params[2])
+		}
+	case "317": // idle
+		if len(params) >= 3 {
+			if idle, err := strconv.ParseInt(params[2], 10, 64); err == nil {
+				user.LastSeen = time.Now().Unix() - idle
+			}
+		}
+	case "318": // end of WHOIS
+		delete(whois, key)
+		profile := profiles.Update(user)
+		if client, exists := chats.Window(key); exists {
+			bridge.Send(client, &profile)
+		}
+	}
+}
+
+// sendProfile sends a new chat window the profile of the nick it is with
+func sendProfile(client *proto.Socket, clientID string) {
+	if user, ok := profiles.Get(clientID); ok {
+		bridge.Send(client, &user)
+	}
+}
+
 func isChannel(name string) bool {
 	return strings.HasPrefix(name, "#") || strings.HasPrefix(name, "&")
 }
 
 func guessMask() string {
+	mu.Lock()
+	defer mu.Unlock()
+
 	return fmt.Sprintf("%s!~%s@%s", config.Nickname, config.Username, myHostname)
 }
 
 func getMaskLen() (maskLen int) {
+	mu.Lock()
+	defer mu.Unlock()
+
 	maskLen = len(config.Nickname) + len(config.Username) + 3 // len("!~@")
 	if myHostname == "" {
 		maskLen += 50
@@ -184,17 +313,69 @@ func getMaskLen() (maskLen int) {
 }
 
 func setHostname(hostname string) {
+	mu.Lock()
 	myHostname = hostname
-	log.Printf("set hostname = '%s'", myHostname)
+	mu.Unlock()
+
+	log.Printf("set hostname = '%s'", hostname)
 	log.Printf("guessed mask = '%s'", guessMask())
 }
 
+// hasCap returns whether the server acknowledged an IRCv3 capability
+func hasCap(name string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return ircCaps[name]
+}
+
+// ircConn returns the connection to the IRC server, or nil before there is one
+func ircConn() net.Conn {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return irc
+}
+
 func leaveChannel(channel string) {
+	mu.Lock()
 	delete(channels, channel)
+	mu.Unlock()
 
 	sendIRCCmd(fmt.Sprintf("PART %s", channel))
 }
 
+// Numerics of the welcome, the MOTD and the user counts, which are only kept
+// for the status window
+var serverInfo = map[string]bool{
+	"001": true, "002": true, "003": true, "004": true,
+	"250": true, "251": true, "252": true, "253": true, "254": true, "255": true,
+	"265": true, "266": true,
+	"372": true, "375": true, "376": true, "422": true,
+}
+
+// logServerInfo keeps a numeric for the status window, without opening it
+func logServerInfo(source string, params []string, timestamp time.Time) {
+	msg := proto.Message{
+		To:   "*",
+		From: source,
+	}
+	if len(params) > 1 {
+		msg.Msg = strings.Join(params[1:], " ")
+	}
+	if !timestamp.IsZero() {
+		msg.Date = timestamp.Unix()
+	}
+
+	chats.LogStatus(&msg)
+}
+
+// isServer returns whether source is a server rather than a user. Nicks can't
+// have dots, and users come with their user@host.
+func isServer(source string) bool {
+	return !strings.Contains(source, "!") && strings.Contains(source, ".")
+}
+
 func getClientID(from, to string) (id string) {
 	fromNick := from
 	nickIDX := strings.Index(from, "!")
@@ -217,29 +398,168 @@ func getClientID(from, to string) (id string) {
 	return
 }
 
-func sendIRCCmd(cmd string) {
-	if irc == nil {
+// typingStates maps IRCv3 +typing tag values to proto.Typing states
+var typingStates = map[string]int8{
+	"active": proto.TypingActive,
+	"paused": proto.TypingPaused,
+	"done":   proto.TypingDone,
+}
+
+var tagValueEscaper = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+
+// escapeTagValue escapes an IRCv3 message tag value
+func escapeTagValue(val string) string {
+	return tagValueEscaper.Replace(val)
+}
+
+// unescapeTagValue undoes the escaping of IRCv3 message tag values
+func unescapeTagValue(val string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(val); i++ {
+		if val[i] != '\\' {
+			b.WriteByte(val[i])
+			continue
+		}
+
+		i++
+		if i >= len(val) {
+			break
+		}
+
+		switch val[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(val[i])
+		}
+	}
+
+	return b.String()
+}
+
+// parseTags parses the tags of a line, without the leading @
+func parseTags(tagStr string) map[string]string {
+	tags := make(map[string]string)
+
+	for _, pair := range strings.Split(tagStr, ";") {
+		if pair == "" {
+			continue
+		}
+
+		key, val, _ := strings.Cut(pair, "=")
+		tags[key] = unescapeTagValue(val)
+	}
+
+	return tags
+}
+
+func sendIRCCmd(cmd string) error {
+	conn := ircConn()
+	if conn == nil {
 		log.Print("cannot send command; irc is nil")
-		return
+		return errors.New("Not connected to IRC")
 	}
 	fmt.Printf("%s\n", cmd)
-	fmt.Fprintf(irc, "%s\r\n", cmd)
+	_, err := fmt.Fprintf(conn, "%s\r\n", cmd)
+	return err
+}
+
+// sendRequest sends an IRC command for a chat window, and remembers the window
+// so the reply goes back to it. With labeled-response the server labels the
+// reply; otherwise it is recognized as requestKey says, if at all.
+func sendRequest(sock *proto.Socket, cmd string) error {
+	if hasCap("labeled-response") {
+		label := strconv.FormatUint(labelSeq.Add(1), 36)
+		requests.Add("label:"+label, sock)
+
+		if strings.HasPrefix(cmd, "@") {
+			cmd = "@label=" + label + ";" + cmd[1:]
+		} else {
+			cmd = "@label=" + label + " " + cmd
+		}
+	} else if key := requestKey(cmd); key != "" {
+		requests.Add(key, sock)
+	}
+
+	return sendIRCCmd(cmd)
+}
+
+// requestKey returns what the unlabeled reply to an IRC command is recognized
+// by, or "" if it can't be told from other traffic
+func requestKey(cmd string) string {
+	if strings.HasPrefix(cmd, "@") {
+		_, cmd, _ = strings.Cut(cmd, " ")
+	}
+
+	fields := strings.Fields(cmd)
+	if len(fields) < 1 {
+		return ""
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "WHOIS":
+		if len(fields) >= 2 {
+			return "whois:" + strings.ToLower(fields[len(fields)-1])
+		}
+	case "HELP", "HELPOP":
+		return "help"
+	case "MODE":
+		if len(fields) >= 2 && strings.EqualFold(fields[1], config.Nickname) {
+			return "mode"
+		}
+	case "PING":
+		if len(fields) >= 2 {
+			return "ping:" + strings.TrimPrefix(strings.Join(fields[1:], " "), ":")
+		}
+	}
+
+	return ""
+}
+
+// labeledOrigin returns the chat window a labeled-response reply goes to, or
+// nil. The lines of a labeled BATCH carry the batch reference instead.
+func labeledOrigin(tags map[string]string, verb string, params []string) (origin *proto.Socket) {
+	if ref, ok := tags["batch"]; ok {
+		origin = requests.Peek("batch:" + ref)
+	} else if label, ok := tags["label"]; ok {
+		origin = requests.Done("label:" + label)
+	}
+
+	if origin != nil && verb == "BATCH" && len(params) > 0 && strings.HasPrefix(params[0], "+") {
+		requests.Add("batch:"+params[0][1:], origin)
+	}
+
+	return
 }
 
 func execPerClientWith(member string, f func(*proto.Socket)) {
 	nick := nickFromMask(member)
 
+	var rooms []string
+	mu.Lock()
 	for channelName, c := range channels {
 		for _, member := range c.members {
 			if nick == member {
-				client := getOrStartClient(channelName)
-				f(client)
+				rooms = append(rooms, channelName)
 				break
 			}
 		}
 	}
+	mu.Unlock()
+
+	for _, channelName := range rooms {
+		client := chats.Open(channelName)
+		f(client)
+	}
 
-	if client, found := clientMap[nick]; found {
+	if client, found := chats.Window(nick); found {
 		f(client)
 	}
 }
@@ -251,6 +571,7 @@ func processIRCLine(line string) {
 
 	var (
 		timestamp time.Time
+		tags      map[string]string
 		source    string
 		verb      string
 		params    []string
@@ -261,17 +582,11 @@ func processIRCLine(line string) {
 		fields := strings.Fields(line)
 
 		if strings.HasPrefix(fields[0], "@") {
-			tagStr := fields[0][1:]
-			tagPairs := strings.Split(tagStr, ";")
-			for _, pair := range tagPairs {
-				idx := strings.Index(pair, "=")
-				key := pair[:idx]
-				val := pair[idx+1:]
-
-				if key == "time" {
-					if err := timestamp.UnmarshalText([]byte(val)); err != nil {
-						log.Printf("error parsing timestamp: %s", err)
-					}
+			tags = parseTags(fields[0][1:])
+
+			if val, ok := tags["time"]; ok {
+				if err := timestamp.UnmarshalText([]byte(val)); err != nil {
+					log.Printf("error parsing timestamp: %s", err)
 				}
 			}
 
@@ -299,6 +614,9 @@ func processIRCLine(line string) {
 		params = fields
 	}
 
+	// the chat window that asked for this, if the server says
+	origin := labeledOrigin(tags, verb, params)
+
 	if verb == "PRIVMSG" || verb == "NOTICE" {
 		to := params[0]
 		text := params[1]
@@ -309,19 +627,28 @@ func processIRCLine(line string) {
 				setHostname(text[idx+21:])
 			}
 			// only needs to be in status window
+			chats.LogStatus(&proto.Message{To: to, From: source, Msg: text})
 			return
 		}
 
 		clientID := getClientID(source, to)
 		msg := proto.Message{
-			To:   to,
-			From: source,
-			Msg:  text,
+			ID:      tags["msgid"],
+			To:      to,
+			From:    source,
+			Msg:     text,
+			ReplyTo: tags["+draft/reply"],
 		}
 		if !timestamp.IsZero() {
 			msg.Date = timestamp.Unix()
 		}
 
+		// notices of the server itself don't get a window of their own
+		if isServer(source) {
+			chats.LogStatus(&msg)
+			return
+		}
+
 		sendToClient(clientID, msg)
 
 		// don't notify for ZNC's * names
@@ -329,6 +656,140 @@ func processIRCLine(line string) {
 			strings.Contains(strings.ToLower(text), strings.ToLower(config.Nickname)) {
 			notify(clientID, fmt.Sprintf("<%s> %s", source, text))
 		}
+	} else if verb == "TAGMSG" {
+		// typing and reactions alone don't open a window
+		to := params[0]
+		client, exists := chats.Window(getClientID(source, to))
+		if !exists {
+			return
+		}
+
+		if state, ok := typingStates[tags["+typing"]]; ok {
+			typing := proto.Typing{
+				To:    to,
+				From:  source,
+				State: state,
+			}
+			bridge.Send(client, &typing)
+		}
+
+		react, isReact := tags["+draft/react"]
+		unreact, isUnreact := tags["+draft/unreact"]
+		if reply := tags["+draft/reply"]; reply != "" && (isReact || isUnreact) {
+			reaction := proto.Reaction{
+				ID:    reply,
+				To:    to,
+				From:  source,
+				Emoji: react,
+			}
+			if isUnreact {
+				reaction.Emoji = unreact
+				reaction.Remove = true
+			}
+			bridge.Send(client, &reaction)
+		}
+
+	} else if verb == "REDACT" && len(params) >= 2 {
+		// a deleted message can only be marked in a window showing it
+		to := params[0]
+		client, exists := chats.Window(getClientID(source, to))
+		if !exists {
+			return
+		}
+
+		retract := proto.Retract{
+			ID:   params[1],
+			To:   to,
+			From: source,
+			Date: time.Now().Unix(),
+		}
+		if len(params) >= 3 {
+			retract.Reason = params[2]
+		}
+		if !timestamp.IsZero() {
+			retract.Date = timestamp.Unix()
+		}
+		bridge.Send(client, &retract)
+
+	} else if verb == "CAP" && len(params) >= 3 {
+		switch params[1] {
+		case "ACK":
+			mu.Lock()
+			for _, c := range strings.Fields(params[len(params)-1]) {
+				if strings.HasPrefix(c, "-") {
+					delete(ircCaps, c[1:])
+				} else {
+					ircCaps[c] = true
+				}
+			}
+			mu.Unlock()
+		case "NAK":
+			log.Printf("Server refused capabilities: %s", params[len(params)-1])
+		}
+
+	} else if verb == "AWAY" {
+		// away-notify
+		since := timestamp
+		if since.IsZero() {
+			since = time.Now()
+		}
+
+		if len(params) > 0 && params[0] != "" {
+			sendPresence(source, proto.StatusAway, params[0], since)
+		} else {
+			sendPresence(source, proto.StatusOnline, "", since)
+		}
+
+	} else if serverInfo[verb] {
+		if verb == "001" && len(params) > 0 {
+			setConnState(proto.StatusOnline, "registered as "+params[0])
+		}
+		logServerInfo(source, params, timestamp)
+
+	} else if verb == "005" {
+		logServerInfo(source, params, timestamp)
+		for _, token := range params[1:] {
+			if token == "MONITOR" || strings.HasPrefix(token, "MONITOR=") {
+				mu.Lock()
+				canMonitor = true
+				mu.Unlock()
+
+				// windows opened before the server said so
+				chats.Each(func(clientID string, _ *proto.Socket) {
+					if !chats.IsStatus(clientID) {
+						monitor(clientID, true)
+					}
+				})
+				break
+			}
+		}
+
+	} else if verb == "730" || verb == "731" { // MONITOR online and offline
+		status := int8(proto.StatusOnline)
+		if verb == "731" {
+			status = proto.StatusOffline
+		}
+
+		if len(params) >= 2 {
+			for _, mask := range strings.Split(params[1], ",") {
+				sendPresence(mask, status, "", time.Now())
+			}
+		}
+
+	} else if verb == "301" && len(params) >= 3 { // away reply to a message or WHOIS
+		if !sendPresence(params[1], proto.StatusAway, params[2], time.Time{}) {
+			client := origin
+			if client == nil {
+				client = requests.Peek("whois:" + strings.ToLower(params[1]))
+			}
+
+			msg := proto.Message{
+				From: source,
+				Msg:  strings.Join(params[1:], " | "),
+			}
+			chats.Reply(client, &msg)
+		}
+
 	} else if verb == "PING" {
 		cmd := fmt.Sprintf("PONG :%s", params[0])
 		sendIRCCmd(cmd)
@@ -336,29 +797,27 @@ func processIRCLine(line string) {
 	} else if verb == "JOIN" {
 		channel := params[0]
 
-		client := getOrStartClient(channel)
+		client := chats.Open(channel)
 		member := proto.RoomMemberJoin(source)
-		client.Send(&member)
+		bridge.Send(client, &member)
 
 	} else if verb == "MODE" {
 		target := params[0]
 		modeArgs := params[1:]
 
-		var client *proto.Socket
-		if target != config.Nickname {
-			client = getOrStartClient(target)
-		} else if lastClient != nil {
-			client = lastClient
-		} else {
-			return
-		}
-
 		msg := proto.Message{
 			From: source,
 			Msg:  fmt.Sprintf("MODE %s", strings.Join(modeArgs, " ")),
 		}
 
-		client.Send(&msg)
+		if target != config.Nickname {
+			bridge.Send(chats.Open(target), &msg)
+		} else if origin != nil {
+			chats.Reply(origin, &msg)
+		} else {
+			// our user modes change at login, unasked
+			chats.Reply(requests.Done("mode"), &msg)
+		}
 
 	} else if verb == "PART" {
 		channel := params[0]
@@ -367,12 +826,12 @@ func processIRCLine(line string) {
 			partMsg = params[1]
 		}
 
-		client := getOrStartClient(channel)
+		client := chats.Open(channel)
 		msg := proto.RoomMemberPart{
 			Member: proto.RoomMember(source),
 			Msg:    partMsg,
 		}
-		client.Send(&msg)
+		bridge.Send(client, &msg)
 	} else if verb == "QUIT" {
 		quitMsg := params[0]
 
@@ -382,7 +841,7 @@ func processIRCLine(line string) {
 				Msg:     quitMsg,
 				HasQuit: true,
 			}
-			client.Send(&msg)
+			bridge.Send(client, &msg)
 		})
 
 	} else if verb == "NICK" {
@@ -394,7 +853,7 @@ func processIRCLine(line string) {
 				From: source,
 				Msg:  fmt.Sprintf("is now known as %s", newNick),
 			}
-			client.Send(&msg)
+			bridge.Send(client, &msg)
 		})
 
 	} else if verb == "332" {
@@ -443,19 +902,12 @@ func processIRCLine(line string) {
 		// list of users and masks when running /who
 	} else if verb == "315" {
 		// end of /who list
-		channelName := params[1]
-
-		channel := channels[channelName]
-		channel.endOfNames = true
-		channels[channelName] = channel
+		endOfNames(params[1])
 	} else if verb == "366" { // end of NAMES
 		to := params[0]
 		channelName := params[1]
 
-		channel := channels[channelName]
-		channel.endOfNames = true
-		channels[channelName] = channel
-		members := channel.members
+		members := endOfNames(channelName)
 		var text string
 
 		if len(members) > 20 {
@@ -472,19 +924,27 @@ func processIRCLine(line string) {
 		if !timestamp.IsZero() {
 			msg.Date = timestamp.Unix()
 		}
-		client := getOrStartClient(channelName)
-		client.SendMessage(&msg)
+		client := chats.Open(channelName)
+		bridge.Send(client, &msg)
 
 		memberList := proto.RoomMemberList{
 			Room:    channelName,
 			Members: members,
 		}
-		client.Send(&memberList)
+		bridge.Send(client, &memberList)
 
 	} else if verb == "276" || verb == "311" || verb == "312" || verb == "317" || // whois
 		verb == "318" || verb == "319" || verb == "330" || verb == "378" || verb == "671" { // whois
-		if lastClient == nil {
-			return
+		whoisProfile(verb, params)
+
+		client := origin
+		if client == nil && len(params) >= 2 {
+			key := "whois:" + strings.ToLower(params[1])
+			if verb == "318" {
+				client = requests.Done(key)
+			} else {
+				client = requests.Peek(key)
+			}
 		}
 
 		var text string
@@ -495,35 +955,56 @@ func processIRCLine(line string) {
 			From: source,
 			Msg:  text,
 		}
-		lastClient.Send(&msg)
+		chats.Reply(client, &msg)
 
 	} else if verb == "704" || verb == "705" || verb == "706" { // help
-		if lastClient == nil {
-			return
+		client := origin
+		if client == nil && verb == "706" {
+			client = requests.Done("help")
+		} else if client == nil {
+			client = requests.Peek("help")
 		}
 
 		var text string
-		if len(params) >= 2 {
+		if len(params) >= 3 {
 			text = params[2]
 		}
 		msg := proto.Message{
 			From: source,
 			Msg:  text,
 		}
-		lastClient.Send(&msg)
+		chats.Reply(client, &msg)
+
+	} else if verb == "BATCH" {
+		// a labeled batch ends
+		if len(params) > 0 && strings.HasPrefix(params[0], "-") {
+			requests.Done("batch:" + params[0][1:])
+		}
+
+	} else if verb == "ACK" {
+		// a labeled command had no reply
 
 	} else {
-		if lastClient != nil {
-			msg := proto.Message{
-				To:   "*",
-				From: source,
-				Msg:  line,
-			}
-			if !timestamp.IsZero() {
-				msg.Date = timestamp.Unix()
-			}
-			lastClient.SendMessage(&msg)
+		client := origin
+		if client == nil && verb == "PONG" && len(params) > 0 {
+			client = requests.Done("ping:" + params[len(params)-1])
+		}
+
+		// tags are for us, not for reading
+		text := line
+		if strings.HasPrefix(text, "@") {
+			_, text, _ = strings.Cut(text, " ")
 		}
+
+		msg := proto.Message{
+			To:   "*",
+			From: source,
+			Msg:  text,
+		}
+		if !timestamp.IsZero() {
+			msg.Date = timestamp.Unix()
+		}
+		chats.Reply(client, &msg)
 	}
 
 }
@@ -534,12 +1015,14 @@ func listenServer(irc net.Conn) {
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
+			// however the connection ended, connectToServer reconnects
 			log.Printf("IRC read error: %s", err)
-			if strings.Contains(err.Error(), "connection reset by peer") {
-				return
-			} else {
-				quit(1)
+			if errors.Is(err, io.EOF) {
+				err = errors.New("closed by the server")
 			}
+			setConnState(proto.StatusOffline, "disconnected: "+err.Error())
+			irc.Close()
+			return
 		}
 
 		if len(line) < 1 {
@@ -551,6 +1034,9 @@ func listenServer(irc net.Conn) {
 }
 
 func addChannelMembers(channel string, members []string) {
+	mu.Lock()
+	defer mu.Unlock()
+
 	c, found := channels[channel]
 	if !found {
 		c = Channel{}
@@ -571,6 +1057,18 @@ func addChannelMembers(channel string, members []string) {
 	channels[channel] = c
 }
 
+// endOfNames marks the member list of a channel complete, and returns it
+func endOfNames(channelName string) []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	channel := channels[channelName]
+	channel.endOfNames = true
+	channels[channelName] = channel
+
+	return channel.members
+}
+
 func nickFromMask(mask string) string {
 	idx := strings.Index(mask, "!")
 	if idx > -1 {
@@ -581,243 +1079,270 @@ func nickFromMask(mask string) string {
 }
 
 func sendToClient(clientID string, msg proto.Message) {
-	client := getOrStartClient(clientID)
-	client.SendMessage(&msg)
+	bridge.Send(chats.Open(clientID), &msg)
 }
 
-func cb_Status(status *proto.Status) {
-	log.Println(status)
+// backend connects chat windows to the IRC server
+type backend struct{}
+
+// Hello advertises what the bridge does to a chat window
+func (backend) Hello(sock *proto.Socket) {
+	sock.SetAgent("flexim-irc")
+	// no CapEdit: our messages can't be redacted without the msgid the
+	// server gave them, see Retract
+	sock.AddCaps(proto.CapRoomMembers, proto.CapReceipts, proto.CapTyping, proto.CapReactions)
+	if hasCap("message-tags") {
+		sock.AddCaps(proto.CapReplies)
+	}
+	sock.SetCommands("QUERY", "PRIVMSG", "WHOIS", "PING", "JOIN", "PART", "QUIT", "RAW", "STATUS")
 }
 
-func cb_Roster(roster *proto.Roster) {
-	log.Println(roster)
+func (backend) Handler(sock *proto.Socket, clientID string) proto.Handler {
+	return &chatHandler{sock: sock, clientID: clientID}
 }
 
-func cb_Auth(auth *proto.Auth) {
-	log.Println(auth)
+// Opened watches the presence of the nick a private chat is with
+func (backend) Opened(sock *proto.Socket, clientID string) {
+	if !isChannel(clientID) && !chats.IsStatus(clientID) {
+		monitor(clientID, true)
+		sendProfile(sock, clientID)
+	}
 }
 
-func getOrStartClient(clientID string) (client *proto.Socket) {
-	var found bool
-	client, found = clientMap[clientID]
-	if !found {
-		client = newChatIn(clientID)
+func (backend) Closed(clientID string) {
+	if !chats.IsStatus(clientID) {
+		monitor(clientID, false)
 	}
+}
 
-	return
+// chatHandler receives datums from a chat window
+type chatHandler struct {
+	proto.BaseHandler
+	sock     *proto.Socket
+	clientID string
 }
 
-func newChatIn(clientID string) (client *proto.Socket) {
-	if len(clientMap) >= *chatLimit {
-		fmt.Printf("Too many open chats! (%d)\n", len(clientMap))
+func (h *chatHandler) Message(msg *proto.Message) {
+	const maxIRCLen = 510
+
+	log.Printf("client -> server: %+v\n", msg)
+	if ircConn() == nil {
+		log.Println("irc is nil")
 		return
 	}
+	if h.clientID == "" && msg.To != "" {
+		h.clientID = strings.ToLower(msg.To)
+		chats.Register(h.clientID, h.sock)
 
-	fd, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
-	if err != nil {
-		log.Panic(err)
+		if strings.HasPrefix(h.clientID, "#") {
+			cmd := fmt.Sprintf("JOIN %s", h.clientID)
+			sendIRCCmd(cmd)
+		}
 	}
 
-	var sock proto.Socket
-	client = &sock
-	sock.SetMode(proto.ModeMsgpack)
-
-	err = sock.UseFD(fd[0])
-	if err != nil {
-		log.Panic(err)
+	// what is typed in the status window goes to the server as it is
+	if chats.IsStatus(h.clientID) {
+		h.raw(msg)
+		return
 	}
 
-	err = sock.SendHeader()
-	if err != nil {
-		log.Panic(err)
-	}
+	// the maximum command length needs to account for what the IRC server will send
+	// to other clients. Full host mask, plus : and a space before PRIVMSG starts
+	cmdLen := maxIRCLen - getMaskLen() - 2
 
-	clientFile := os.NewFile(uintptr(fd[1]), "")
-	if clientFile == nil {
-		log.Panicln("Could not get file from file descriptor:", fd[1])
+	// a reply is marked on the first line only. Tags don't count toward cmdLen.
+	var tagPrefix string
+	if msg.ReplyTo != "" && hasCap("message-tags") {
+		tagPrefix = fmt.Sprintf("@+draft/reply=%s ", escapeTagValue(msg.ReplyTo))
+	}
+	send := func(ircCmd string) error {
+		ircCmd, tagPrefix = tagPrefix+ircCmd, ""
+		return sendRequest(h.sock, ircCmd)
 	}
-	defer clientFile.Close()
 
-	// exec
-	pattr := os.ProcAttr{
-		Files: []*os.File{nil, os.Stdout, os.Stderr, clientFile},
+	var err error
+	msgTrimmed := strings.Trim(msg.Msg, "\n\r")
+	msgLines := strings.Split(msgTrimmed, "\n")
+	for _, msgLine := range msgLines {
+		ircCmd := fmt.Sprintf("PRIVMSG %s :%s", msg.To, msgLine)
+		for len(ircCmd) > cmdLen && err == nil {
+			err = send(ircCmd[:cmdLen])
+			ircCmd = fmt.Sprintf("PRIVMSG %s :%s", msg.To, ircCmd[cmdLen:])
+		}
+		if err == nil {
+			err = send(ircCmd)
+		}
 	}
 
-	proc, err := os.StartProcess("flexim-chat", []string{"flexim-chat", "--fd", "3", "--mode", "msgpack", "--to", clientID, "--user", config.Nickname}, &pattr)
+	// without an Ack, the chat window reports the message as failed
 	if err != nil {
+		log.Printf("Error sending message: %s", err)
+	} else if err = h.sock.SendAck(msg); err != nil {
 		log.Print(err)
-		return
 	}
 
-	log.Printf("Pid: %v", proc.Pid)
+	chats.SetLast(h.sock)
+}
 
-	clientMap[clientID] = &sock
+// raw sends each line of a message as an IRC command, like RAW
+func (h *chatHandler) raw(msg *proto.Message) {
+	var err error
+	for _, line := range strings.Split(strings.Trim(msg.Msg, "\n\r"), "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "/")
+		if line == "" {
+			continue
+		}
 
-	setCallbacks(&sock, clientID)
+		if err = sendRequest(h.sock, line); err != nil {
+			break
+		}
+	}
 
-	return
+	if err != nil {
+		log.Printf("Error sending command: %s", err)
+	} else if err = h.sock.SendAck(msg); err != nil {
+		log.Print(err)
+	}
 }
 
-func newChatOut(conn net.Conn) {
-	sock := proto.FromConn(conn, proto.ModeMsgpack)
-
-	setCallbacks(sock, "")
-}
+func (h *chatHandler) Typing(typing *proto.Typing) {
+	if !hasCap("message-tags") {
+		return
+	}
 
-func setCallbacks(sock *proto.Socket, clientID string) {
-	const maxIRCLen = 510
+	target := typing.To
+	if target == "" {
+		target = h.clientID
+	}
+	if target == "" {
+		return
+	}
 
-	sock.SetCallbacks(func(msg *proto.Message) { //msg
-		log.Printf("client -> server: %+v\n", msg)
-		if irc == nil {
-			log.Println("irc is nil")
+	for val, state := range typingStates {
+		if state == typing.State {
+			sendIRCCmd(fmt.Sprintf("@+typing=%s TAGMSG %s", val, target))
 			return
 		}
-		if clientID == "" && msg.To != "" {
-			clientID = strings.ToLower(msg.To)
-			clientMap[clientID] = sock
-
-			if strings.HasPrefix(clientID, "#") {
-				cmd := fmt.Sprintf("JOIN %s", clientID)
-				sendIRCCmd(cmd)
-			}
-		}
-
-		// the maximum command length needs to account for what the IRC server will send
-		// to other clients. Full host mask, plus : and a space before PRIVMSG starts
-		cmdLen := maxIRCLen - getMaskLen() - 2
+	}
+}
 
-		msgTrimmed := strings.Trim(msg.Msg, "\n\r")
-		msgLines := strings.Split(msgTrimmed, "\n")
-		for _, msgLine := range msgLines {
-			ircCmd := fmt.Sprintf("PRIVMSG %s :%s", msg.To, msgLine)
-			for len(ircCmd) > cmdLen {
-				sendIRCCmd(ircCmd[:cmdLen])
-				ircCmd = fmt.Sprintf("PRIVMSG %s :%s", msg.To, ircCmd[cmdLen:])
-			}
-			sendIRCCmd(ircCmd)
-		}
+// Reaction is sent as a reply to the message's msgid. Our own messages have no
+// msgid the server knows, so reactions to them are ignored by other clients.
+func (h *chatHandler) Reaction(reaction *proto.Reaction) {
+	if !hasCap("message-tags") {
+		return
+	}
 
-		lastClient = sock
-	}, func(cmd *proto.Command) { // cmd
-		log.Println(cmd)
+	target := reaction.To
+	if target == "" {
+		target = h.clientID
+	}
+	if target == "" || reaction.ID == "" {
+		return
+	}
 
-		lastClient = sock
+	tag := "+draft/react"
+	if reaction.Remove {
+		tag = "+draft/unreact"
+	}
 
-		switch cmd.Cmd {
-		case "QUERY":
-			var target string
-			if len(cmd.Payload) > 0 {
-				target = cmd.Payload[0]
-			}
-			getOrStartClient(strings.ToLower(target))
+	sendIRCCmd(fmt.Sprintf("@+draft/reply=%s;%s=%s TAGMSG %s",
+		escapeTagValue(reaction.ID), tag, escapeTagValue(reaction.Emoji), target))
+}
 
-		case "PRIVMSG":
-			var target string
-			var msg string
-			if len(cmd.Payload) > 0 {
-				target = cmd.Payload[0]
-			}
-			if len(cmd.Payload) > 1 {
-				msg = cmd.Payload[1]
-			}
-			sendIRCCmd(fmt.Sprintf("PRIVMSG %s :%s", target, msg))
+// Edit is not supported by IRC
+func (h *chatHandler) Edit(edit *proto.Edit) {
+	bridge.Send(h.sock, &proto.Status{Payload: "IRC messages can't be edited"})
+}
 
-		case "WHOIS":
-			var target string
-			if len(cmd.Payload) > 0 {
-				target = cmd.Payload[0]
-			}
-			sendIRCCmd(fmt.Sprintf("WHOIS %s", target))
+// Retract can't be passed on: REDACT needs the msgid the server gave our
+// message, which we never see.
+func (h *chatHandler) Retract(retract *proto.Retract) {
+	log.Printf("Can't redact message %s: its IRC msgid is unknown", retract.ID)
+	bridge.Send(h.sock, &proto.Status{Payload: "Your IRC messages can't be deleted from here"})
+}
 
-		case "PING":
-			var msg string
-			if len(cmd.Payload) > 0 {
-				msg = cmd.Payload[0]
-			} else {
-				msg = "flexim-irc"
-			}
-			sendIRCCmd(fmt.Sprintf("PING :%s", msg))
+func (h *chatHandler) Command(cmd *proto.Command) {
+	log.Println(cmd)
 
-		case "JOIN":
-			channel := clientID
-			if len(cmd.Payload) > 0 {
-				channel = cmd.Payload[0]
-			}
-			sendIRCCmd(fmt.Sprintf("JOIN %s", channel))
+	chats.SetLast(h.sock)
 
-		case "PART":
-			channel := clientID
-			if len(cmd.Payload) > 0 {
-				channel = cmd.Payload[0]
-			}
+	switch cmd.Cmd {
+	case "QUERY":
+		var target string
+		if len(cmd.Payload) > 0 {
+			target = cmd.Payload[0]
+		}
+		chats.Open(strings.ToLower(target))
 
-			leaveChannel(channel)
+	case "PRIVMSG":
+		var target string
+		var msg string
+		if len(cmd.Payload) > 0 {
+			target = cmd.Payload[0]
+		}
+		if len(cmd.Payload) > 1 {
+			msg = cmd.Payload[1]
+		}
+		sendRequest(h.sock, fmt.Sprintf("PRIVMSG %s :%s", target, msg))
 
-		case "QUIT":
-			sendIRCCmd("QUIT")
-			quit(0)
+	case "WHOIS":
+		var target string
+		if len(cmd.Payload) > 0 {
+			target = cmd.Payload[0]
+		}
+		sendRequest(h.sock, fmt.Sprintf("WHOIS %s", target))
 
-		case "RAW":
-			if len(cmd.Payload) > 0 {
-				sendIRCCmd(cmd.Payload[0])
-			}
+	case "PING":
+		var msg string
+		if len(cmd.Payload) > 0 {
+			msg = cmd.Payload[0]
+		} else {
+			msg = "flexim-irc"
 		}
+		sendRequest(h.sock, fmt.Sprintf("PING :%s", msg))
 
-	}, func(txt string) { // text
-		log.Println(txt)
+	case "JOIN":
+		channel := h.clientID
+		if len(cmd.Payload) > 0 {
+			channel = cmd.Payload[0]
+		}
+		sendRequest(h.sock, fmt.Sprintf("JOIN %s", channel))
 
-	}, func() { // disconnect
-		log.Println("Chat window disconnected")
-		if clientID != "" {
-			/*if strings.HasPrefix(clientID, "#") {
-				fmt.Fprintf(irc, "PART %s\n", clientID)
-			}*/
-			delete(clientMap, clientID)
+	case "PART":
+		channel := h.clientID
+		if len(cmd.Payload) > 0 {
+			channel = cmd.Payload[0]
 		}
 
-	},
-		cb_Status, // status
-		cb_Roster, // roster
-		cb_Auth)   // auth
-}
+		leaveChannel(channel)
 
-func listenLoop(ln net.Listener) {
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Fatal(err)
+	case "QUIT":
+		sendIRCCmd("QUIT")
+		chats.Quit(0)
+
+	case "RAW":
+		if len(cmd.Payload) > 0 {
+			sendRequest(h.sock, cmd.Payload[0])
 		}
 
-		newChatOut(conn)
+	case "STATUS":
+		chats.Open(chats.Status)
 	}
 }
 
-// Catch interrupt signal
-func waitSignal() {
-	c := make(chan os.Signal)
-
-	signal.Notify(c, os.Interrupt)
-	s := <-c
-	log.Println("Received signal:", s)
-
-	quit(0)
+func (h *chatHandler) Text(txt string) {
+	log.Println(txt)
 }
 
-// do cleanup
-func quit(ret int) {
-	fmt.Println("Closing down...")
-	os.Remove(*unixlisten)
-
-	cmd := proto.Command{
-		Cmd: "BYE ",
-	}
-	for _, sock := range clientMap {
-		sock.SendCommand(&cmd)
-		sock.Close()
+func (h *chatHandler) Disconnect() {
+	log.Println("Chat window disconnected")
+	if h.clientID != "" {
+		/*if strings.HasPrefix(h.clientID, "#") {
+			fmt.Fprintf(irc, "PART %s\n", h.clientID)
+		}*/
+		chats.Unregister(h.clientID, h.sock)
 	}
-
-	os.Exit(ret)
 }
 
 func loadConfig() {
@@ -837,6 +1362,8 @@ func main() {
 	flag.Parse()
 
 	loadConfig()
+	chats.User = config.Nickname
+	chats.Status = strings.ToLower(config.Address) // client ids are lowercased
 
 	// connect
 	c := make(chan error)
@@ -845,39 +1372,14 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// maybe listen to a tcp socket for clients
-	if *tcplisten != "" {
-		ln, err := net.Listen("tcp", *tcplisten)
-		if err != nil {
-			log.Fatal(err)
-		}
-		go listenLoop(ln)
-	}
-
 	// listen to a unix socket for clients
-	if *unixlisten == "" {
+	if bridgeOpts.UnixListen == "" {
 		var err error
-		*unixlisten, err = xdg.RuntimeFile("flexim/" + strings.ReplaceAll(config.Address, "/", "_"))
+		bridgeOpts.UnixListen, err = xdg.RuntimeFile("flexim/" + strings.ReplaceAll(config.Address, "/", "_"))
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	os.Remove(*unixlisten)
-	ln, err := net.Listen("unix", *unixlisten)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer func() {
-		r := recover()
-		if r != nil {
-			fmt.Println("Panic:", r)
-		}
-
-		quit(1)
-	}()
-
-	go listenLoop(ln)
-
-	waitSignal()
+	chats.Run()
 }
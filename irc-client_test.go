@@ -0,0 +1,318 @@
+package main
+
+// Run with: go test -race irc-client.go irc-client_test.go
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mnakama/flexim-go/proto"
+)
+
+// The bridge keeps its state in globals, so all tests share one bridge,
+// connected to server by TestMain
+var server *fakeIRC
+
+const noiseChannels = 5
+
+// fakeIRC is an IRC server for one client at a time. It echoes every PRIVMSG
+// to a channel back from another user, and counts them. Meanwhile, other users
+// talk, join and part in channels #c0 to #c<noise>.
+type fakeIRC struct {
+	ln    net.Listener
+	noise int
+
+	mu       sync.Mutex
+	conn     net.Conn
+	logins   int
+	privmsgs int
+	monitors []string
+}
+
+func (s *fakeIRC) send(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(s.conn, format+"\r\n", args...)
+}
+
+func (s *fakeIRC) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.handle(conn)
+	}
+}
+
+func (s *fakeIRC) handle(conn net.Conn) {
+	s.mu.Lock()
+	s.conn = conn
+	s.logins++
+	s.mu.Unlock()
+
+	s.send(":irc.test 001 me :Welcome")
+	go s.talk()
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if fields[0] == "MONITOR" {
+			s.mu.Lock()
+			s.monitors = append(s.monitors, strings.TrimSpace(line))
+			s.mu.Unlock()
+		} else if len(fields) == 3 && fields[0] == "PRIVMSG" && strings.HasPrefix(fields[1], "#") {
+			s.mu.Lock()
+			s.privmsgs++
+			s.mu.Unlock()
+
+			s.send(":bob!b@host PRIVMSG %s :re %s", fields[1], strings.TrimPrefix(fields[2], ":"))
+		}
+	}
+}
+
+// talk sends what other users do in the channels
+func (s *fakeIRC) talk() {
+	for i := 0; i < 100; i++ {
+		channel := fmt.Sprintf("#c%d", i%s.noise)
+
+		s.send(":alice!a@host PRIVMSG %s :noise %d", channel, i)
+		s.send(":carol!c@host JOIN %s", channel)
+		s.send(":carol!c@host PART %s :bye", channel)
+		s.send(":irc.test NOTICE * :*** noise %d", i)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *fakeIRC) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.privmsgs
+}
+
+func (s *fakeIRC) monitored() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.monitors...)
+}
+
+func (s *fakeIRC) loginCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.logins
+}
+
+// hangUp closes the connection, as a server restarting does
+func (s *fakeIRC) hangUp() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn.Close()
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "irc-client-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "ircd"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server = &fakeIRC{ln: ln, noise: noiseChannels}
+	go server.serve()
+
+	// traffic in channels without a window must not start real ones
+	bridgeOpts.Launcher.Program = filepath.Join(dir, "no-chat-program")
+
+	// set up like main does. Window ids are lowercased, the address may not
+	// be.
+	config.Address = ln.Addr().String()
+	config.Nickname = "me"
+	chats.User = config.Nickname
+	chats.Status = strings.ToUpper(config.Address)
+
+	connected := make(chan error)
+	go connectToServer(connected)
+	if err := <-connected; err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// waitFor polls cond for up to 10 seconds
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return cond()
+}
+
+// testWindow is a chat window that remembers the replies to its messages
+type testWindow struct {
+	proto.BaseHandler
+	sock *proto.Socket
+
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (w *testWindow) Message(msg *proto.Message) {
+	if !strings.HasPrefix(msg.Msg, "re ") {
+		return
+	}
+
+	w.mu.Lock()
+	w.msgs = append(w.msgs, msg.Msg)
+	w.mu.Unlock()
+}
+
+func (w *testWindow) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.msgs)
+}
+
+// openWindow connects a chat window to the bridge, the way the listeners do
+func openWindow(t *testing.T) *testWindow {
+	bridgeEnd, windowEnd := net.Pipe()
+
+	chats.Accept(proto.FromConn(bridgeEnd, proto.ModeMsgpack))
+
+	w := &testWindow{sock: proto.FromConn(windowEnd, proto.ModeMsgpack)}
+	if err := w.sock.SendHeader(); err != nil {
+		t.Fatal(err)
+	}
+	go w.sock.Serve(context.Background(), w)
+
+	return w
+}
+
+// TestConcurrentWindows sends from several chat windows at once while the
+// server answers each message, so the race detector sees the IRC reader and
+// the window goroutines share the bridge and connection state.
+func TestConcurrentWindows(t *testing.T) {
+	const windows = noiseChannels
+	const perWindow = 20
+
+	registered := chats.Len()
+	echoed := server.count()
+
+	var wins []*testWindow
+	for i := 0; i < windows; i++ {
+		wins = append(wins, openWindow(t))
+	}
+
+	var wg sync.WaitGroup
+	for i, w := range wins {
+		channel := fmt.Sprintf("#c%d", i)
+
+		// the first message registers the window for its channel
+		if err := w.sock.Send(&proto.Message{To: channel, Msg: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+
+		for j := 1; j < perWindow; j++ {
+			wg.Add(1)
+			go func(w *testWindow, j int) {
+				defer wg.Done()
+
+				if err := w.sock.Send(&proto.Message{To: channel, Msg: fmt.Sprint("message ", j)}); err != nil {
+					t.Error(err)
+				}
+			}(w, j)
+		}
+	}
+	wg.Wait()
+
+	waitFor(func() bool {
+		done := server.count()-echoed == windows*perWindow
+		for _, w := range wins {
+			done = done && w.count() == perWindow
+		}
+		return done
+	})
+
+	if n := server.count() - echoed; n != windows*perWindow {
+		t.Errorf("The server got %d messages, not %d", n, windows*perWindow)
+	}
+	for i, w := range wins {
+		if n := w.count(); n != perWindow {
+			t.Errorf("Window %d got %d replies, not %d", i, n, perWindow)
+		}
+	}
+	if n := chats.Len() - registered; n != windows {
+		t.Errorf("%d windows were registered, not %d", n, windows)
+	}
+}
+
+// TestReconnect closes the connection from the server side, which the bridge
+// reads as EOF, and expects it to log in again
+func TestReconnect(t *testing.T) {
+	logins := server.loginCount()
+
+	for i := 1; i <= 2; i++ {
+		server.hangUp()
+
+		if !waitFor(func() bool { return server.loginCount() == logins+i }) {
+			t.Fatalf("No new login after the server hung up %d times", i)
+		}
+	}
+}
+
+// TestMonitorSkipsStatus opens a private chat and the status window, whose id
+// is the server address, before the server says it supports MONITOR. Only the
+// nick is monitored.
+func TestMonitorSkipsStatus(t *testing.T) {
+	registered := chats.Len()
+
+	for _, to := range []string{config.Address, "Bob"} {
+		w := openWindow(t)
+		if err := w.sock.Send(&proto.Message{To: to, Msg: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !waitFor(func() bool { return chats.Len() == registered+2 }) {
+		t.Fatal("The windows were not registered")
+	}
+
+	server.send(":irc.test 005 me MONITOR=100 :are supported by this server")
+
+	waitFor(func() bool { return len(server.monitored()) > 0 })
+	time.Sleep(100 * time.Millisecond)
+
+	if monitors := server.monitored(); len(monitors) != 1 || monitors[0] != "MONITOR + bob" {
+		t.Errorf("Sent %q, not only MONITOR + bob", monitors)
+	}
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"os"
+	"syscall"
+
+	"github.com/mnakama/flexim-go/pkg/launcher"
+	"github.com/mnakama/flexim-go/proto"
 )
 
 const (
@@ -12,29 +19,81 @@ const (
 	modeMsgpack = "msgpack"
 )
 
+var (
+	listenAddress = flag.String("listen", ":9001", "address to accept chats on")
+	tlsOnly       = flag.Bool("tls-only", false, "refuse connections that don't start with a TLS handshake")
+	tlsOpts       = proto.TLSFlags(flag.CommandLine)
+	chat          = launcher.Flags(flag.CommandLine)
+)
+
+// peekHeader waits for the connection header without consuming it, so that
+// flexim-chat can read it and pick the framing itself.
+func peekHeader(conn *net.TCPConn) ([]byte, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(proto.HeaderMsgpack))
+	var length int
+	var peekErr error
+
+	err = raw.Read(func(fd uintptr) bool {
+		length, _, peekErr = syscall.Recvfrom(int(fd), header, syscall.MSG_PEEK)
+		if peekErr == syscall.EAGAIN {
+			return false
+		}
+
+		// wait for the rest of the header to arrive
+		return peekErr != nil || length == 0 || length >= len(header)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if peekErr != nil {
+		return nil, peekErr
+	}
+	if length == 0 {
+		return nil, io.EOF
+	}
+	if length < len(header) {
+		return nil, errors.New("Initial packet too short")
+	}
+
+	return header, nil
+}
+
 func handoverConn(conn *net.TCPConn) {
 	defer conn.Close()
 	log.Printf("Connection: %v", conn)
 
-	// Read header
-	header := make([]byte, 5)
-	length, err := conn.Read(header)
+	header, err := peekHeader(conn)
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	if length < 5 {
-		log.Printf("Initial packet too short: %d, %s", length, header)
-		return
-	}
 
-	// Check header
-	var proto string
-	switch string(header) {
-	case "\x00FLEX":
-		proto = modeText
-	case "\xa4FLEX":
-		proto = modeMsgpack
+	// Check header. TLS connections are handed over as they are, and
+	// flexim-chat reads the header after the handshake.
+	var mode string
+	var args []string
+
+	switch {
+	case proto.IsTLSRecord(header):
+		if tlsOpts.CertFile == "" {
+			log.Print("TLS connection refused: no certificate configured")
+			return
+		}
+
+		args = append([]string{"--tls-accept"}, tlsOpts.Args()...)
+		mode = modeMsgpack
+	case *tlsOnly:
+		log.Print("Plaintext connection refused")
+		return
+	case bytes.Equal(header, proto.HeaderText):
+		mode = modeText
+	case bytes.Equal(header, proto.HeaderMsgpack), bytes.Equal(header, proto.HeaderMsgpackExt):
+		mode = modeMsgpack
 	default:
 		log.Printf("Invalid connection header: %s", header)
 		return
@@ -49,24 +108,30 @@ func handoverConn(conn *net.TCPConn) {
 	defer file.Close()
 	log.Printf("File: %v, %v", file, file.Fd())
 
-	// exec
-	pattr := os.ProcAttr{
-		Files: []*os.File{nil, os.Stdout, os.Stderr, file},
-	}
-
-	fmt.Println("init mode:", proto)
+	fmt.Println("init mode:", mode)
 
-	proc, err := os.StartProcess("flexim-chat", []string{"flexim-chat", "--fd", "3", "--mode", proto}, &pattr)
+	err = chat.Launch(file, launcher.Window{Mode: mode, Args: args})
 	if err != nil {
 		log.Print(err)
-		return
 	}
-
-	log.Printf("Pid: %v", proc.Pid)
 }
 
 func main() {
-	addr, err := net.ResolveTCPAddr("tcp", ":9001")
+	flag.Parse()
+
+	if *tlsOnly && tlsOpts.CertFile == "" {
+		log.Fatal("-tls-only needs -tls-cert and -tls-key")
+	}
+
+	if tlsOpts.CertFile != "" {
+		// fail now rather than on the first connection
+		_, err := tlsOpts.ServerConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", *listenAddress)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,399 @@
+// Package bridge has what the flexim bridges share: the chat windows open on
+// a network, spawning and accepting them, routing datums to them, and
+// shutting down. A bridge implements Backend for its network, and gets the
+// rest from Bridge.
+package bridge
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+
+	"github.com/mnakama/flexim-go/pkg/launcher"
+	"github.com/mnakama/flexim-go/proto"
+)
+
+// Backend is the network side of a bridge
+type Backend interface {
+	// Hello sets the agent, capabilities and commands a new chat window is
+	// told about
+	Hello(sock *proto.Socket)
+
+	// Handler returns what receives the datums from a chat window. id is the
+	// conversation the window was opened for, or empty for a window that
+	// connected by itself and hasn't said yet.
+	Handler(sock *proto.Socket, id string) proto.Handler
+
+	// Opened is called when a window is registered for conversation id, and
+	// Closed when it is gone
+	Opened(sock *proto.Socket, id string)
+	Closed(id string)
+}
+
+// Options are the command line settings shared by the bridges
+type Options struct {
+	TCPListen  string
+	UnixListen string
+	WSListen   string
+	WSOrigins  string
+	ChatLimit  int
+	Launcher   *launcher.Launcher
+}
+
+// Flags registers the flags shared by the bridges
+func Flags(fs *flag.FlagSet) *Options {
+	var o Options
+
+	fs.StringVar(&o.TCPListen, "tcplisten", "", "bind address for TCP clients")
+	fs.StringVar(&o.UnixListen, "listen", "", "bind address for local clients")
+	fs.StringVar(&o.WSListen, "ws", "", "bind address for WebSocket clients, speaking JSON mode")
+	fs.StringVar(&o.WSOrigins, "ws-origin", "", "comma separated web page origins allowed to connect with --ws, besides the same host")
+
+	// X.org crashes at about 50+ visible windows with dwm
+	fs.IntVar(&o.ChatLimit, "chatlimit", 30, "flood protection: maximum amount of open chats")
+	o.Launcher = launcher.Flags(fs)
+
+	return &o
+}
+
+// Bridge keeps the chat windows of one network connection, by conversation.
+// It is safe for concurrent use; Backend methods are called without its lock
+// held, so they may use the Bridge.
+type Bridge struct {
+	Backend Backend
+	Options *Options
+	User    string // our name on the network, passed to spawned windows
+	Status  string // conversation of the window for traffic no window asked for
+
+	spawnMu sync.Mutex // held while spawning, so a conversation gets one window
+
+	mu        sync.Mutex
+	windows   map[string]*proto.Socket
+	last      *proto.Socket
+	sockets   []string      // unix socket files to remove on Quit
+	statusLog []interface{} // what the status window showed, for when it opens again
+}
+
+// How many datums the status window gets again when it is reopened
+const statusBacklog = 200
+
+// New returns a Bridge for backend, set up by opts
+func New(backend Backend, opts *Options) *Bridge {
+	return &Bridge{
+		Backend: backend,
+		Options: opts,
+		windows: make(map[string]*proto.Socket, 1),
+	}
+}
+
+// Window returns the chat window for conversation id, if one is open
+func (b *Bridge) Window(id string) (*proto.Socket, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sock, exists := b.windows[id]
+	return sock, exists
+}
+
+// Open returns the chat window for conversation id, spawning one if none is
+// open. It returns nil if that fails.
+func (b *Bridge) Open(id string) *proto.Socket {
+	b.spawnMu.Lock()
+	if sock, exists := b.Window(id); exists {
+		b.spawnMu.Unlock()
+		return sock
+	}
+
+	sock, err := b.spawn(id)
+	b.spawnMu.Unlock()
+
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+
+	b.serveSpawned(sock, id)
+
+	return sock
+}
+
+// Register makes sock the chat window for conversation id
+func (b *Bridge) Register(id string, sock *proto.Socket) {
+	b.put(id, sock)
+	b.Backend.Opened(sock, id)
+}
+
+// put adds a window to b.windows. The status window is shown what it showed
+// before, in the same critical section, so nothing is shown twice or missed.
+func (b *Bridge) put(id string, sock *proto.Socket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.windows[id] = sock
+
+	if b.IsStatus(id) {
+		for _, datum := range b.statusLog {
+			Send(sock, datum)
+		}
+	}
+}
+
+// Unregister forgets the chat window for conversation id, unless another
+// window has taken its place
+func (b *Bridge) Unregister(id string, sock *proto.Socket) {
+	b.mu.Lock()
+	if b.windows[id] != sock {
+		b.mu.Unlock()
+		return
+	}
+
+	delete(b.windows, id)
+	if b.last == sock {
+		b.last = nil
+	}
+	b.mu.Unlock()
+
+	b.Backend.Closed(id)
+}
+
+// Len returns how many chat windows are open
+func (b *Bridge) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.windows)
+}
+
+// Each calls f with every chat window open when it is called
+func (b *Bridge) Each(f func(id string, sock *proto.Socket)) {
+	b.mu.Lock()
+	windows := make(map[string]*proto.Socket, len(b.windows))
+	for id, sock := range b.windows {
+		windows[id] = sock
+	}
+	b.mu.Unlock()
+
+	for id, sock := range windows {
+		f(id, sock)
+	}
+}
+
+// Relay passes a datum on to the chat window for conversation id, and returns
+// whether one is open. No window is opened for it.
+func (b *Bridge) Relay(id string, datum interface{}) bool {
+	sock, exists := b.Window(id)
+	if exists {
+		Send(sock, datum)
+	}
+
+	return exists
+}
+
+// Last returns the chat window that was used last, or nil
+func (b *Bridge) Last() *proto.Socket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.last
+}
+
+// SetLast records sock as the chat window that was used last
+func (b *Bridge) SetLast(sock *proto.Socket) {
+	b.mu.Lock()
+	b.last = sock
+	b.mu.Unlock()
+}
+
+// IsStatus returns whether id is the conversation of the status window.
+// Backends may lowercase ids, so case is ignored.
+func (b *Bridge) IsStatus(id string) bool {
+	return b.Status != "" && strings.EqualFold(id, b.Status)
+}
+
+// ToStatus passes a datum no window asked for on to the status window,
+// opening it if needed. Without a status window, it goes to the window used
+// last, if any.
+func (b *Bridge) ToStatus(datum interface{}) {
+	if b.Status == "" {
+		if sock := b.Last(); sock != nil {
+			Send(sock, datum)
+		}
+		return
+	}
+
+	b.Open(b.Status)
+	b.LogStatus(datum)
+}
+
+// LogStatus shows a datum in the status window if it is open, and keeps it
+// for when it opens
+func (b *Bridge) LogStatus(datum interface{}) {
+	if b.Status == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.statusLog = append(b.statusLog, datum)
+	if len(b.statusLog) > statusBacklog {
+		b.statusLog = b.statusLog[len(b.statusLog)-statusBacklog:]
+	}
+
+	if sock, exists := b.windows[b.Status]; exists {
+		Send(sock, datum)
+	}
+}
+
+// Reply passes a datum on to the window that asked for it, or to the status
+// window if that is unknown or gone
+func (b *Bridge) Reply(sock *proto.Socket, datum interface{}) {
+	if sock != nil {
+		err := sock.Send(datum)
+		if err == nil {
+			return
+		} else if errors.Is(err, proto.ErrQueueFull) {
+			log.Printf("chat window is not keeping up: %s", err)
+			return
+		}
+	}
+
+	b.ToStatus(datum)
+}
+
+// Send queues a datum for a chat window. It never blocks, so a window that
+// stops reading loses datums instead of stalling the network connection.
+func Send(sock *proto.Socket, datum interface{}) {
+	err := sock.Send(datum)
+	if errors.Is(err, proto.ErrQueueFull) {
+		log.Printf("chat window is not keeping up: %s", err)
+	} else if err != nil {
+		log.Print(err)
+	}
+}
+
+// Accept serves a chat window that connected by itself
+func (b *Bridge) Accept(sock *proto.Socket) {
+	b.Backend.Hello(sock)
+
+	go sock.Serve(context.Background(), b.Backend.Handler(sock, ""))
+}
+
+// Listen accepts chat windows on a unix or TCP socket
+func (b *Bridge) Listen(network, addr string) error {
+	if network == "unix" {
+		os.Remove(addr)
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	if network == "unix" {
+		b.mu.Lock()
+		b.sockets = append(b.sockets, addr)
+		b.mu.Unlock()
+	}
+
+	go b.acceptLoop(ln)
+
+	return nil
+}
+
+func (b *Bridge) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		b.Accept(proto.FromConn(conn, proto.ModeMsgpack))
+	}
+}
+
+// ListenWebSocket accepts chat windows running in a web browser, from pages
+// on the same host or from origins
+func (b *Bridge) ListenWebSocket(addr string, origins []string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Fatal(http.Serve(ln, proto.WebSocketHandler(origins, b.Accept)))
+	}()
+
+	return nil
+}
+
+// Run listens for chat windows where the options say, and serves them until
+// interrupted
+func (b *Bridge) Run() {
+	o := b.Options
+
+	if o.TCPListen != "" {
+		if err := b.Listen("tcp", o.TCPListen); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if o.WSListen != "" {
+		var origins []string
+		if o.WSOrigins != "" {
+			origins = strings.Split(o.WSOrigins, ",")
+		}
+
+		if err := b.ListenWebSocket(o.WSListen, origins); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if o.UnixListen != "" {
+		if err := b.Listen("unix", o.UnixListen); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	b.waitSignal()
+}
+
+// Catch interrupt signal
+func (b *Bridge) waitSignal() {
+	c := make(chan os.Signal, 1)
+
+	signal.Notify(c, os.Interrupt)
+	s := <-c
+	log.Println("Received signal:", s)
+
+	b.Quit(0)
+}
+
+// Quit says goodbye to the chat windows, cleans up and exits
+func (b *Bridge) Quit(ret int) {
+	fmt.Println("Closing down...")
+
+	b.mu.Lock()
+	for _, path := range b.sockets {
+		os.Remove(path)
+	}
+	b.mu.Unlock()
+
+	cmd := proto.Command{
+		Cmd: "BYE ",
+	}
+	b.Each(func(_ string, sock *proto.Socket) {
+		sock.SendCommand(&cmd)
+		sock.Close()
+	})
+
+	os.Exit(ret)
+}
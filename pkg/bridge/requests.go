@@ -0,0 +1,106 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mnakama/flexim-go/proto"
+)
+
+// How long a request waits for its reply before it is forgotten
+const requestTimeout = time.Minute
+
+// Requests remembers which chat window sent a request to the network, so the
+// reply goes back to it rather than to whichever window was used last. A
+// request is found by a key the bridge makes up, like the IRC label or the
+// nick of a WHOIS. The zero value is ready to use, and it is safe for
+// concurrent use.
+type Requests struct {
+	mu      sync.Mutex
+	pending []request // oldest first
+}
+
+type request struct {
+	key  string
+	sock *proto.Socket
+	at   time.Time
+}
+
+// Add records that sock sent a request with key
+func (r *Requests) Add(key string, sock *proto.Socket) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire()
+	r.pending = append(r.pending, request{key: key, sock: sock, at: time.Now()})
+}
+
+// Peek returns the window of the oldest request with key, which is still
+// waiting for more of its reply, or nil
+func (r *Requests) Peek(key string) *proto.Socket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire()
+	if i := r.find(key); i >= 0 {
+		return r.pending[i].sock
+	}
+
+	return nil
+}
+
+// Done forgets the oldest request with key, whose reply is complete, and
+// returns its window, or nil
+func (r *Requests) Done(key string) *proto.Socket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire()
+	i := r.find(key)
+	if i < 0 {
+		return nil
+	}
+
+	sock := r.pending[i].sock
+	r.pending = append(r.pending[:i], r.pending[i+1:]...)
+
+	return sock
+}
+
+// DoneAny forgets the oldest request, for a reply that doesn't say what it
+// answers, and returns its window, or nil
+func (r *Requests) DoneAny() *proto.Socket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire()
+	if len(r.pending) == 0 {
+		return nil
+	}
+
+	sock := r.pending[0].sock
+	r.pending = r.pending[1:]
+
+	return sock
+}
+
+func (r *Requests) find(key string) int {
+	for i := range r.pending {
+		if r.pending[i].key == key {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// expire forgets requests that never got a reply. r.mu must be held.
+func (r *Requests) expire() {
+	cutoff := time.Now().Add(-requestTimeout)
+
+	i := 0
+	for i < len(r.pending) && r.pending[i].at.Before(cutoff) {
+		i++
+	}
+	r.pending = r.pending[i:]
+}
@@ -0,0 +1,77 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/mnakama/flexim-go/pkg/launcher"
+	"github.com/mnakama/flexim-go/proto"
+)
+
+// Spawn starts a chat window for conversation id with the launcher, connected
+// over a socketpair, and registers it
+func (b *Bridge) Spawn(id string) (*proto.Socket, error) {
+	b.spawnMu.Lock()
+	sock, err := b.spawn(id)
+	b.spawnMu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.serveSpawned(sock, id)
+
+	return sock, nil
+}
+
+// spawn starts a chat window and puts it in b.windows. b.spawnMu must be
+// held, and serveSpawned called after releasing it.
+func (b *Bridge) spawn(id string) (*proto.Socket, error) {
+	if open := b.Len(); open >= b.Options.ChatLimit {
+		return nil, fmt.Errorf("Too many open chats! (%d)", open)
+	}
+
+	fd, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	clientFile := os.NewFile(uintptr(fd[1]), "")
+	defer clientFile.Close()
+
+	// the window is started by us, so it knows the current framing
+	sock := new(proto.Socket)
+	sock.SetMode(proto.ModeMsgpack)
+	sock.SetFraming(proto.FramingVarint)
+	b.Backend.Hello(sock)
+
+	err = sock.UseFD(fd[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = sock.SendHeader()
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	err = b.Options.Launcher.Launch(clientFile, launcher.Window{Mode: "msgpack", To: id, User: b.User})
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	b.put(id, sock)
+
+	return sock, nil
+}
+
+// serveSpawned tells the backend about a window from spawn, and serves it
+func (b *Bridge) serveSpawned(sock *proto.Socket, id string) {
+	b.Backend.Opened(sock, id)
+
+	go sock.Serve(context.Background(), b.Backend.Handler(sock, id))
+}
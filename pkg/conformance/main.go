@@ -0,0 +1,164 @@
+// Command conformance checks the proto codecs against the golden corpus in
+// proto/testdata, or rewrites the corpus with -write. Each sample datum is
+// stored as <name>.msgpack, a packet with FramingVarint, <name>.txt, a text
+// mode line, and <name>.json, a JSON mode line.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/mnakama/flexim-go/proto"
+)
+
+var (
+	dir   = flag.String("dir", "proto/testdata", "corpus directory")
+	write = flag.Bool("write", false, "write the corpus instead of checking it")
+)
+
+// fixed keys and signatures, so the corpus doesn't change between runs
+var (
+	key  = bytes.Repeat([]byte{0xab}, 32)
+	key2 = bytes.Repeat([]byte{0xcd}, 32)
+	sig  = bytes.Repeat([]byte{0x5a}, 64)
+	hash = bytes.Repeat([]byte{0x0f}, 32)
+)
+
+var samples = []struct {
+	name  string
+	datum interface{}
+}{
+	{"auth", &proto.Auth{Date: 1700000000, Challenge: "c0ffee", LastSeen: 1690000000}},
+	{"auth-response", &proto.AuthResponse{Challenge: "c0ffee"}},
+	{"auth-response-signed", &proto.AuthResponse{Challenge: "c0ffee", Key: key, Signature: sig}},
+	{"command", &proto.Command{Cmd: "NICK", Payload: []string{"bob"}}},
+	{"command-trailing", &proto.Command{Cmd: "PRIVMSG", Payload: []string{"#flexim", "hello there"}}},
+	{"message", &proto.Message{To: "alice", From: "bob", Flags: []string{}, Date: 1700000000, Msg: "hello there"}},
+	{"message-signed", &proto.Message{ID: "0123456789abcdef01234567", To: "alice", From: "bob", Flags: []string{"action"},
+		Date: 1700000000, Msg: "waves: \\o/", Signature: sig}},
+	{"message-rich", &proto.Message{ID: "m2", To: "#flexim", From: "bob!b@example.org", Flags: []string{}, Date: 1700000000,
+		Msg: "see https://example.org/a b", ReplyTo: "m1",
+		Attachments: []proto.Attachment{{Name: "a; b,c.png", Type: "image/png", Size: 1234, URL: "https://example.org/a.png"}},
+		Embeds: []proto.Embed{{URL: "https://example.org/a b", Title: "Example: *", Description: "two\nlines",
+			Thumbnail: "https://example.org/t.png"}}}},
+	{"message-encrypted", &proto.Message{ID: "m3", To: "alice", From: "bob", Flags: []string{}, Date: 1700000000,
+		Signature: sig, Encrypted: hash}},
+	{"roster", &proto.Roster{{Aliases: []string{"bob", "robert"}, Key: key, LastSeen: 1700000000},
+		{Aliases: []string{"carol"}, LastSeen: 0, Name: "carol", DisplayName: "Carol C"}}},
+	{"user", &proto.User{Aliases: []string{"bob"}, Key: key, LastSeen: 1700000000}},
+	{"user-profile", &proto.User{Aliases: []string{"bob!b@example.org"}, LastSeen: 1700000000, Name: "bob",
+		DisplayName: "Bob Example", Avatar: "https://example.org/bob.png"}},
+	{"status", &proto.Status{Payload: "Your IRC messages can't be deleted from here"}},
+	{"status-presence", &proto.Status{Status: proto.StatusAway, User: "bob!b@example.org", Since: 1700000000,
+		Payload: "gone fishing"}},
+	{"room-members", &proto.RoomMemberList{Room: "#flexim", Members: []string{"alice", "bob"}}},
+	{"room-join", func() *proto.RoomMemberJoin { j := proto.RoomMemberJoin("bob!b@example.org"); return &j }()},
+	{"room-part", &proto.RoomMemberPart{Member: "bob!b@example.org", Msg: "see you"}},
+	{"room-quit", &proto.RoomMemberPart{Member: "bob!b@example.org", Msg: "Quit: bye", HasQuit: true}},
+	{"ping", &proto.Ping{ID: 7, Date: 1700000000000000000}},
+	{"pong", &proto.Pong{ID: 7, Date: 1700000000000000000}},
+	{"hello", &proto.Hello{Version: proto.ProtocolVersion, Agent: "flexim-chat",
+		Caps: []string{proto.CapRoomMembers, proto.CapReceipts}, Commands: []string{"NICK"}}},
+	{"key-exchange", &proto.KeyExchange{To: "alice", From: "bob", Name: "bob", Identity: key, Ephemeral: key2,
+		Date: 1700000000, Reply: true, Signature: sig}},
+	{"ack", &proto.Ack{ID: "m1"}},
+	{"receipt", &proto.Receipt{To: "alice", From: "bob", IDs: []string{"m1", "m2"}, Status: proto.ReceiptRead,
+		Date: 1700000000}},
+	{"typing", &proto.Typing{To: "alice", From: "bob", State: proto.TypingActive}},
+	{"edit", &proto.Edit{ID: "m1", To: "alice", From: "bob", Date: 1700000000, Msg: "hello again", Signature: sig}},
+	{"edit-encrypted", &proto.Edit{ID: "m1", To: "alice", From: "bob", Date: 1700000000, Signature: sig,
+		Encrypted: hash}},
+	{"retract", &proto.Retract{ID: "m1", To: "alice", From: "bob", Date: 1700000000, Reason: "typo"}},
+	{"reaction", &proto.Reaction{ID: "m1", To: "alice", From: "bob", Emoji: "👍"}},
+	{"reaction-remove", &proto.Reaction{ID: "m1", To: "alice", From: "bob", Emoji: "👍", Remove: true, Count: 2}},
+	{"file-offer", &proto.FileOffer{ID: "f1", To: "alice", From: "bob", Name: "notes 1.txt", Size: 5, SHA256: hash}},
+	{"file-accept", &proto.FileAccept{ID: "f1", To: "bob", From: "alice", Offset: 2}},
+	{"file-reject", &proto.FileAccept{ID: "f1", To: "bob", From: "alice", Reject: true}},
+	{"file-chunk", &proto.FileChunk{ID: "f1", To: "alice", From: "bob", Offset: 2, Data: []byte("llo")}},
+	{"file-complete", &proto.FileComplete{ID: "f1", To: "alice", From: "bob"}},
+	{"file-error", &proto.FileComplete{ID: "f1", To: "bob", From: "alice", Error: "checksum mismatch"}},
+}
+
+var modes = []struct {
+	ext  string
+	mode int
+}{
+	{".msgpack", proto.ModeMsgpack},
+	{".txt", proto.ModeText},
+	{".json", proto.ModeJSON},
+}
+
+// check compares the corpus file of a sample to what the codec makes of it,
+// both ways
+func check(path string, datum interface{}, mode int) error {
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := proto.MarshalDatum(datum, mode)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(encoded, golden) {
+		return fmt.Errorf("encodes as %q, not %q", encoded, golden)
+	}
+
+	decoded, err := proto.UnmarshalDatum(golden, mode)
+	if err != nil {
+		return err
+	}
+	if reflect.TypeOf(decoded) != reflect.TypeOf(datum) {
+		return fmt.Errorf("decodes as %T, not %T", decoded, datum)
+	}
+
+	again, err := proto.MarshalDatum(decoded, mode)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(again, golden) {
+		return fmt.Errorf("decodes to %+v, which encodes as %q", decoded, again)
+	}
+
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	failed := 0
+	for _, sample := range samples {
+		for _, m := range modes {
+			path := filepath.Join(*dir, sample.name+m.ext)
+
+			if *write {
+				encoded, err := proto.MarshalDatum(sample.datum, m.mode)
+				if err == nil {
+					err = os.WriteFile(path, encoded, 0644)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+					os.Exit(1)
+				}
+				continue
+			}
+
+			if err := check(path, sample.datum, m.mode); err != nil {
+				fmt.Printf("FAIL %s: %s\n", path, err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d corpus files failed\n", failed, len(samples)*len(modes))
+		os.Exit(1)
+	}
+	if !*write {
+		fmt.Printf("ok, %d corpus files\n", len(samples)*len(modes))
+	}
+}
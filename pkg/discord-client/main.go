@@ -3,21 +3,23 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/mnakama/flexim-go/pkg/bridge"
 	"github.com/mnakama/flexim-go/proto"
 	"gopkg.in/guregu/null.v4"
 	"gopkg.in/yaml.v2"
 	"io"
 	"log"
-	"net"
-	"net/url"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
-	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,6 +28,7 @@ type SnowflakeID string
 type Author struct {
 	ID               SnowflakeID `json:"id"`
 	Username         string      `json:"username"`
+	GlobalName       string      `json:"global_name,omitempty"`
 	Avatar           string      `json:"avatar"`
 	AvatarDecoration string      `json:"avatar_decoration"`
 	Discriminator    string      `json:"discriminator"`
@@ -77,23 +80,41 @@ type Reaction struct {
 	Me    bool  `json:"me"`
 }
 
-type MessageReference struct {
+// ReactionEvent is the d of a MESSAGE_REACTION_ADD or MESSAGE_REACTION_REMOVE
+// event. Member is only sent in guilds.
+type ReactionEvent struct {
+	UserID    SnowflakeID `json:"user_id"`
 	ChannelID SnowflakeID `json:"channel_id"`
-	GuildID   SnowflakeID `json:"guild_id"`
+	MessageID SnowflakeID `json:"message_id"`
+	Emoji     Emoji       `json:"emoji"`
+	Member    *struct {
+		User Author `json:"user"`
+	} `json:"member,omitempty"`
+}
+
+type MessageReference struct {
+	ChannelID SnowflakeID `json:"channel_id,omitempty"`
+	GuildID   SnowflakeID `json:"guild_id,omitempty"`
 	MessageID SnowflakeID `json:"message_id"`
 }
 
 type MessageSend struct {
-	Content string `json:"content"`
-	Nonce   string `json:"nonce,omitempty"`
-	TTS     bool   `json:"tts"`
+	Content          string            `json:"content"`
+	Nonce            string            `json:"nonce,omitempty"`
+	TTS              bool              `json:"tts"`
+	MessageReference *MessageReference `json:"message_reference,omitempty"`
 }
 
+// Message.Type of a reply. Other types may have a MessageReference too, such
+// as crossposts.
+const messageTypeReply = 19
+
 type Message struct {
 	ID              SnowflakeID   `json:"id,omitempty"`
 	Type            int           `json:"type"`
 	Content         string        `json:"content"`
-	ChannelID       SnowflakeID   `json:"channel_id`
+	ChannelID       SnowflakeID   `json:"channel_id"`
+	GuildID         SnowflakeID   `json:"guild_id,omitempty"`
 	Author          Author        `json:"author"`
 	Attachments     []Attachment  `json:"attachments"`
 	Embeds          []Embed       `json:"embeds"`
@@ -107,10 +128,84 @@ type Message struct {
 	Flags           int           `json:"flags"`
 	Components      []interface{} `json:"components"`
 
-	Nonce             SnowflakeID `json:"nonce,omitempty"`
-	MessageReference  interface{} `json:"message_reference,omitempty"`
-	ReferencedMessage *Message    `json:"referenced_message,omitempty"`
-	Reactions         []Reaction  `json:"reactions,omitempty"`
+	Nonce             SnowflakeID       `json:"nonce,omitempty"`
+	MessageReference  *MessageReference `json:"message_reference,omitempty"`
+	ReferencedMessage *Message          `json:"referenced_message,omitempty"`
+	Reactions         []Reaction        `json:"reactions,omitempty"`
+}
+
+// Channel is a channel in READY and CHANNEL_CREATE. Recipients are only sent
+// for private channels.
+type Channel struct {
+	ID         SnowflakeID `json:"id"`
+	Type       int         `json:"type"`
+	Recipients []Author    `json:"recipients,omitempty"`
+}
+
+// Channel.Type of a private chat with one user
+const channelTypeDM = 1
+
+// GatewayPayload is a message on the gateway websocket
+type GatewayPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  *int            `json:"s"`
+	T  string          `json:"t"`
+}
+
+// Gateway opcodes
+const (
+	opDispatch       = 0
+	opHeartbeat      = 1
+	opIdentify       = 2
+	opReconnect      = 7
+	opInvalidSession = 9
+	opHello          = 10
+)
+
+// Gateway intents: guilds, guild presences, guild and direct messages and
+// their reactions, and message content
+const gatewayIntents = 1<<0 | 1<<8 | 1<<9 | 1<<10 | 1<<12 | 1<<13 | 1<<15
+
+// How long to wait before connecting to the gateway again
+const gatewayRetry = 5 * time.Second
+
+// gatewaySend is a message we send on the gateway websocket
+type gatewaySend struct {
+	Op int         `json:"op"`
+	D  interface{} `json:"d"`
+}
+
+type Identify struct {
+	Token      string            `json:"token"`
+	Intents    int               `json:"intents"`
+	Properties map[string]string `json:"properties"`
+}
+
+type Activity struct {
+	Name  string `json:"name"`
+	Type  int    `json:"type"`
+	State string `json:"state,omitempty"`
+}
+
+// Activity.Type of a custom status, whose State is the status text
+const activityTypeCustom = 4
+
+// PresenceUpdate is the d of a PRESENCE_UPDATE event. Its User may only have
+// an ID.
+type PresenceUpdate struct {
+	User       Author      `json:"user"`
+	GuildID    SnowflakeID `json:"guild_id"`
+	Status     string      `json:"status"`
+	Activities []Activity  `json:"activities"`
+}
+
+// presenceStates maps Discord statuses to proto presence states
+var presenceStates = map[string]int8{
+	"online":  proto.StatusOnline,
+	"idle":    proto.StatusAway,
+	"dnd":     proto.StatusBusy,
+	"offline": proto.StatusOffline,
 }
 
 // User config variables
@@ -120,17 +215,15 @@ var config struct {
 }
 
 var (
-	lastClient *proto.Socket
-	clientMap  = make(map[string]*proto.Socket, 1)
-	tcplisten  = flag.String("tcplisten", "", "bind address for TCP clients")
-	unixlisten = flag.String("listen", "", "bind address for local clients")
 	configFile = flag.String("c", os.ExpandEnv("$HOME/.config/flexim/discord.yaml"), "config file")
-
-	// X.org crashes at about 50+ visible windows with dwm
-	chatLimit = flag.Int("chatlimit", 30, "flood protection: maximum amount of open chats")
+	bridgeOpts = bridge.Flags(flag.CommandLine)
+	chats      = bridge.New(backend{}, bridgeOpts)
 
 	client = http.Client{}
 
+	profiles proto.Profiles // of the message authors seen
+	dms      privateChats
+
 	self = Author{
 		ID:            SnowflakeID("311322749010182145"),
 		Username:      "gnuman",
@@ -163,98 +256,84 @@ func main() {
 
 	log.Printf("%+v", config)
 
-	// maybe listen to a tcp socket for clients
-	if *tcplisten != "" {
-		ln, err := net.Listen("tcp", *tcplisten)
-		if err != nil {
-			log.Fatal(err)
-		}
-		go listenLoop(ln)
-	}
-
 	// listen to a unix socket for clients
-	if *unixlisten == "" {
-		*unixlisten = "/tmp/flexim-discord"
+	if bridgeOpts.UnixListen == "" {
+		bridgeOpts.UnixListen = "/tmp/flexim-discord"
 	}
 
-	os.Remove(*unixlisten)
-	ln, err := net.Listen("unix", *unixlisten)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer func() {
-		r := recover()
-		if r != nil {
-			fmt.Println("Panic:", r)
-		}
+	chats.User = self.Username
 
-		quit(1)
+	go func() {
+		for {
+			if err := connectToDiscord(); err != nil {
+				log.Print(err)
+			}
+			time.Sleep(gatewayRetry)
+		}
 	}()
 
-	go listenLoop(ln)
+	chats.Run()
+}
 
-	waitSignal()
+// gateway is a connection to the Discord gateway. The websocket allows one
+// writer at a time, so sends are serialized.
+type gateway struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+	seq  *int // of the last event, for heartbeats
+}
 
-	messageJSON, err := os.Open("/tmp/msg.json")
-	if err != nil {
-		log.Fatal(err)
-	}
+func (g *gateway) send(op int, d interface{}) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-	var messages []Message = make([]Message, 0, 50)
+	return g.conn.WriteJSON(&gatewaySend{Op: op, D: d})
+}
 
-	decoder := json.NewDecoder(messageJSON)
-	decoder.Decode(&messages)
+func (g *gateway) setSeq(seq int) {
+	g.mu.Lock()
+	g.seq = &seq
+	g.mu.Unlock()
+}
 
-	for i := len(messages) - 1; i >= 0; i-- {
-		msg := messages[i]
-		fmt.Printf("%s#%s: %s\n", msg.Author.Username, msg.Author.Discriminator, msg.Content)
+func (g *gateway) heartbeat() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-		for _, a := range msg.Attachments {
-			fmt.Printf("Name: %s\n", a.Filename)
-			fmt.Printf("Type: %s\n", a.ContentType)
-			fmt.Printf("URL: %s\n", a.URL)
-		}
+	return g.conn.WriteJSON(&gatewaySend{Op: opHeartbeat, D: g.seq})
+}
 
-		for _, e := range msg.Embeds {
-			if e.Title != "" {
-				fmt.Printf("Title: %s\n", e.Title)
-			}
-			if e.Description != "" {
-				fmt.Printf("Description: %s\n", e.Description)
-			}
-			/*if e.URL != "" && e.URL != msg.Content {
-				fmt.Printf("URL: %s\n", e.URL)
-			}*/
-			/*if e.Thumbnail.ProxyURL != "" {
-				fmt.Printf("Proxy URL: %s\n", e.Thumbnail.ProxyURL)
-			}*/
-		}
+// heartbeatLoop keeps the gateway connection alive until done is closed
+func (g *gateway) heartbeatLoop(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-		if len(msg.Reactions) > 0 {
-			for _, r := range msg.Reactions {
-				fmt.Printf("%s%d ", r.Emoji.Name, r.Count)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := g.heartbeat(); err != nil {
+				log.Printf("failed to send heartbeat: %s", err)
+				g.conn.Close() // ends the read loop, which reconnects
+				return
 			}
-			fmt.Println()
 		}
-
-		fmt.Println()
 	}
-
-	notify("done", "done")
 }
 
-func connectToDiscord() {
-	const discordWebsocketURL = "gateway.discord.gg/"
-
+// connectToDiscord identifies on the gateway and passes its events on to the
+// chat windows, until the connection ends
+func connectToDiscord() error {
 	u := url.URL{
 		Scheme:   "wss",
-		Host:     discordWebsocketURL,
-		Path:     "/echo",
-		RawQuery: "encoding=json&v=9&compress=zlib-stream",
+		Host:     "gateway.discord.gg",
+		Path:     "/",
+		RawQuery: "encoding=json&v=9", // uncompressed, so events can be decoded as they are
 	}
 	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer func() {
 		err := c.Close()
@@ -263,155 +342,652 @@ func connectToDiscord() {
 		}
 	}()
 
+	g := gateway{conn: c}
+	done := make(chan struct{})
+	defer close(done)
+
 	for {
 		_, message, err := c.ReadMessage()
 		if err != nil {
-			log.Printf("error reading websocket message: %w", err)
+			return fmt.Errorf("error reading websocket message: %w", err)
 		}
 
 		log.Printf("recv: %s", message)
+
+		var payload GatewayPayload
+		if err := json.Unmarshal(message, &payload); err != nil {
+			log.Printf("failed to decode gateway payload: %s", err)
+			continue
+		}
+
+		if payload.S != nil {
+			g.setSeq(*payload.S)
+		}
+
+		switch payload.Op {
+		case opHello:
+			var hello struct {
+				HeartbeatInterval int `json:"heartbeat_interval"`
+			}
+			if err := json.Unmarshal(payload.D, &hello); err != nil || hello.HeartbeatInterval <= 0 {
+				return fmt.Errorf("Invalid gateway hello: %s", payload.D)
+			}
+			go g.heartbeatLoop(time.Duration(hello.HeartbeatInterval)*time.Millisecond, done)
+
+			err := g.send(opIdentify, &Identify{
+				Token:      strings.TrimPrefix(config.AuthToken, "Bot "),
+				Intents:    gatewayIntents,
+				Properties: map[string]string{"os": "linux", "browser": "flexim", "device": "flexim"},
+			})
+			if err != nil {
+				return err
+			}
+
+		case opHeartbeat:
+			if err := g.heartbeat(); err != nil {
+				return err
+			}
+
+		case opReconnect, opInvalidSession:
+			return errors.New("Discord asked to reconnect")
+
+		case opDispatch:
+			handleEvent(&payload)
+		}
 	}
 }
 
-func listenLoop(ln net.Listener) {
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Fatal(err)
+// handleEvent passes a gateway event on to the chat windows it concerns
+func handleEvent(payload *GatewayPayload) {
+	switch payload.T {
+	case "READY":
+		var ready struct {
+			User            Author    `json:"user"`
+			PrivateChannels []Channel `json:"private_channels"`
+		}
+		if err := json.Unmarshal(payload.D, &ready); err != nil {
+			log.Printf("failed to decode ready: %s", err)
+			return
+		}
+
+		// after main has read it, only this goroutine uses self
+		self = ready.User
+
+		for i := range ready.PrivateChannels {
+			dms.addChannel(&ready.PrivateChannels[i])
+		}
+
+	case "CHANNEL_CREATE":
+		var ch Channel
+		if err := json.Unmarshal(payload.D, &ch); err != nil {
+			log.Printf("failed to decode channel: %s", err)
+			return
+		}
+
+		dms.addChannel(&ch)
+
+	case "MESSAGE_CREATE":
+		var msg Message
+		if err := json.Unmarshal(payload.D, &msg); err != nil {
+			log.Printf("failed to decode message: %s", err)
+			return
+		}
+
+		// bots aren't told about private channels, only sent their messages
+		if msg.GuildID == "" && msg.Author.ID != self.ID {
+			dms.addMessage(&msg)
+		}
+
+		rememberAuthor(&msg.Author)
+
+		// our own messages are already in the window that sent them
+		if msg.Author.ID != self.ID {
+			relayMessage(&msg)
+		}
+
+	case "MESSAGE_UPDATE":
+		var msg Message
+		if err := json.Unmarshal(payload.D, &msg); err != nil {
+			log.Printf("failed to decode message: %s", err)
+			return
+		}
+
+		rememberAuthor(&msg.Author)
+
+	case "PRESENCE_UPDATE":
+		var presence PresenceUpdate
+		if err := json.Unmarshal(payload.D, &presence); err != nil {
+			log.Printf("failed to decode presence: %s", err)
+			return
+		}
+
+		status := protoStatus(&presence)
+		if status == nil {
+			return
 		}
 
-		newChatOut(conn)
+		// only a private chat shows presence
+		if id, found := dms.conversation(presence.User.ID); found {
+			chats.Relay(id, status)
+		}
+
+	case "MESSAGE_REACTION_ADD", "MESSAGE_REACTION_REMOVE":
+		var event ReactionEvent
+		if err := json.Unmarshal(payload.D, &event); err != nil {
+			log.Printf("failed to decode reaction: %s", err)
+			return
+		}
+
+		// reactions alone don't open a window
+		reaction := protoReaction(&event, payload.T == "MESSAGE_REACTION_REMOVE")
+		chats.Relay(conversation(event.ChannelID), reaction)
 	}
 }
 
-func newChatOut(conn net.Conn) {
-	sock := proto.FromConn(conn, proto.ModeMsgpack)
+// relayMessage passes a received message on to the chat window of its
+// channel, opening one if needed
+func relayMessage(msg *Message) {
+	id := conversation(msg.ChannelID)
+
+	sock := chats.Open(id)
+	if sock == nil {
+		return
+	}
+
+	pmsg := protoMessage(msg)
+	bridge.Send(sock, pmsg)
+	for _, reaction := range protoReactions(msg) {
+		bridge.Send(sock, reaction)
+	}
 
-	setCallbacks(sock, "")
+	notify(id, fmt.Sprintf("<%s> %s", pmsg.From, pmsg.Msg))
 }
 
-func setCallbacks(sock *proto.Socket, clientID string) {
-	const maxIRCLen = 510
+// conversation returns the chat window ID of a Discord channel: its nickname
+// in the config, or else the channel ID
+func conversation(channelID SnowflakeID) string {
+	for nick, id := range config.Nicknames {
+		if id == string(channelID) {
+			return strings.ToLower(nick)
+		}
+	}
+
+	return string(channelID)
+}
 
-	sock.SetCallbacks(func(msg *proto.Message) { //msg
-		log.Printf("client -> server: %+v\n", msg)
-		if clientID == "" && msg.To != "" {
-			clientID = strings.ToLower(msg.To)
-			clientMap[clientID] = sock
+// channel returns the Discord channel of a conversation, see conversation
+func channel(to string) SnowflakeID {
+	for nick, id := range config.Nicknames {
+		if strings.EqualFold(nick, to) {
+			return SnowflakeID(id)
 		}
+	}
 
-		SendMessage(msg)
+	return SnowflakeID(to)
+}
 
-		lastClient = sock
-	}, func(cmd *proto.Command) { // cmd
-		log.Println(cmd)
+// privateChats remembers who each private channel is with. Chat windows are
+// keyed by channel, while presence and profiles are about users.
+type privateChats struct {
+	mu       sync.Mutex
+	channels map[SnowflakeID]string      // username of a private channel; "" for group chats
+	byUser   map[SnowflakeID]SnowflakeID // private channel of a user ID
+}
 
-		lastClient = sock
+func (p *privateChats) add(channelID SnowflakeID, user *Author) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	}, func(txt string) { // text
-		log.Println(txt)
+	if p.channels == nil {
+		p.channels = make(map[SnowflakeID]string)
+		p.byUser = make(map[SnowflakeID]SnowflakeID)
+	}
 
-	}, func() { // disconnect
-		log.Println("Chat window disconnected")
-		if clientID != "" {
-			/*if strings.HasPrefix(clientID, "#") {
-				fmt.Fprintf(irc, "PART %s\n", clientID)
-			}*/
-			delete(clientMap, clientID)
-		}
+	if user == nil {
+		p.channels[channelID] = ""
+		return
+	}
 
-	},
-		cb_Status, // status
-		cb_Roster, // roster
-		cb_Auth)   // auth
+	p.channels[channelID] = user.Username
+	p.byUser[user.ID] = channelID
 }
 
-func SendMessage(pmsg *proto.Message) {
-	msg := MessageSend{
-		Content: pmsg.Msg,
+// addChannel remembers a channel from READY or CHANNEL_CREATE. Guild
+// channels are not private.
+func (p *privateChats) addChannel(ch *Channel) {
+	if ch.Type == channelTypeDM && len(ch.Recipients) == 1 {
+		p.add(ch.ID, &ch.Recipients[0])
+	} else if len(ch.Recipients) > 0 {
+		p.add(ch.ID, nil)
 	}
+}
 
-	data, err := json.Marshal(&msg)
-	if err != nil {
-		log.Printf("error while encoding message to json: %w", err)
-		return
+// addMessage remembers the channel of a message outside of guilds as private
+// with its author, unless it is known to be a group chat
+func (p *privateChats) addMessage(msg *Message) {
+	p.mu.Lock()
+	_, known := p.channels[msg.ChannelID]
+	p.mu.Unlock()
+
+	if !known {
+		p.add(msg.ChannelID, &msg.Author)
 	}
+}
 
-	channelID, found := config.Nicknames[pmsg.To]
+// conversation returns the chat window ID of the private chat with a user
+func (p *privateChats) conversation(userID SnowflakeID) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	channelID, found := p.byUser[userID]
 	if !found {
-		channelID = pmsg.To
+		return "", false
 	}
 
-	fmt.Printf("To: %s ChannelID: %s\n", pmsg.To, channelID)
-	fmt.Printf("data: %s\n\n", string(data))
+	return conversation(channelID), true
+}
+
+// username returns who a private channel is with
+func (p *privateChats) username(channelID SnowflakeID) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := p.channels[channelID]
+	return name, name != ""
+}
+
+// sendProfile sends a private chat window the profile of the user it is with.
+// The window knows them by its conversation ID, so that is the name the
+// profile gets, and the username becomes an alias.
+func sendProfile(sock *proto.Socket, id string, profile proto.User) {
+	if !strings.EqualFold(profile.Name, id) {
+		profile.Aliases = append([]string{profile.Name}, profile.Aliases...)
+		profile.Name = id
+	}
+
+	bridge.Send(sock, &profile)
+}
+
+// backend connects chat windows to Discord
+type backend struct{}
+
+func (backend) Hello(sock *proto.Socket) {
+	sock.SetAgent("flexim-discord") // no commands are handled yet
+	sock.AddCaps(proto.CapReceipts, proto.CapEdit, proto.CapReactions, proto.CapReplies)
+}
+
+func (backend) Handler(sock *proto.Socket, clientID string) proto.Handler {
+	return &chatHandler{sock: sock, clientID: clientID, sent: make(map[string]sentMessage)}
+}
 
-	reader := bytes.NewReader(data)
-	req, err := http.NewRequest(
-		http.MethodPost,
-		"https://discord.com/api/v9/channels/"+channelID+"/messages",
-		reader)
+// Opened sends a private chat window the profile of the user it is with
+func (backend) Opened(sock *proto.Socket, clientID string) {
+	name, private := dms.username(channel(clientID))
+	if !private {
+		return
+	}
+
+	if profile, known := profiles.Get(name); known {
+		sendProfile(sock, clientID, profile)
+	}
+}
+
+func (backend) Closed(clientID string) {}
+
+// sentMessage is where a message from the chat window ended up on Discord
+type sentMessage struct {
+	channelID SnowflakeID
+	id        SnowflakeID
+}
+
+// chatHandler receives datums from a chat window
+type chatHandler struct {
+	proto.BaseHandler
+	sock     *proto.Socket
+	clientID string
+	sent     map[string]sentMessage // by proto.Message ID, for edits and deletes
+}
+
+func (h *chatHandler) Message(msg *proto.Message) {
+	log.Printf("client -> server: %+v\n", msg)
+	if h.clientID == "" && msg.To != "" {
+		h.clientID = strings.ToLower(msg.To)
+		chats.Register(h.clientID, h.sock)
+	}
+
+	// without an Ack, the chat window reports the message as failed
+	sent, err := SendMessage(msg, h.reference(msg.ReplyTo))
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	req.Header.Add("Authorization", config.AuthToken)
-	req.Header.Add("Content-Type", "application/json")
+	if msg.ID != "" && sent.id != "" {
+		h.sent[msg.ID] = sent
+	}
 
-	res, err := client.Do(req)
-	if err != nil {
+	if err = h.sock.SendAck(msg); err != nil {
 		log.Print(err)
+	}
+
+	chats.SetLast(h.sock)
+}
+
+// reference finds the Discord message a reply answers. Received messages
+// already have Discord IDs; our own are looked up in sent.
+func (h *chatHandler) reference(id string) *MessageReference {
+	if id == "" {
+		return nil
+	}
+
+	if sent, found := h.sent[id]; found {
+		return &MessageReference{MessageID: sent.id}
+	}
+
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		log.Printf("Can't reply to message %s: it was not sent from this window", id)
+		return nil
+	}
+
+	return &MessageReference{MessageID: SnowflakeID(id)}
+}
+
+func (h *chatHandler) Edit(edit *proto.Edit) {
+	sent, found := h.sent[edit.ID]
+	if !found {
+		log.Printf("Can't edit message %s: it was not sent from this window", edit.ID)
 		return
 	}
 
-	body, err := io.ReadAll(res.Body)
+	_, err := discordRequest(http.MethodPatch, fmt.Sprintf("channels/%s/messages/%s", sent.channelID, sent.id),
+		&MessageSend{Content: edit.Msg})
 	if err != nil {
-		log.Printf("failed to read response body: %w", err)
+		log.Printf("failed to edit message: %s", err)
 	}
+}
 
-	if res.StatusCode != http.StatusOK {
-		log.Printf("failed to send message (%d): %s", res.StatusCode, body)
+func (h *chatHandler) Retract(retract *proto.Retract) {
+	sent, found := h.sent[retract.ID]
+	if !found {
+		log.Printf("Can't delete message %s: it was not sent from this window", retract.ID)
 		return
 	}
 
-	log.Printf("send message received response: %s", body)
+	_, err := discordRequest(http.MethodDelete, fmt.Sprintf("channels/%s/messages/%s", sent.channelID, sent.id), nil)
+	if err != nil {
+		log.Printf("failed to delete message: %s", err)
+		return
+	}
+
+	delete(h.sent, retract.ID)
 }
 
-func cb_Status(status *proto.Status) {
-	log.Println(status)
+func (h *chatHandler) Command(cmd *proto.Command) {
+	log.Println(cmd)
+
+	chats.SetLast(h.sock)
 }
 
-func cb_Roster(roster *proto.Roster) {
-	log.Println(roster)
+func (h *chatHandler) Text(txt string) {
+	log.Println(txt)
 }
 
-func cb_Auth(auth *proto.Auth) {
-	log.Println(auth)
+func (h *chatHandler) Disconnect() {
+	log.Println("Chat window disconnected")
+	if h.clientID != "" {
+		chats.Unregister(h.clientID, h.sock)
+	}
 }
 
-// Catch interrupt signal
-func waitSignal() {
-	c := make(chan os.Signal)
+// Reaction reacts to a message. Received messages already have Discord IDs;
+// our own are looked up in sent.
+func (h *chatHandler) Reaction(reaction *proto.Reaction) {
+	sent, found := h.sent[reaction.ID]
+	if !found {
+		if _, err := strconv.ParseUint(reaction.ID, 10, 64); err != nil {
+			log.Printf("Can't react to message %s: it was not sent from this window", reaction.ID)
+			return
+		}
+
+		to := reaction.To
+		if to == "" {
+			to = h.clientID
+		}
+		sent = sentMessage{channelID: channel(to), id: SnowflakeID(reaction.ID)}
+	}
+
+	method := http.MethodPut
+	if reaction.Remove {
+		method = http.MethodDelete
+	}
+
+	_, err := discordRequest(method, fmt.Sprintf("channels/%s/messages/%s/reactions/%s/@me",
+		sent.channelID, sent.id, url.PathEscape(reaction.Emoji)), nil)
+	if err != nil {
+		log.Printf("failed to react to message: %s", err)
+	}
+}
+
+// protoMessage converts a Discord message for a chat window
+func protoMessage(msg *Message) *proto.Message {
+	pmsg := proto.Message{
+		ID:    string(msg.ID),
+		To:    string(msg.ChannelID),
+		From:  msg.Author.Username,
+		Flags: []string{},
+		Date:  msg.Timestamp.Unix(),
+		Msg:   msg.Content,
+	}
+
+	if msg.Type == messageTypeReply && msg.MessageReference != nil {
+		pmsg.ReplyTo = string(msg.MessageReference.MessageID)
+	}
 
-	signal.Notify(c, os.Interrupt)
-	s := <-c
-	log.Println("Received signal:", s)
+	for _, a := range msg.Attachments {
+		pmsg.Attachments = append(pmsg.Attachments, proto.Attachment{
+			Name: a.Filename,
+			Type: a.ContentType,
+			Size: int64(a.Size),
+			URL:  a.URL,
+		})
+	}
+
+	for _, e := range msg.Embeds {
+		// a link without a preview is already in the text
+		if e.Title == "" && e.Description == "" && e.Thumbnail.URL == "" {
+			continue
+		}
+
+		// the proxy serves the thumbnail without telling its host who we are
+		thumbnail := e.Thumbnail.ProxyURL
+		if thumbnail == "" {
+			thumbnail = e.Thumbnail.URL
+		}
+
+		pmsg.Embeds = append(pmsg.Embeds, proto.Embed{
+			URL:         e.URL,
+			Title:       e.Title,
+			Description: e.Description,
+			Thumbnail:   thumbnail,
+		})
+	}
 
-	quit(0)
+	return &pmsg
 }
 
-// do cleanup
-func quit(ret int) {
-	fmt.Println("Closing down...")
-	os.Remove(*unixlisten)
+// rememberAuthor updates the profile of a message's author, and passes it on
+// to the private chat window with the author if it changed
+func rememberAuthor(author *Author) {
+	if author.Username == "" {
+		return
+	}
+
+	user := protoUser(author)
+	old, known := profiles.Get(user.Name)
+	profile := profiles.Update(user)
+	if known && old.DisplayName == profile.DisplayName && old.Avatar == profile.Avatar {
+		return
+	}
 
-	cmd := proto.Command{
-		Cmd: "BYE ",
+	id, found := dms.conversation(author.ID)
+	if !found {
+		return
 	}
-	for _, sock := range clientMap {
-		sock.SendCommand(&cmd)
-		sock.Close()
+
+	if sock, open := chats.Window(id); open {
+		sendProfile(sock, id, profile)
+	}
+}
+
+// protoUser converts a Discord user to a profile
+func protoUser(author *Author) *proto.User {
+	user := proto.User{
+		Name:        author.Username,
+		DisplayName: author.GlobalName,
+	}
+
+	// users that haven't moved to unique usernames yet are still name#1234
+	if author.Discriminator != "" && author.Discriminator != "0" {
+		user.Aliases = []string{author.Username + "#" + author.Discriminator}
+	}
+
+	if author.Avatar != "" {
+		user.Avatar = fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", author.ID, author.Avatar)
+	}
+
+	return &user
+}
+
+// protoStatus converts a Discord presence for a chat window. The user is
+// named by username if Discord sent it, or else by ID.
+func protoStatus(presence *PresenceUpdate) *proto.Status {
+	state, ok := presenceStates[presence.Status]
+	if !ok {
+		log.Printf("unknown presence status: %s", presence.Status)
+		return nil
+	}
+
+	status := proto.Status{
+		Status: state,
+		User:   presence.User.Username,
+		Since:  time.Now().Unix(),
+	}
+	if status.User == "" {
+		status.User = string(presence.User.ID)
+	}
+
+	for _, a := range presence.Activities {
+		if a.Type == activityTypeCustom {
+			status.Payload = a.State
+		}
+	}
+
+	return &status
+}
+
+// protoReactions converts the reactions on a Discord message to Reaction
+// datums. Discord only tells the totals, and whether one of them is ours.
+func protoReactions(msg *Message) []*proto.Reaction {
+	var reactions []*proto.Reaction
+
+	for _, r := range msg.Reactions {
+		reaction := proto.Reaction{
+			ID:    string(msg.ID),
+			To:    string(msg.ChannelID),
+			Emoji: r.Emoji.Name,
+			Count: r.Count,
+		}
+		if r.Me {
+			reaction.From = self.Username
+		}
+
+		reactions = append(reactions, &reaction)
+	}
+
+	return reactions
+}
+
+// protoReaction converts a reaction event for a chat window. Unlike the
+// totals on a message, it tells who reacted.
+func protoReaction(event *ReactionEvent, remove bool) *proto.Reaction {
+	reaction := proto.Reaction{
+		ID:     string(event.MessageID),
+		To:     string(event.ChannelID),
+		From:   string(event.UserID),
+		Emoji:  event.Emoji.Name,
+		Remove: remove,
+	}
+
+	if event.UserID == self.ID {
+		reaction.From = self.Username
+	} else if event.Member != nil && event.Member.User.Username != "" {
+		reaction.From = event.Member.User.Username
+	}
+
+	return &reaction
+}
+
+// discordRequest calls the Discord API, sending body as JSON if it is not nil
+func discordRequest(method, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("error while encoding request to json: %w", err)
+		}
+
+		fmt.Printf("data: %s\n\n", string(data))
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "https://discord.com/api/v9/"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Authorization", config.AuthToken)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("failed to read response body: %s", err)
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("%s %s failed (%d): %s", method, path, res.StatusCode, resBody)
+	}
+
+	return resBody, nil
+}
+
+func SendMessage(pmsg *proto.Message, reference *MessageReference) (sentMessage, error) {
+	channelID, found := config.Nicknames[pmsg.To]
+	if !found {
+		channelID = pmsg.To
+	}
+
+	fmt.Printf("To: %s ChannelID: %s\n", pmsg.To, channelID)
+
+	body, err := discordRequest(http.MethodPost, "channels/"+channelID+"/messages",
+		&MessageSend{Content: pmsg.Msg, MessageReference: reference})
+	if err != nil {
+		return sentMessage{}, fmt.Errorf("failed to send message: %w", err)
+	}
+
+	log.Printf("send message received response: %s", body)
+
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		log.Printf("failed to decode sent message: %s", err)
 	}
 
-	os.Exit(ret)
+	return sentMessage{channelID: SnowflakeID(channelID), id: msg.ID}, nil
 }
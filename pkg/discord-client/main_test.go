@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mnakama/flexim-go/proto"
+)
+
+// testWindow is a chat window that remembers the presence and profiles it is
+// sent
+type testWindow struct {
+	proto.BaseHandler
+
+	mu       sync.Mutex
+	statuses []proto.Status
+	users    []proto.User
+}
+
+func (w *testWindow) Status(status *proto.Status) {
+	w.mu.Lock()
+	w.statuses = append(w.statuses, *status)
+	w.mu.Unlock()
+}
+
+func (w *testWindow) User(user *proto.User) {
+	w.mu.Lock()
+	w.users = append(w.users, *user)
+	w.mu.Unlock()
+}
+
+func (w *testWindow) got() ([]proto.Status, []proto.User) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]proto.Status{}, w.statuses...), append([]proto.User{}, w.users...)
+}
+
+// openWindow registers a chat window for conversation id
+func openWindow(t *testing.T, id string) *testWindow {
+	bridgeEnd, windowEnd := net.Pipe()
+
+	sock := proto.FromConn(bridgeEnd, proto.ModeMsgpack)
+	if err := sock.SendHeader(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testWindow{}
+	go proto.FromConn(windowEnd, proto.ModeMsgpack).Serve(context.Background(), w)
+
+	chats.Register(id, sock)
+
+	return w
+}
+
+func event(t *testing.T, name string, d interface{}) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handleEvent(&GatewayPayload{Op: opDispatch, T: name, D: data})
+}
+
+// Presence and profiles are about users, but reach the window of the private
+// channel with them, which is known by its nickname
+func TestPrivateChatRouting(t *testing.T) {
+	config.Nicknames = map[string]string{"Friend": "100"}
+
+	event(t, "READY", map[string]interface{}{
+		"user": Author{ID: "1", Username: "me"},
+		"private_channels": []Channel{
+			{ID: "100", Type: channelTypeDM, Recipients: []Author{{ID: "2", Username: "alice"}}},
+			{ID: "200", Type: 3, Recipients: []Author{{ID: "2", Username: "alice"}, {ID: "3", Username: "bob"}}},
+		},
+	})
+
+	// a private channel only told about by a message, as bots are
+	event(t, "MESSAGE_UPDATE", Message{ID: "m1", ChannelID: "300",
+		Author: Author{ID: "4", Username: "carol", GlobalName: "Carol C"}})
+	dms.addMessage(&Message{ChannelID: "300", Author: Author{ID: "4", Username: "carol"}})
+	dms.addMessage(&Message{ChannelID: "200", Author: Author{ID: "3", Username: "bob"}})
+
+	friend := openWindow(t, "friend")
+	group := openWindow(t, "200")
+	carol := openWindow(t, "300")
+
+	event(t, "PRESENCE_UPDATE", PresenceUpdate{User: Author{ID: "2"}, Status: "idle"})
+	event(t, "PRESENCE_UPDATE", PresenceUpdate{User: Author{ID: "3"}, Status: "online"})
+	event(t, "MESSAGE_UPDATE", Message{ID: "m2", ChannelID: "200",
+		Author: Author{ID: "2", Username: "alice", GlobalName: "Alice A"}})
+
+	time.Sleep(100 * time.Millisecond)
+
+	statuses, users := friend.got()
+	if len(statuses) != 1 || statuses[0].Status != proto.StatusAway || statuses[0].User != "2" {
+		t.Errorf("The private chat with alice got the presence %+v", statuses)
+	}
+	want := []proto.User{{Name: "friend", DisplayName: "Alice A", Aliases: []string{"alice"}}}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("The private chat with alice got the profiles %+v, not %+v", users, want)
+	}
+
+	statuses, users = group.got()
+	if len(statuses) != 0 || len(users) != 0 {
+		t.Errorf("The group chat got %+v and %+v", statuses, users)
+	}
+
+	// the profile known when the window opened
+	_, users = carol.got()
+	want = []proto.User{{Name: "300", DisplayName: "Carol C", Aliases: []string{"carol"}}}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("The private chat with carol got the profiles %+v, not %+v", users, want)
+	}
+}
@@ -0,0 +1,162 @@
+package launcher
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// An attach request is one message on a unix stream socket: the Window as a
+// JSON object, ending in LF, with the chat socket passed along as SCM_RIGHTS.
+// The instance that listens on the attach socket, see ListenAttach, starts a
+// chat window on the received file as if it had been started with it.
+
+// Longest attach request ReadAttach accepts
+const maxAttachLen = 64 * 1024
+
+// ErrNoFile is returned by ReadAttach for a request that carries no socket
+var ErrNoFile = errors.New("Attach request has no file descriptor")
+
+// Attach hands a chat window for w on file over to the instance listening on
+// the unix socket at addr
+func Attach(addr string, file *os.File, w Window) error {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: addr, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	request = append(request, '\n')
+
+	rights := syscall.UnixRights(int(file.Fd()))
+	_, _, err = conn.WriteMsgUnix(request, rights, nil)
+
+	return err
+}
+
+// ReadAttach reads an attach request from a connection accepted on the attach
+// socket. The caller owns the returned file.
+func ReadAttach(conn *net.UnixConn) (Window, *os.File, error) {
+	var w Window
+
+	buf := make([]byte, maxAttachLen)
+	oob := make([]byte, syscall.CmsgSpace(4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return w, nil, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return w, nil, err
+	}
+
+	var file *os.File
+	for i := range msgs {
+		fds, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			if file == nil {
+				file = os.NewFile(uintptr(fd), "attach")
+			} else {
+				syscall.Close(fd)
+			}
+		}
+	}
+	if file == nil {
+		return w, nil, ErrNoFile
+	}
+
+	if err := json.Unmarshal(buf[:n], &w); err != nil {
+		file.Close()
+		return w, nil, err
+	}
+
+	return w, file, nil
+}
+
+// ListenAttach takes attach requests on the unix socket at addr, and starts a
+// chat window for each with l, which must not attach itself. This lets a
+// bridge without a display hand windows to a session that has one. It only
+// returns on error.
+func ListenAttach(addr string, l *Launcher) error {
+	if l.Attach != "" {
+		return errors.New("The launcher of attached windows can't attach them again")
+	}
+
+	ln, err := listenAttach(addr)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(addr)
+	defer ln.Close()
+
+	for {
+		conn, err := ln.AcceptUnix()
+		if err != nil {
+			return err
+		}
+
+		go serveAttach(conn, l)
+	}
+}
+
+// listenAttach listens on a unix socket at addr that only we may connect to.
+// The socket is bound in a new directory only we can enter and moved to addr
+// once its mode is 0600, so nobody can connect while it has the umask's.
+func listenAttach(addr string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(addr), ".flexim-attach-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	bound := filepath.Join(dir, "socket")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	// the socket is removed from addr, not where it was bound
+	ln.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(bound, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	os.Remove(addr)
+	if err := os.Rename(bound, addr); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+func serveAttach(conn *net.UnixConn, l *Launcher) {
+	defer conn.Close()
+
+	w, file, err := ReadAttach(conn)
+	if err != nil {
+		log.Printf("Bad attach request: %s", err)
+		return
+	}
+	defer file.Close()
+
+	if err := l.Launch(file, w); err != nil {
+		log.Printf("Can't start chat window for %s: %s", w.To, err)
+	}
+}
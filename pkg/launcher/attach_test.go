@@ -0,0 +1,87 @@
+package launcher
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The attach socket is private from the moment anyone can reach it
+func TestListenAttachMode(t *testing.T) {
+	dir := t.TempDir()
+	addr := filepath.Join(dir, "attach")
+
+	// a stale socket from an earlier run is replaced
+	if err := os.WriteFile(addr, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := listenAttach(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	info, err := os.Lstat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		t.Errorf("%s is not a socket: %s", addr, info.Mode())
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("The attach socket has mode %o", perm)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files are next to the attach socket", len(entries)-1)
+	}
+
+	// and it still takes requests where it was moved to
+	file, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	want := Window{Mode: "text", To: "bob", User: "alice", Args: []string{"--tls"}}
+	attached := make(chan error, 1)
+	go func() { attached <- Attach(addr, file, want) }()
+
+	conn, err := ln.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w, got, err := ReadAttach(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Close()
+
+	if err := <-attached; err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(w, want) {
+		t.Errorf("Attached %+v, not %+v", w, want)
+	}
+}
+
+func TestListenAttachRefuses(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "attach")
+
+	if err := ListenAttach(addr, &Launcher{Attach: addr}); err == nil {
+		t.Error("A launcher that attaches listens for attach requests")
+	}
+
+	if _, err := net.Dial("unix", addr); err == nil {
+		t.Error("The attach socket was created")
+	}
+}
@@ -0,0 +1,162 @@
+// Package launcher starts a chat window on a connected socket. The program,
+// its arguments and an optional terminal to run it in are configurable, so a
+// terminal UI or a logger can stand in for flexim-chat; a running instance
+// can also take windows over a unix socket instead, see Attach and
+// ListenAttach.
+package launcher
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultArgs is the argument template flexim-chat understands
+const DefaultArgs = "--fd {fd} --mode {mode} --to {to} --user {user} {args}"
+
+// The socket is the first file after stdin, stdout and stderr
+const childFD = 3
+
+// Window is a chat window to start
+type Window struct {
+	Mode string   `json:"mode"`           // "msgpack" or "text"
+	To   string   `json:"to,omitempty"`   // who the chat is with, if known
+	User string   `json:"user,omitempty"` // our name, if known
+	Args []string `json:"args,omitempty"` // more flags for the program, like the TLS ones
+}
+
+// Launcher starts chat windows
+type Launcher struct {
+	Program  string // name in $PATH or next to this executable, or a path
+	Args     string // template, see Expand
+	Terminal string // command line the program is appended to, like "xterm -e"
+	Attach   string // unix socket of a running instance that takes windows
+}
+
+// Flags registers the flags that configure the chat window launcher
+func Flags(fs *flag.FlagSet) *Launcher {
+	var l Launcher
+
+	fs.StringVar(&l.Program, "chat-program", "flexim-chat", "program that shows a chat window")
+	fs.StringVar(&l.Args, "chat-args", DefaultArgs, "arguments of --chat-program; {fd}, {mode}, {to} and {user} are replaced, and {args} becomes any further flags")
+	fs.StringVar(&l.Terminal, "chat-terminal", "", "run --chat-program in this terminal, like \"xterm -e\"; it must pass file descriptor 3 on")
+	fs.StringVar(&l.Attach, "chat-attach", "", "unix socket of a running chat program to hand windows to, before starting a new one, like flexim-chat --attach-listen")
+
+	return &l
+}
+
+// Expand returns the arguments of the program for w
+func (l *Launcher) Expand(w Window) []string {
+	template := l.Args
+	if template == "" {
+		template = DefaultArgs
+	}
+
+	replacer := strings.NewReplacer(
+		"{fd}", fmt.Sprint(childFD),
+		"{mode}", w.Mode,
+		"{to}", w.To,
+		"{user}", w.User,
+	)
+
+	var args []string
+	for _, field := range strings.Fields(template) {
+		if field == "{args}" {
+			args = append(args, w.Args...)
+		} else {
+			args = append(args, replacer.Replace(field))
+		}
+	}
+
+	return args
+}
+
+// Launch starts a chat window for w on file, which is a connected socket. The
+// file is only borrowed, and may be closed once Launch returns.
+func (l *Launcher) Launch(file *os.File, w Window) error {
+	if l.Attach != "" {
+		err := Attach(l.Attach, file, w)
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("Can't attach to %s, starting %s: %s", l.Attach, l.Program, err)
+	}
+
+	program, err := l.path()
+	if err != nil {
+		return err
+	}
+
+	argv := append(strings.Fields(l.Terminal), program)
+	argv = append(argv, l.Expand(w)...)
+
+	path := program
+	if l.Terminal != "" {
+		path, err = exec.LookPath(argv[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	pattr := os.ProcAttr{
+		Files: []*os.File{nil, os.Stdout, os.Stderr, file},
+	}
+
+	proc, err := os.StartProcess(path, argv, &pattr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Pid: %v", proc.Pid)
+
+	go reap(proc, filepath.Base(argv[0]))
+
+	return nil
+}
+
+// path finds the program in $PATH, or else next to this executable, where
+// make puts it
+func (l *Launcher) path() (string, error) {
+	program := l.Program
+	if program == "" {
+		program = "flexim-chat"
+	}
+
+	if strings.ContainsRune(program, filepath.Separator) {
+		return program, nil
+	}
+
+	path, err := exec.LookPath(program)
+	if err == nil {
+		return path, nil
+	}
+
+	if self, selfErr := os.Executable(); selfErr == nil {
+		path = filepath.Join(filepath.Dir(self), program)
+		if info, statErr := os.Stat(path); statErr == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+
+	return "", err
+}
+
+// reap waits for a chat window to exit, so it doesn't linger as a zombie
+func reap(proc *os.Process, name string) {
+	state, err := proc.Wait()
+	if err != nil {
+		log.Printf("%s (pid %d): %s", name, proc.Pid, err)
+		return
+	}
+
+	if !state.Success() {
+		log.Printf("%s (pid %d) %s", name, proc.Pid, state)
+	} else {
+		log.Printf("%s (pid %d) exited", name, proc.Pid)
+	}
+}
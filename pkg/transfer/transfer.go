@@ -0,0 +1,411 @@
+// Package transfer keeps the files of flexim file transfers on disk. It reads
+// outgoing files into FileChunks, and writes incoming ones to a partial file
+// that a later offer of the same file resumes. Partial files are locked while
+// a transfer writes them, so concurrent offers of a file don't share one.
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/mnakama/flexim-go/proto"
+)
+
+// How many packets may wait in the socket's queue before Send holds back the
+// next chunk, so chat messages don't get stuck behind a whole file.
+const maxQueued = 8
+
+// ErrCanceled is returned by Send after Cancel
+var ErrCanceled = errors.New("Transfer canceled")
+
+// DownloadDir returns the directory received files are saved in
+func DownloadDir() string {
+	if xdg.UserDirs.Download != "" {
+		return xdg.UserDirs.Download
+	}
+
+	return xdg.Home
+}
+
+// Outgoing is a file being sent. It is safe for concurrent use.
+type Outgoing struct {
+	offer    proto.FileOffer
+	path     string
+	sent     atomic.Int64
+	cancel   sync.Once
+	canceled chan struct{}
+}
+
+// NewOutgoing reads the file at path to offer it from one user to another
+func NewOutgoing(path, to, from string) (*Outgoing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Outgoing{
+		offer: proto.FileOffer{
+			ID:     proto.NewMessageID(),
+			To:     to,
+			From:   from,
+			Name:   filepath.Base(path),
+			Size:   size,
+			SHA256: hash.Sum(nil),
+		},
+		path:     path,
+		canceled: make(chan struct{}),
+	}, nil
+}
+
+// Offer returns the FileOffer to send to the peer
+func (o *Outgoing) Offer() *proto.FileOffer {
+	offer := o.offer
+	return &offer
+}
+
+// Sent returns how many bytes the peer has, counting the ones it already had
+func (o *Outgoing) Sent() int64 {
+	return o.sent.Load()
+}
+
+// Cancel stops Send
+func (o *Outgoing) Cancel() {
+	o.cancel.Do(func() {
+		close(o.canceled)
+	})
+}
+
+// Send sends the file from offset on, then a FileComplete. It waits for the
+// socket to write the chunks as it goes, so call it on its own goroutine.
+// progress is called after each chunk, with the bytes sent so far.
+func (o *Outgoing) Send(sock *proto.Socket, offset int64, progress func(sent int64)) error {
+	if offset < 0 || offset > o.offer.Size {
+		return fmt.Errorf("Offset %d is outside of %s", offset, o.offer.Name)
+	}
+
+	file, err := os.Open(o.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	o.sent.Store(offset)
+	buf := make([]byte, proto.FileChunkSize)
+
+	for offset < o.offer.Size {
+		for sock.QueueLen() > maxQueued {
+			select {
+			case <-o.canceled:
+				return ErrCanceled
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+
+		select {
+		case <-o.canceled:
+			return ErrCanceled
+		default:
+		}
+
+		n := int64(len(buf))
+		if rest := o.offer.Size - offset; rest < n {
+			n = rest
+		}
+
+		// a file that shrank since the offer ends in io.ErrUnexpectedEOF
+		_, err := io.ReadFull(file, buf[:n])
+		if err != nil {
+			return err
+		}
+
+		err = sock.Send(&proto.FileChunk{
+			ID:     o.offer.ID,
+			To:     o.offer.To,
+			From:   o.offer.From,
+			Offset: offset,
+			Data:   buf[:n],
+		})
+		if err != nil {
+			return err
+		}
+
+		offset += n
+		o.sent.Store(offset)
+		progress(offset)
+	}
+
+	return sock.Send(&proto.FileComplete{
+		ID:   o.offer.ID,
+		To:   o.offer.To,
+		From: o.offer.From,
+	})
+}
+
+// Incoming is a file being received. It is safe for concurrent use.
+type Incoming struct {
+	mu       sync.Mutex
+	offer    proto.FileOffer
+	dir      string
+	part     string
+	file     *os.File
+	received int64
+}
+
+// NewIncoming prepares to receive an offered file into dir. If part of the
+// same file was received before, the transfer resumes after it.
+func NewIncoming(offer *proto.FileOffer, dir string) (*Incoming, error) {
+	if len(offer.SHA256) != sha256.Size {
+		return nil, errors.New("File offer has no valid checksum")
+	}
+	if offer.Size < 0 {
+		return nil, fmt.Errorf("File offer has a negative size: %d", offer.Size)
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, part, err := openPart(dir, offer)
+	if err != nil {
+		return nil, err
+	}
+
+	received, err := file.Seek(0, io.SeekEnd)
+	if err == nil && received > offer.Size {
+		received = 0
+		err = file.Truncate(0)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Incoming{
+		offer:    *offer,
+		dir:      dir,
+		part:     part,
+		file:     file,
+		received: received,
+	}, nil
+}
+
+// Offer returns the offer being received
+func (in *Incoming) Offer() *proto.FileOffer {
+	offer := in.offer
+	return &offer
+}
+
+// Received returns how many bytes of the file are stored
+func (in *Incoming) Received() int64 {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	return in.received
+}
+
+// Accept returns the answer to the offer, asking for the data not received yet
+func (in *Incoming) Accept(from string) *proto.FileAccept {
+	return &proto.FileAccept{
+		ID:     in.offer.ID,
+		To:     in.offer.From,
+		From:   from,
+		Offset: in.Received(),
+	}
+}
+
+// Write stores a chunk, which must follow the data received so far, and
+// returns the number of bytes received.
+func (in *Incoming) Write(chunk *proto.FileChunk) (int64, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if chunk.Offset != in.received {
+		return in.received, fmt.Errorf("Chunk of %s at %d, expected %d", in.offer.Name, chunk.Offset, in.received)
+	}
+	if in.received+int64(len(chunk.Data)) > in.offer.Size {
+		return in.received, fmt.Errorf("Received more than the %d bytes offered for %s", in.offer.Size, in.offer.Name)
+	}
+
+	n, err := in.file.Write(chunk.Data)
+	in.received += int64(n)
+
+	return in.received, err
+}
+
+// Finish checks the received file against the offer's checksum and moves it
+// into place, returning its path. A file that doesn't match is deleted.
+func (in *Incoming) Finish() (string, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.received != in.offer.Size {
+		return "", fmt.Errorf("Transfer of %s ended after %d of %d bytes", in.offer.Name, in.received, in.offer.Size)
+	}
+
+	_, err := in.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, in.file)
+	if err != nil {
+		return "", err
+	}
+
+	// the lock is kept until the partial file is gone
+	defer in.file.Close()
+
+	if !bytes.Equal(hash.Sum(nil), in.offer.SHA256) {
+		os.Remove(in.part)
+		return "", fmt.Errorf("%s does not match its checksum, and was deleted", in.offer.Name)
+	}
+
+	path := uniquePath(in.dir, safeName(in.offer.Name))
+	err = os.Rename(in.part, path)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Close stops receiving, keeping what was received to resume later
+func (in *Incoming) Close() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	return in.file.Close()
+}
+
+// Discard stops receiving and deletes what was received
+func (in *Incoming) Discard() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	defer in.file.Close()
+	return os.Remove(in.part)
+}
+
+// openPart opens and locks a partial file for an offer in dir. One left by an
+// earlier transfer of the same file is resumed, unless another transfer holds
+// it; otherwise a new one is named after the checksum and the transfer ID.
+func openPart(dir string, offer *proto.FileOffer) (*os.File, string, error) {
+	prefix := filepath.Join(dir, ".flexim-"+hex.EncodeToString(offer.SHA256)+"-")
+
+	parts, err := filepath.Glob(prefix + "*.part")
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, part := range parts {
+		file, err := lockPart(part, os.O_RDWR)
+		if err == nil {
+			return file, part, nil
+		}
+	}
+
+	// the ID comes from the peer, so only its hash goes in the name
+	id := sha256.Sum256([]byte(offer.ID))
+	part := prefix + hex.EncodeToString(id[:8]) + ".part"
+
+	file, err := lockPart(part, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return file, part, nil
+}
+
+// lockPart opens a partial file and locks it for this transfer
+func lockPart(part string, flag int) (*os.File, error) {
+	file, err := os.OpenFile(part, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s is being received by another transfer: %w", part, err)
+	}
+
+	// the transfer that held the lock may have finished with the file since
+	// it was opened
+	opened, err := file.Stat()
+	if err == nil {
+		var current os.FileInfo
+		current, err = os.Stat(part)
+		if err == nil && !os.SameFile(opened, current) {
+			err = fmt.Errorf("%s was replaced", part)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// safeName keeps an offered name from leaving the download directory
+func safeName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == ".." || name == "/" {
+		return "download"
+	}
+
+	return name
+}
+
+// uniquePath returns a path in dir for name that doesn't exist yet, adding a
+// number to the name if needed.
+func uniquePath(dir, name string) string {
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			return path
+		}
+
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+}
@@ -0,0 +1,322 @@
+package transfer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mnakama/flexim-go/proto"
+)
+
+// offerFile writes data to a file and returns an offer of it
+func offerFile(t *testing.T, name string, data []byte) *proto.FileOffer {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := NewOutgoing(path, "bob", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer := o.Offer()
+	offer.Name = name // NewOutgoing only keeps the base name
+
+	return offer
+}
+
+// reoffer is the same file offered again, as a new transfer
+func reoffer(offer *proto.FileOffer) *proto.FileOffer {
+	again := *offer
+	again.ID = proto.NewMessageID()
+	return &again
+}
+
+func write(t *testing.T, in *Incoming, data []byte, from, to int) {
+	offer := in.Offer()
+	_, err := in.Write(&proto.FileChunk{ID: offer.ID, Offset: int64(from), Data: data[from:to]})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// partFiles returns the partial files left in dir
+func partFiles(t *testing.T, dir string) []string {
+	parts, err := filepath.Glob(filepath.Join(dir, ".flexim-*.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parts
+}
+
+func TestResume(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	dir := t.TempDir()
+
+	resumes := []struct {
+		name     string
+		received int
+	}{
+		{"nothing", 0},
+		{"half", 500},
+		{"all", 1000},
+	}
+
+	for _, tt := range resumes {
+		offer := offerFile(t, tt.name, data)
+
+		in, err := NewIncoming(offer, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, in, data, 0, tt.received)
+		in.Close()
+
+		in, err = NewIncoming(reoffer(offer), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := in.Accept("bob").Offset; n != int64(tt.received) {
+			t.Errorf("%s: resumes at %d, not %d", tt.name, n, tt.received)
+		}
+		write(t, in, data, tt.received, len(data))
+
+		path, err := in.Finish()
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: %s holds %d bytes, %v", tt.name, path, len(got), err)
+		}
+	}
+
+	if parts := partFiles(t, dir); len(parts) != 0 {
+		t.Errorf("Partial files are left: %s", parts)
+	}
+}
+
+// A partial file longer than the offer is not the same file after all
+func TestResumeTooLong(t *testing.T) {
+	data := []byte("short file")
+	dir := t.TempDir()
+
+	long := offerFile(t, "long", bytes.Repeat(data, 3))
+	in, err := NewIncoming(long, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, in, bytes.Repeat(data, 3), 0, 3*len(data))
+	in.Close()
+
+	offer := reoffer(long)
+	offer.Size = int64(len(data))
+	in, err = NewIncoming(offer, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Discard()
+
+	if n := in.Received(); n != 0 {
+		t.Errorf("Resumed at %d of %d bytes", n, len(data))
+	}
+}
+
+// Two offers of the same file at once each get their own partial file
+func TestConcurrentOffers(t *testing.T) {
+	data := bytes.Repeat([]byte("abc"), 1000)
+	dir := t.TempDir()
+	offer := offerFile(t, "same", data)
+
+	first, err := NewIncoming(offer, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewIncoming(reoffer(offer), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.part == second.part {
+		t.Fatalf("Both transfers write %s", first.part)
+	}
+
+	// interleaved, as chunks of both arrive
+	for from := 0; from < len(data); from += 500 {
+		write(t, first, data, from, from+500)
+		write(t, second, data, from, from+500)
+	}
+
+	for _, in := range []*Incoming{first, second} {
+		path, err := in.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+			t.Errorf("%s holds %d bytes, not %d", path, len(got), len(data))
+		}
+	}
+}
+
+// The same transfer offered again while it is still being received
+func TestOfferInUse(t *testing.T) {
+	dir := t.TempDir()
+	offer := offerFile(t, "file", []byte("data"))
+
+	in, err := NewIncoming(offer, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Discard()
+
+	if again, err := NewIncoming(offer, dir); err == nil {
+		again.Discard()
+		t.Error("Two transfers with the same ID write the same file")
+	}
+}
+
+func TestBadChecksum(t *testing.T) {
+	data := []byte("the real file")
+	dir := t.TempDir()
+	offer := offerFile(t, "file", data)
+
+	in, err := NewIncoming(offer, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, in, []byte("the fake file"), 0, len(data))
+
+	if path, err := in.Finish(); err == nil {
+		t.Errorf("A file not matching its checksum was saved as %s", path)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d files are left in the download directory", len(entries))
+	}
+}
+
+func TestBadOffsets(t *testing.T) {
+	data := []byte("0123456789")
+	offer := offerFile(t, "file", data)
+
+	in, err := NewIncoming(offer, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Discard()
+
+	chunks := []struct {
+		name   string
+		offset int64
+		data   []byte
+	}{
+		{"gap", 5, data[5:]},
+		{"negative", -1, data},
+		{"past the end", 0, append(data, 'x')},
+	}
+
+	for _, tt := range chunks {
+		if _, err := in.Write(&proto.FileChunk{ID: offer.ID, Offset: tt.offset, Data: tt.data}); err == nil {
+			t.Errorf("The %s chunk was written", tt.name)
+		}
+	}
+	if n := in.Received(); n != 0 {
+		t.Errorf("%d bytes were received", n)
+	}
+
+	write(t, in, data, 0, 5)
+	if _, err := in.Write(&proto.FileChunk{ID: offer.ID, Offset: 0, Data: data[:5]}); err == nil {
+		t.Error("A repeated chunk was written")
+	}
+
+	if _, err := in.Finish(); err == nil {
+		t.Error("A file with 5 of 10 bytes was finished")
+	}
+}
+
+func TestBadSendOffsets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := NewOutgoing(path, "bob", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []int64{-1, 11} {
+		if err := o.Send(nil, offset, func(int64) {}); err == nil {
+			t.Errorf("Sent from %d", offset)
+		}
+	}
+}
+
+func TestBadOffers(t *testing.T) {
+	offer := offerFile(t, "file", []byte("data"))
+
+	noSum := *offer
+	noSum.SHA256 = nil
+	negative := *offer
+	negative.Size = -1
+
+	for _, bad := range []*proto.FileOffer{&noSum, &negative} {
+		if in, err := NewIncoming(bad, t.TempDir()); err == nil {
+			in.Discard()
+			t.Errorf("Accepted %+v", bad)
+		}
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	names := []struct {
+		offered, saved string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"../../.bashrc", ".bashrc"},
+		{"/etc/passwd", "passwd"},
+		{`..\..\Windows\win.ini`, "win.ini"},
+		{"dir/", "dir"},
+		{"..", "download"},
+		{".", "download"},
+		{"/", "download"},
+		{"", "download"},
+	}
+
+	for _, tt := range names {
+		if saved := safeName(tt.offered); saved != tt.saved {
+			t.Errorf("%q is saved as %q, not %q", tt.offered, saved, tt.saved)
+		}
+	}
+}
+
+// Whatever name is offered, the file ends up in the download directory
+func TestTraversalNames(t *testing.T) {
+	data := []byte("data")
+	dir := filepath.Join(t.TempDir(), "downloads")
+
+	for _, name := range []string{"../escaped", "../../escaped", `..\escaped`, "/tmp/escaped", ".."} {
+		offer := offerFile(t, "file", data)
+		offer.Name = name
+
+		in, err := NewIncoming(offer, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, in, data, 0, len(data))
+
+		path, err := in.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(path) != dir {
+			t.Errorf("%q was saved as %s", name, path)
+		}
+	}
+}
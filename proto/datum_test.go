@@ -0,0 +1,110 @@
+package proto
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The corpus in testdata is written by pkg/conformance
+var corpusModes = map[string]int{
+	".msgpack": ModeMsgpack,
+	".txt":     ModeText,
+	".json":    ModeJSON,
+}
+
+func TestCorpusRoundTrip(t *testing.T) {
+	files, err := os.ReadDir("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checked := 0
+	for _, file := range files {
+		mode, ok := corpusModes[filepath.Ext(file.Name())]
+		if !ok {
+			continue
+		}
+
+		golden, err := os.ReadFile(filepath.Join("testdata", file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		datum, err := UnmarshalDatum(golden, mode)
+		if err != nil {
+			t.Errorf("%s: %s", file.Name(), err)
+			continue
+		}
+
+		encoded, err := MarshalDatum(datum, mode)
+		if err != nil {
+			t.Errorf("%s: %s", file.Name(), err)
+			continue
+		}
+
+		if !bytes.Equal(encoded, golden) {
+			t.Errorf("%s: decodes to %+v, which encodes as %q", file.Name(), datum, encoded)
+		}
+		checked++
+	}
+
+	if checked == 0 {
+		t.Error("No corpus files in testdata")
+	}
+}
+
+// fuzzUnmarshal seeds f with the corpus files of a mode, and checks that any
+// input either fails to decode or decodes to a datum that encodes stably
+func fuzzUnmarshal(f *testing.F, ext string) {
+	mode := corpusModes[ext]
+
+	seeds, _ := filepath.Glob(filepath.Join("testdata", "*"+ext))
+	for _, seed := range seeds {
+		data, err := os.ReadFile(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		datum, err := UnmarshalDatum(data, mode)
+		if err != nil {
+			return
+		}
+
+		encoded, err := MarshalDatum(datum, mode)
+		if err != nil {
+			// too large once escaped, or not encodable at all
+			return
+		}
+
+		again, err := UnmarshalDatum(encoded, mode)
+		if err != nil {
+			t.Fatalf("%+v encodes as %q, which fails to decode: %s", datum, encoded, err)
+		}
+
+		reencoded, err := MarshalDatum(again, mode)
+		if err != nil {
+			t.Fatalf("%+v fails to encode: %s", again, err)
+		}
+
+		if !bytes.Equal(encoded, reencoded) {
+			t.Fatalf("%q decodes and encodes as %q", encoded, reencoded)
+		}
+	})
+}
+
+func FuzzUnmarshalDatumMsgpack(f *testing.F) {
+	fuzzUnmarshal(f, ".msgpack")
+}
+
+func FuzzUnmarshalDatumText(f *testing.F) {
+	fuzzUnmarshal(f, ".txt")
+}
+
+func FuzzUnmarshalDatumJSON(f *testing.F) {
+	fuzzUnmarshal(f, ".json")
+}
@@ -0,0 +1,342 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// End-to-end encryption for one-to-one chats. Each side sends a KeyExchange
+// holding a fresh X25519 key signed by its identity; the shared secret of the
+// two ephemeral keys encrypts Message.Encrypted with AES-GCM. The ephemeral
+// keys are never stored, so old sessions can't be decrypted later even if an
+// identity leaks.
+
+const (
+	sigDomainKeyExchange = "flexim key exchange v1"
+	e2eInfo              = "flexim e2e v1"
+)
+
+// KeyExchange offers, or answers an offer of, an encrypted session. Like
+// Message, it is signed again by relays that change From.
+type KeyExchange struct {
+	To        string `msgpack:"to" json:"to"`
+	From      string `msgpack:"from" json:"from"`
+	Name      string `msgpack:"name" json:"name"`           // the name the sender's identity is remembered under
+	Identity  []byte `msgpack:"identity" json:"identity"`   // Ed25519 public key
+	Ephemeral []byte `msgpack:"ephemeral" json:"ephemeral"` // X25519 public key for this session only
+	Date      int64  `msgpack:"date" json:"date"`
+	Reply     bool   `msgpack:"reply" json:"reply"`
+	Signature []byte `msgpack:"sig" json:"sig"`
+}
+
+// KeyExchangeMaxAge is how far the Date of a KeyExchange may be from now, so
+// old ones can't be replayed later
+const KeyExchangeMaxAge = 5 * time.Minute
+
+// Session is one side of an encrypted session. It is safe for concurrent use.
+type Session struct {
+	mu        sync.Mutex
+	id        *Identity
+	ephemeral *ecdh.PrivateKey
+	offer     KeyExchange
+	peer      *KeyExchange
+	send      cipher.AEAD
+	recv      cipher.AEAD
+	sendSeq   uint64
+	recvSeq   uint64
+}
+
+// KeyStatus tells how a peer's identity compares to the remembered one
+type KeyStatus int
+
+const (
+	KeyNew     KeyStatus = iota // first session with this name; the key is now remembered
+	KeyKnown                    // same key as before
+	KeyChanged                  // a different key than before; it was not remembered
+	KeyUnknown                  // the remembered keys could not be checked
+)
+
+// DefaultKnownKeysFile returns the file peer identities are remembered in
+func DefaultKnownKeysFile() string {
+	return filepath.Join(xdg.ConfigHome, "flexim", "known_keys")
+}
+
+// CheckPeerKey compares key with the one remembered for name, remembering it
+// if name is new.
+func CheckPeerKey(path string, name string, key []byte) (KeyStatus, error) {
+	pinMu.Lock()
+	defer pinMu.Unlock()
+
+	known, found, err := lookupPin(path, name)
+	if err != nil {
+		return KeyUnknown, err
+	}
+
+	if found {
+		if known != hex.EncodeToString(key) {
+			return KeyChanged, nil
+		}
+
+		return KeyKnown, nil
+	}
+
+	return KeyNew, savePin(path, name, hex.EncodeToString(key))
+}
+
+// TrustPeerKey remembers key for name, replacing the old one
+func TrustPeerKey(path string, name string, key []byte) error {
+	pinMu.Lock()
+	defer pinMu.Unlock()
+
+	return savePin(path, name, hex.EncodeToString(key))
+}
+
+func keyExchangeSigData(kx *KeyExchange) []byte {
+	return sigData(sigDomainKeyExchange, kx.To, kx.From, kx.Name, string(kx.Identity), string(kx.Ephemeral),
+		fmt.Sprint(kx.Date), fmt.Sprint(kx.Reply))
+}
+
+// SignKeyExchange signs kx as coming from id, which must already have its
+// final To and From
+func (id *Identity) SignKeyExchange(kx *KeyExchange) {
+	kx.Identity = id.Public()
+	kx.Signature = ed25519.Sign(id.Private, keyExchangeSigData(kx))
+}
+
+// VerifyKeyExchange checks that kx was signed by the identity it carries, and
+// that it was made recently
+func VerifyKeyExchange(kx *KeyExchange) error {
+	if len(kx.Identity) != ed25519.PublicKeySize {
+		return errors.New("Key exchange has no valid identity")
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(kx.Identity), keyExchangeSigData(kx), kx.Signature) {
+		return fmt.Errorf("Invalid key exchange signature from %s", kx.From)
+	}
+
+	date := time.Unix(kx.Date, 0)
+	if age := time.Since(date); age > KeyExchangeMaxAge || age < -KeyExchangeMaxAge {
+		return fmt.Errorf("Key exchange from %s is dated %s, which is too far from now", kx.From,
+			date.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// NewSession starts a session, creating our half of the key exchange. name is
+// what the peer will remember our identity as. Set reply when answering the
+// peer's offer.
+func NewSession(id *Identity, name string, reply bool) (*Session, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Session{id: id, ephemeral: ephemeral}
+	s.offer = KeyExchange{
+		Name:      name,
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+		Date:      time.Now().Unix(),
+		Reply:     reply,
+	}
+
+	return &s, nil
+}
+
+// Offer returns our half of the key exchange, signed for sending from one
+// name to the other
+func (s *Session) Offer(to, from string) *KeyExchange {
+	offer := s.offer
+	offer.To = to
+	offer.From = from
+	s.id.SignKeyExchange(&offer)
+
+	return &offer
+}
+
+// Yields reports whether our offer should be dropped in favour of the peer's,
+// when both sides offered a session at the same time. Exactly one side yields.
+func (s *Session) Yields(kx *KeyExchange) bool {
+	return bytes.Compare(s.offer.Ephemeral, kx.Ephemeral) < 0
+}
+
+// hkdf derives a 32 byte key, as in RFC 5869 with a single output block
+func hkdf(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Complete verifies the peer's half of the key exchange and derives the
+// session keys.
+func (s *Session) Complete(kx *KeyExchange) error {
+	err := VerifyKeyExchange(kx)
+	if err != nil {
+		return err
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(kx.Ephemeral)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ephemeral == nil {
+		return errors.New("Key exchange was already completed")
+	}
+
+	secret, err := s.ephemeral.ECDH(peerKey)
+	if err != nil {
+		return err
+	}
+
+	// both sides must see the same salt
+	ours, theirs := s.offer.Ephemeral, kx.Ephemeral
+	salt := append(append([]byte{}, ours...), theirs...)
+	if bytes.Compare(ours, theirs) > 0 {
+		salt = append(append([]byte{}, theirs...), ours...)
+	}
+
+	send, err := newAEAD(hkdf(secret, salt, e2eInfo+" "+hex.EncodeToString(ours)))
+	if err != nil {
+		return err
+	}
+
+	recv, err := newAEAD(hkdf(secret, salt, e2eInfo+" "+hex.EncodeToString(theirs)))
+	if err != nil {
+		return err
+	}
+
+	s.peer = kx
+	s.send = send
+	s.recv = recv
+	s.sendSeq = 0
+	s.recvSeq = 0
+	s.ephemeral = nil
+
+	return nil
+}
+
+// Established reports whether Complete has succeeded
+func (s *Session) Established() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.send != nil
+}
+
+// Peer returns the peer's half of the key exchange, or nil before Complete
+func (s *Session) Peer() *KeyExchange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.peer
+}
+
+func seqNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// Seal encrypts text for the peer. The result starts with the sequence
+// number.
+func (s *Session) Seal(text string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.send == nil {
+		return nil, errors.New("Encrypted session is not established")
+	}
+
+	s.sendSeq++
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, s.sendSeq)
+
+	return s.send.Seal(seq, seqNonce(s.send, s.sendSeq), []byte(text), []byte(e2eInfo)), nil
+}
+
+// Open decrypts what the peer's Seal returned. Sealed texts must arrive in
+// order, so replayed ones are refused.
+func (s *Session) Open(sealed []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.recv == nil {
+		return "", errors.New("Encrypted session is not established")
+	}
+
+	if len(sealed) < 8 {
+		return "", errors.New("Encrypted message is too short")
+	}
+
+	seq := binary.BigEndian.Uint64(sealed[:8])
+	if seq <= s.recvSeq {
+		return "", fmt.Errorf("Encrypted message %d was replayed or reordered", seq)
+	}
+
+	plain, err := s.recv.Open(nil, seqNonce(s.recv, seq), sealed[8:], []byte(e2eInfo))
+	if err != nil {
+		return "", err
+	}
+
+	s.recvSeq = seq
+	return string(plain), nil
+}
+
+// Encrypt moves msg.Msg into msg.Encrypted. Sign the message afterwards.
+func (s *Session) Encrypt(msg *Message) error {
+	sealed, err := s.Seal(msg.Msg)
+	if err != nil {
+		return err
+	}
+
+	msg.Encrypted = sealed
+	msg.Msg = ""
+
+	return nil
+}
+
+// Decrypt restores msg.Msg from msg.Encrypted
+func (s *Session) Decrypt(msg *Message) error {
+	text, err := s.Open(msg.Encrypted)
+	if err != nil {
+		return err
+	}
+
+	msg.Msg = text
+	msg.Encrypted = nil
+
+	return nil
+}
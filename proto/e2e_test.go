@@ -0,0 +1,243 @@
+package proto
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestIdentity(t *testing.T) *Identity {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// newSessions runs a key exchange between alice and bob
+func newSessions(t *testing.T) (*Session, *Session) {
+	alice, err := NewSession(newTestIdentity(t), "alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := NewSession(newTestIdentity(t), "bob", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.Complete(alice.Offer("bob", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Complete(bob.Offer("alice", "bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	return alice, bob
+}
+
+func TestSessionSealOpen(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	for _, text := range []string{"hello", "", "again"} {
+		sealed, err := alice.Seal(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opened, err := bob.Open(sealed)
+		if err != nil {
+			t.Errorf("%q: %s", text, err)
+		} else if opened != text {
+			t.Errorf("%q opens as %q", text, opened)
+		}
+	}
+
+	// each direction has its own key
+	sealed, err := bob.Seal("back")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open(sealed); err == nil {
+		t.Error("Bob opened his own message")
+	}
+	if opened, err := alice.Open(sealed); err != nil || opened != "back" {
+		t.Errorf("Alice opened %q, %v", opened, err)
+	}
+}
+
+func TestSessionOpenRefuses(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	first, _ := alice.Seal("first")
+	second, _ := alice.Seal("second")
+
+	tampered := append([]byte{}, first...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := bob.Open(tampered); err == nil {
+		t.Error("A tampered message was opened")
+	}
+
+	if _, err := bob.Open(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open(first); err == nil {
+		t.Error("A reordered message was opened")
+	}
+	if _, err := bob.Open(second); err == nil {
+		t.Error("A replayed message was opened")
+	}
+	if _, err := bob.Open(first[:7]); err == nil {
+		t.Error("A short message was opened")
+	}
+
+	other, _ := newSessions(t)
+	third, _ := other.Seal("third")
+	if _, err := bob.Open(third); err == nil {
+		t.Error("A message from another session was opened")
+	}
+}
+
+func TestSessionCompleteOnce(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	if err := alice.Complete(bob.Offer("alice", "bob")); err == nil {
+		t.Error("A session was completed twice")
+	}
+}
+
+func TestVerifyKeyExchange(t *testing.T) {
+	sess, err := NewSession(newTestIdentity(t), "alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyKeyExchange(sess.Offer("bob", "alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := []struct {
+		name   string
+		change func(kx *KeyExchange)
+	}{
+		{"to", func(kx *KeyExchange) { kx.To = "carol" }},
+		{"from", func(kx *KeyExchange) { kx.From = "carol" }},
+		{"name", func(kx *KeyExchange) { kx.Name = "carol" }},
+		{"ephemeral", func(kx *KeyExchange) { kx.Ephemeral[0] ^= 1 }},
+		{"reply", func(kx *KeyExchange) { kx.Reply = true }},
+		{"identity", func(kx *KeyExchange) { kx.Identity = newTestIdentity(t).Public() }},
+		{"no identity", func(kx *KeyExchange) { kx.Identity = nil }},
+	}
+
+	for _, tt := range changes {
+		kx := sess.Offer("bob", "alice")
+		kx.Ephemeral = append([]byte{}, kx.Ephemeral...)
+		tt.change(kx)
+
+		if err := VerifyKeyExchange(kx); err == nil {
+			t.Errorf("Changing the %s was not noticed", tt.name)
+		}
+	}
+}
+
+func TestVerifyKeyExchangeDate(t *testing.T) {
+	id := newTestIdentity(t)
+
+	dates := []struct {
+		name  string
+		shift time.Duration
+		ok    bool
+	}{
+		{"now", 0, true},
+		{"a minute ago", -time.Minute, true},
+		{"a minute ahead", time.Minute, true},
+		{"stale", -KeyExchangeMaxAge - time.Minute, false},
+		{"future", KeyExchangeMaxAge + time.Minute, false},
+	}
+
+	for _, tt := range dates {
+		kx := &KeyExchange{To: "bob", From: "alice", Name: "alice", Ephemeral: []byte("e"),
+			Date: time.Now().Add(tt.shift).Unix()}
+		id.SignKeyExchange(kx)
+
+		if err := VerifyKeyExchange(kx); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+// A relay may change From if it signs again
+func TestSignKeyExchangeRelay(t *testing.T) {
+	sess, err := NewSession(newTestIdentity(t), "alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := newTestIdentity(t)
+	kx := sess.Offer("bob", "alice")
+	kx.From = relay.KeyString()
+	relay.SignKeyExchange(kx)
+
+	if err := VerifyKeyExchange(kx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerKeyPins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flexim", "known_keys")
+	alice := newTestIdentity(t).Public()
+	bob := newTestIdentity(t).Public()
+	mallory := newTestIdentity(t).Public()
+
+	steps := []struct {
+		name   string
+		key    []byte
+		status KeyStatus
+	}{
+		{"alice", alice, KeyNew},
+		{"bob", bob, KeyNew},
+		{"alice", alice, KeyKnown},
+		{"alice", mallory, KeyChanged},
+		{"alice", alice, KeyKnown}, // a changed key is not remembered
+		{"bob", bob, KeyKnown},
+		{"Alice", alice, KeyNew}, // names are case sensitive
+	}
+
+	for i, tt := range steps {
+		status, err := CheckPeerKey(path, tt.name, tt.key)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if status != tt.status {
+			t.Errorf("%d: %s is %d, not %d", i, tt.name, status, tt.status)
+		}
+	}
+
+	if err := TrustPeerKey(path, "alice", mallory); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		key    []byte
+		status KeyStatus
+	}{
+		{"alice", mallory, KeyKnown},
+		{"alice", alice, KeyChanged},
+		{"bob", bob, KeyKnown},
+	} {
+		if status, err := CheckPeerKey(path, tt.name, tt.key); err != nil || status != tt.status {
+			t.Errorf("After trusting, %s is %d, not %d (%v)", tt.name, status, tt.status, err)
+		}
+	}
+}
+
+func TestPeerKeyPinsUnreadable(t *testing.T) {
+	// a directory where the file should be
+	path := t.TempDir()
+
+	status, err := CheckPeerKey(path, "alice", newTestIdentity(t).Public())
+	if err == nil || status != KeyUnknown {
+		t.Errorf("Got %d, %v", status, err)
+	}
+}
@@ -0,0 +1,50 @@
+package proto
+
+// File transfers. The sender offers a file with FileOffer; the receiver
+// answers with FileAccept, giving the offset to start from so an interrupted
+// transfer can be resumed. The sender then sends FileChunks in order and a
+// FileComplete. The receiver checks the SHA-256 of the whole file and answers
+// with its own FileComplete. Either side may send FileComplete with an Error
+// to cancel. File datums are relayed like Message, but are not encrypted in
+// encrypted sessions.
+
+// FileChunkSize is the most data one FileChunk carries. It keeps chunks within
+// FramingShort and the default text mode line length even when hex encoded.
+const FileChunkSize = 16 << 10
+
+// FileOffer proposes sending a file
+type FileOffer struct {
+	ID     string `msgpack:"id" json:"id"` // of the transfer, see NewMessageID
+	To     string `msgpack:"to" json:"to"`
+	From   string `msgpack:"from" json:"from"`
+	Name   string `msgpack:"name" json:"name"` // without any directory
+	Size   int64  `msgpack:"size" json:"size"`
+	SHA256 []byte `msgpack:"sha256" json:"sha256"`
+}
+
+// FileAccept answers a FileOffer
+type FileAccept struct {
+	ID     string `msgpack:"id" json:"id"`
+	To     string `msgpack:"to" json:"to"`
+	From   string `msgpack:"from" json:"from"`
+	Offset int64  `msgpack:"offset" json:"offset"` // bytes the receiver already has
+	Reject bool   `msgpack:"reject" json:"reject"`
+}
+
+// FileChunk carries the file data starting at Offset
+type FileChunk struct {
+	ID     string `msgpack:"id" json:"id"`
+	To     string `msgpack:"to" json:"to"`
+	From   string `msgpack:"from" json:"from"`
+	Offset int64  `msgpack:"offset" json:"offset"`
+	Data   []byte `msgpack:"data" json:"data"`
+}
+
+// FileComplete ends a transfer. Without an Error, the sender has sent every
+// chunk, or the receiver has stored the file intact.
+type FileComplete struct {
+	ID    string `msgpack:"id" json:"id"`
+	To    string `msgpack:"to" json:"to"`
+	From  string `msgpack:"from" json:"from"`
+	Error string `msgpack:"error" json:"error"`
+}
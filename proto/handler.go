@@ -0,0 +1,67 @@
+package proto
+
+// Handler receives the datums read by Socket.Serve. Embed BaseHandler and
+// override only the methods you need; datum types added to the protocol get a
+// no-op default there, so existing handlers keep compiling.
+type Handler interface {
+	Message(*Message)
+	Command(*Command)
+	Status(*Status)
+	Roster(*Roster)
+	User(*User)
+	Auth(*Auth)
+	AuthResponse(*AuthResponse)
+	RoomMemberList(*RoomMemberList)
+	RoomMemberJoin(*RoomMemberJoin)
+	RoomMemberPart(*RoomMemberPart)
+	KeyExchange(*KeyExchange)
+	Ack(*Ack)
+	Receipt(*Receipt)
+	Typing(*Typing)
+	Edit(*Edit)
+	Retract(*Retract)
+	Reaction(*Reaction)
+	FileOffer(*FileOffer)
+	FileAccept(*FileAccept)
+	FileChunk(*FileChunk)
+	FileComplete(*FileComplete)
+
+	// Hello is called when the peer's Hello arrives, once the negotiated
+	// capabilities are available from the Socket.
+	Hello(*Hello)
+
+	// Text receives human readable notices from the Socket itself, such as
+	// decoding errors and the reason for a disconnect.
+	Text(string)
+
+	// Disconnect is called once the Socket is closed.
+	Disconnect()
+}
+
+// BaseHandler implements Handler by ignoring everything.
+type BaseHandler struct{}
+
+func (BaseHandler) Message(*Message)               {}
+func (BaseHandler) Command(*Command)               {}
+func (BaseHandler) Status(*Status)                 {}
+func (BaseHandler) Roster(*Roster)                 {}
+func (BaseHandler) User(*User)                     {}
+func (BaseHandler) Auth(*Auth)                     {}
+func (BaseHandler) AuthResponse(*AuthResponse)     {}
+func (BaseHandler) RoomMemberList(*RoomMemberList) {}
+func (BaseHandler) RoomMemberJoin(*RoomMemberJoin) {}
+func (BaseHandler) RoomMemberPart(*RoomMemberPart) {}
+func (BaseHandler) KeyExchange(*KeyExchange)       {}
+func (BaseHandler) Ack(*Ack)                       {}
+func (BaseHandler) Receipt(*Receipt)               {}
+func (BaseHandler) Typing(*Typing)                 {}
+func (BaseHandler) Edit(*Edit)                     {}
+func (BaseHandler) Retract(*Retract)               {}
+func (BaseHandler) Reaction(*Reaction)             {}
+func (BaseHandler) FileOffer(*FileOffer)           {}
+func (BaseHandler) FileAccept(*FileAccept)         {}
+func (BaseHandler) FileChunk(*FileChunk)           {}
+func (BaseHandler) FileComplete(*FileComplete)     {}
+func (BaseHandler) Hello(*Hello)                   {}
+func (BaseHandler) Text(string)                    {}
+func (BaseHandler) Disconnect()                    {}
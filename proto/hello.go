@@ -0,0 +1,173 @@
+package proto
+
+// ProtocolVersion is sent in Hello. Legacy peers skip the Hello as an unknown
+// datum type and send none, so they are treated as having no capabilities.
+const ProtocolVersion = 1
+
+// Capabilities advertised in Hello. A capability is only used when both sides
+// advertise it.
+const (
+	CapText        = "text"         // switching modes with the TEXT and MPCK commands
+	CapKeepalive   = "keepalive"    // answers Ping with Pong
+	CapRoomMembers = "room-members" // RoomMemberList, RoomMemberJoin and RoomMemberPart
+	CapAuth        = "auth"         // Auth and AuthResponse
+	CapE2E         = "e2e"          // KeyExchange and Message.Encrypted
+	CapReceipts    = "receipts"     // Ack and Receipt for messages with an ID
+	CapTyping      = "typing"       // Typing
+	CapEdit        = "edit"         // Edit and Retract
+	CapReactions   = "reactions"    // Reaction
+	CapFiles       = "files"        // FileOffer, FileAccept, FileChunk and FileComplete
+	CapReplies     = "replies"      // Message.ReplyTo
+)
+
+// CommandAny in Hello.Commands means every command is passed on, as a relay
+// such as flexim-client does.
+const CommandAny = "*"
+
+// defaultCaps are implemented by Socket itself
+var defaultCaps = []string{CapText, CapKeepalive}
+
+// Hello is sent by both sides right after the header, whichever it is.
+type Hello struct {
+	Version  int      `msgpack:"version" json:"version"`
+	Agent    string   `msgpack:"agent" json:"agent"`
+	Caps     []string `msgpack:"caps" json:"caps"`
+	Commands []string `msgpack:"commands" json:"commands"` // Command.Cmd values the sender acts on
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddCaps advertises capabilities beyond the ones Socket implements itself.
+// Call it before the header is exchanged.
+func (s *Socket) AddCaps(caps ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range caps {
+		if !contains(s.caps, c) {
+			s.caps = append(s.caps, c)
+		}
+	}
+}
+
+// SetCommands sets the commands advertised to the peer as handled. Call it
+// before the header is exchanged.
+func (s *Socket) SetCommands(cmds ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands = cmds
+}
+
+// SetAgent sets the program name advertised to the peer
+func (s *Socket) SetAgent(agent string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.agent = agent
+}
+
+// PeerHello returns the Hello received from the peer, or nil if none has
+// arrived yet or the peer is a legacy one.
+func (s *Socket) PeerHello() *Hello {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.peer
+}
+
+// HasCap reports whether both sides advertised the capability
+func (s *Socket) HasCap(c string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.hasCap(c)
+}
+
+// hasCap is HasCap with s.mu held
+func (s *Socket) hasCap(c string) bool {
+	if s.peer == nil || !contains(s.peer.Caps, c) {
+		return false
+	}
+
+	return contains(defaultCaps, c) || contains(s.caps, c)
+}
+
+// Caps returns the capabilities advertised by both sides
+func (s *Socket) Caps() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peer == nil {
+		return nil
+	}
+
+	var caps []string
+	for _, c := range s.peer.Caps {
+		if s.hasCap(c) && !contains(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+
+	return caps
+}
+
+// AcceptsCommand reports whether the peer acts on cmd. Without a Hello
+// nothing is known about the peer, so every command is assumed to work.
+func (s *Socket) AcceptsCommand(cmd string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch cmd {
+	case "BYE":
+		return true
+	case "TEXT", "MPCK":
+		if s.peer != nil {
+			return s.hasCap(CapText)
+		}
+	}
+
+	if s.peer == nil {
+		return true
+	}
+
+	return contains(s.peer.Commands, CommandAny) || contains(s.peer.Commands, cmd)
+}
+
+// sendHello queues our Hello. s.mu must be held.
+func (s *Socket) sendHello() error {
+	caps := append([]string{}, defaultCaps...)
+	for _, c := range s.caps {
+		if !contains(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+
+	agent := s.agent
+	if agent == "" {
+		agent = "flexim-go"
+	}
+
+	return s.send(&Hello{
+		Version:  ProtocolVersion,
+		Agent:    agent,
+		Caps:     caps,
+		Commands: s.commands,
+	})
+}
+
+func (s *Socket) processHello(hello *Hello) {
+	s.mu.Lock()
+	s.peer = hello
+	s.mu.Unlock()
+
+	s.h().Hello(hello)
+}
@@ -0,0 +1,72 @@
+package proto
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipe connects two sockets, a sending the header and b receiving it, and
+// serves both until the test ends
+func pipe(t *testing.T, mode, framing int) (*Socket, *Socket) {
+	aEnd, bEnd := net.Pipe()
+
+	a := &Socket{modeSend: mode, modeRecv: mode}
+	a.SetFraming(framing)
+	a.UseConn(aEnd)
+
+	b := FromConn(bEnd, mode)
+
+	if err := a.SendHeader(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go a.Serve(ctx, BaseHandler{})
+	go b.Serve(ctx, BaseHandler{})
+
+	return a, b
+}
+
+// waitFor polls cond for up to a second
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return cond()
+}
+
+// Both sides send a Hello after every header, the legacy one included
+func TestHelloAfterHeader(t *testing.T) {
+	headers := []struct {
+		name    string
+		mode    int
+		framing int
+	}{
+		{"msgpack short", ModeMsgpack, FramingShort},
+		{"msgpack varint", ModeMsgpack, FramingVarint},
+		{"text", ModeText, FramingShort},
+		{"json", ModeJSON, FramingShort},
+	}
+
+	for _, tt := range headers {
+		a, b := pipe(t, tt.mode, tt.framing)
+
+		if !waitFor(func() bool { return a.PeerHello() != nil && b.PeerHello() != nil }) {
+			t.Errorf("%s: no Hello exchanged", tt.name)
+			continue
+		}
+
+		if !a.HasCap(CapKeepalive) || !b.HasCap(CapKeepalive) {
+			t.Errorf("%s: keepalive not negotiated: %v, %v", tt.name, a.Caps(), b.Caps())
+		}
+	}
+}
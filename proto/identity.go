@@ -0,0 +1,279 @@
+package proto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/adrg/xdg"
+)
+
+// Identity is a user's Ed25519 keypair. The hex encoded public key is the
+// user's address, and is what Message.From holds once it has gone through a
+// flexim-client.
+type Identity struct {
+	Private ed25519.PrivateKey
+}
+
+// Domain separation for the different things an identity signs
+const (
+	sigDomainAuth    = "flexim auth v1"
+	sigDomainMessage = "flexim message v1"
+	sigDomainEdit    = "flexim edit v1"
+	sigDomainRetract = "flexim retract v1"
+)
+
+// DefaultIdentityFile returns the file the identity of user is stored in
+func DefaultIdentityFile(user string) string {
+	name := "identity.pem"
+	if user != "" {
+		name = "identity-" + user + ".pem"
+	}
+
+	return filepath.Join(xdg.ConfigHome, "flexim", name)
+}
+
+// GenerateIdentity creates a new random identity
+func GenerateIdentity() (*Identity, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{Private: private}, nil
+}
+
+// LoadIdentity reads an identity stored as a PKCS #8 PEM file
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("No private key found in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an Ed25519 key", path)
+	}
+
+	return &Identity{Private: private}, nil
+}
+
+// Save writes the identity to path, readable only by the user
+func (id *Identity) Save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.Private)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// LoadOrCreateIdentity loads the identity at path, generating and saving a
+// new one if the file does not exist yet.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	id, err := LoadIdentity(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return id, err
+	}
+
+	id, err = GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	err = id.Save(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Generated new identity %s in %s\n", id.KeyString(), path)
+	return id, nil
+}
+
+func (id *Identity) Public() ed25519.PublicKey {
+	return id.Private.Public().(ed25519.PublicKey)
+}
+
+// KeyString returns the public key as used in Message.From
+func (id *Identity) KeyString() string {
+	return hex.EncodeToString(id.Public())
+}
+
+// ParseKey decodes a public key written by Identity.KeyString
+func ParseKey(s string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Public key is %d bytes, expected %d", len(key), ed25519.PublicKeySize)
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// sigData serializes the signed fields unambiguously, each prefixed with its
+// length.
+func sigData(domain string, fields ...string) []byte {
+	var data []byte
+
+	for _, field := range append([]string{domain}, fields...) {
+		data = binary.AppendUvarint(data, uint64(len(field)))
+		data = append(data, field...)
+	}
+
+	return data
+}
+
+func authSigData(auth *Auth) []byte {
+	return sigData(sigDomainAuth, fmt.Sprint(auth.Date), auth.Challenge)
+}
+
+func messageSigData(msg *Message) []byte {
+	fields := []string{msg.ID, msg.To, msg.From, fmt.Sprint(msg.Date), msg.Msg, string(msg.Encrypted), fmt.Sprint(len(msg.Flags))}
+	fields = append(fields, msg.Flags...)
+
+	// only when present, so signatures of plain messages stay the same
+	if len(msg.Attachments) > 0 || len(msg.Embeds) > 0 {
+		fields = append(fields, fmt.Sprint(len(msg.Attachments)))
+		for _, a := range msg.Attachments {
+			fields = append(fields, a.Name, a.Type, fmt.Sprint(a.Size), a.URL)
+		}
+
+		fields = append(fields, fmt.Sprint(len(msg.Embeds)))
+		for _, e := range msg.Embeds {
+			fields = append(fields, e.URL, e.Title, e.Description, e.Thumbnail)
+		}
+	}
+
+	if msg.ReplyTo != "" {
+		fields = append(fields, "reply", msg.ReplyTo)
+	}
+
+	return sigData(sigDomainMessage, fields...)
+}
+
+func editSigData(edit *Edit) []byte {
+	return sigData(sigDomainEdit, edit.ID, edit.To, edit.From, fmt.Sprint(edit.Date), edit.Msg, string(edit.Encrypted))
+}
+
+func retractSigData(retract *Retract) []byte {
+	return sigData(sigDomainRetract, retract.ID, retract.To, retract.From, fmt.Sprint(retract.Date), retract.Reason)
+}
+
+// SignAuth answers an Auth challenge
+func (id *Identity) SignAuth(auth *Auth) *AuthResponse {
+	return &AuthResponse{
+		Challenge: auth.Challenge,
+		Key:       id.Public(),
+		Signature: ed25519.Sign(id.Private, authSigData(auth)),
+	}
+}
+
+// VerifyAuth checks that resp answers auth and was signed by key
+func VerifyAuth(auth *Auth, resp *AuthResponse, key ed25519.PublicKey) error {
+	if resp.Challenge != auth.Challenge {
+		return errors.New("AuthResponse is for a different challenge")
+	}
+
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, authSigData(auth), resp.Signature) {
+		return errors.New("Invalid AuthResponse signature")
+	}
+
+	return nil
+}
+
+// SignMessage signs msg, which must already have its final From and Date
+func (id *Identity) SignMessage(msg *Message) {
+	msg.Signature = ed25519.Sign(id.Private, messageSigData(msg))
+}
+
+// VerifyMessage checks the signature of msg against the key in msg.From
+func VerifyMessage(msg *Message) error {
+	if len(msg.Signature) == 0 {
+		return errors.New("Message is not signed")
+	}
+
+	key, err := ParseKey(msg.From)
+	if err != nil {
+		return fmt.Errorf("Message sender is not a key: %w", err)
+	}
+
+	if !ed25519.Verify(key, messageSigData(msg), msg.Signature) {
+		return fmt.Errorf("Invalid signature on message from %s", msg.From)
+	}
+
+	return nil
+}
+
+// SignEdit signs edit, which must already have its final From and Date
+func (id *Identity) SignEdit(edit *Edit) {
+	edit.Signature = ed25519.Sign(id.Private, editSigData(edit))
+}
+
+// VerifyEdit checks the signature of edit against the key in edit.From
+func VerifyEdit(edit *Edit) error {
+	return verifyFrom(edit.From, editSigData(edit), edit.Signature, "edit")
+}
+
+// SignRetract signs retract, which must already have its final From and Date
+func (id *Identity) SignRetract(retract *Retract) {
+	retract.Signature = ed25519.Sign(id.Private, retractSigData(retract))
+}
+
+// VerifyRetract checks the signature of retract against the key in
+// retract.From
+func VerifyRetract(retract *Retract) error {
+	return verifyFrom(retract.From, retractSigData(retract), retract.Signature, "retraction")
+}
+
+func verifyFrom(from string, data []byte, sig []byte, what string) error {
+	if len(sig) == 0 {
+		return fmt.Errorf("The %s is not signed", what)
+	}
+
+	key, err := ParseKey(from)
+	if err != nil {
+		return fmt.Errorf("The %s sender is not a key: %w", what, err)
+	}
+
+	if !ed25519.Verify(key, data, sig) {
+		return fmt.Errorf("Invalid signature on %s from %s", what, from)
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// JSON mode carries one datum per line as an object naming its type, for
+// browsers and scripts without msgpack:
+//
+//	{"type":"message","data":{"to":"alice","from":"bob","msg":"hello"}}
+//
+// The data has the msgpack field names. Byte fields such as keys and
+// signatures are base64. Over a WebSocket, each text message is one datum.
+
+// datumNames are the types of JSON mode datums
+var datumNames = map[byte]string{
+	DAuth:           "auth",
+	DAuthResponse:   "auth_response",
+	DCommand:        "command",
+	DMessage:        "message",
+	DRoster:         "roster",
+	DUser:           "user",
+	DStatus:         "status",
+	DRoomMemberList: "room_members",
+	DRoomMemberJoin: "room_join",
+	DRoomMemberPart: "room_part",
+	DPing:           "ping",
+	DPong:           "pong",
+	DHello:          "hello",
+	DKeyExchange:    "key_exchange",
+	DAck:            "ack",
+	DReceipt:        "receipt",
+	DTyping:         "typing",
+	DEdit:           "edit",
+	DRetract:        "retract",
+	DReaction:       "reaction",
+	DFileOffer:      "file_offer",
+	DFileAccept:     "file_accept",
+	DFileChunk:      "file_chunk",
+	DFileComplete:   "file_complete",
+}
+
+type jsonDatum struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// encodeJSON returns the JSON mode line for a datum, without a line ending
+func encodeJSON(msg interface{}) ([]byte, error) {
+	dt, err := datumType(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonDatum{Type: datumNames[dt], Data: data})
+}
+
+func decodeJSON(line []byte) (interface{}, error) {
+	var envelope jsonDatum
+
+	err := json.Unmarshal(line, &envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envelope.Data) == 0 {
+		return nil, errors.New("Datum has no data")
+	}
+
+	for dt, name := range datumNames {
+		if name != envelope.Type {
+			continue
+		}
+
+		data, err := newDatum(dt)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(envelope.Data, data)
+		if err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("Unrecognized datum type: %q", envelope.Type)
+}
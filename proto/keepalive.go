@@ -0,0 +1,134 @@
+package proto
+
+import (
+	"time"
+)
+
+// SetKeepalive makes Serve send a Ping every interval, and close the
+// connection when nothing has been received for timeout. Both only apply once
+// the peer has advertised CapKeepalive in its Hello, unless
+// SetKeepaliveAlways is set. A timeout of 0 means three intervals. An
+// interval of 0 disables keepalive, which is the default.
+func (s *Socket) SetKeepalive(interval, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keepaliveInterval = interval
+	s.keepaliveTimeout = timeout
+}
+
+// SetKeepaliveAlways makes keepalive apply without CapKeepalive, for a peer
+// known to answer pings that doesn't advertise it.
+func (s *Socket) SetKeepaliveAlways(always bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keepaliveAlways = always
+}
+
+// keepaliveOn reports whether the peer is pinged and timed out. s.mu must be
+// held.
+func (s *Socket) keepaliveOn() bool {
+	return s.keepaliveInterval > 0 && (s.keepaliveAlways || s.hasCap(CapKeepalive))
+}
+
+// RTT returns the round-trip time measured by the last keepalive Ping, or 0
+// if no Pong has been received yet.
+func (s *Socket) RTT() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rtt
+}
+
+// timeout returns how long a read may wait for data, or 0 for no limit. Peers
+// that don't answer pings are never timed out.
+func (s *Socket) timeout() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.keepaliveOn() {
+		return 0
+	}
+
+	if s.keepaliveTimeout <= 0 {
+		return 3 * s.keepaliveInterval
+	}
+
+	return s.keepaliveTimeout
+}
+
+// refreshDeadline pushes back the read deadline after receiving a datum
+func (s *Socket) refreshDeadline() {
+	timeout := s.timeout()
+
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// keepalive sends pings until done is closed
+func (s *Socket) keepalive(done chan struct{}) {
+	s.mu.Lock()
+	interval := s.keepaliveInterval
+	s.mu.Unlock()
+
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var id uint64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			on := s.conn != nil && s.keepaliveOn()
+			s.mu.Unlock()
+			if !on {
+				continue
+			}
+
+			id++
+			err := s.Send(&Ping{ID: id, Date: time.Now().UnixNano()})
+			if err != nil {
+				s.h().Text("Error sending ping: " + err.Error())
+			}
+		}
+	}
+}
+
+func (s *Socket) processPing(ping *Ping) {
+	pong := Pong(*ping)
+
+	err := s.Send(&pong)
+	if err != nil {
+		s.h().Text("Error sending pong: " + err.Error())
+	}
+}
+
+func (s *Socket) processPong(pong *Pong) {
+	if pong.Date == 0 {
+		return
+	}
+
+	rtt := time.Since(time.Unix(0, pong.Date))
+
+	s.mu.Lock()
+	s.rtt = rtt
+	s.mu.Unlock()
+}
@@ -0,0 +1,71 @@
+package proto
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Pin files remember what was seen from a peer the first time, with one
+// "name value" pair per line.
+
+// pinMu serializes pin file updates within this process
+var pinMu sync.Mutex
+
+// lookupPin returns the value pinned for name. pinMu must be held.
+func lookupPin(path string, name string) (string, bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == name {
+			return fields[1], true, nil
+		}
+	}
+
+	return "", false, scanner.Err()
+}
+
+// savePin pins value for name, replacing any earlier pin. pinMu must be held.
+func savePin(path string, name string, value string) error {
+	var lines []string
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == name {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+	lines = append(lines, fmt.Sprintf("%s %s", name, value))
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	// write a new file and rename it, so a crash can't lose the other pins
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
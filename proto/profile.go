@@ -0,0 +1,68 @@
+package proto
+
+import (
+	"strings"
+	"sync"
+)
+
+// Profiles caches the User profiles received, by name. Names are compared
+// without case, as IRC does. The zero value is an empty cache ready to use,
+// and it is safe for concurrent use.
+type Profiles struct {
+	mu    sync.Mutex
+	users map[string]User
+}
+
+// Update merges a profile into the cache and returns the result. Fields the
+// profile leaves empty keep what was known before.
+func (p *Profiles) Update(user *User) User {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.users == nil {
+		p.users = make(map[string]User)
+	}
+
+	name := strings.ToLower(user.Name)
+	cached := p.users[name]
+	cached.Name = user.Name
+
+	if len(user.Aliases) > 0 {
+		cached.Aliases = user.Aliases
+	}
+	if len(user.Key) > 0 {
+		cached.Key = user.Key
+	}
+	if user.LastSeen > cached.LastSeen {
+		cached.LastSeen = user.LastSeen
+	}
+	if user.DisplayName != "" {
+		cached.DisplayName = user.DisplayName
+	}
+	if user.Avatar != "" {
+		cached.Avatar = user.Avatar
+	}
+
+	p.users[name] = cached
+
+	return cached
+}
+
+// Get returns the profile of name, if there is one
+func (p *Profiles) Get(name string) (User, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	user, ok := p.users[strings.ToLower(name)]
+	return user, ok
+}
+
+// DisplayName returns how to show name: the display name in its profile, or
+// name itself.
+func (p *Profiles) DisplayName(name string) string {
+	if user, ok := p.Get(name); ok && user.DisplayName != "" {
+		return user.DisplayName
+	}
+
+	return name
+}
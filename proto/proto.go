@@ -1,7 +1,12 @@
 package proto
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/vmihailenco/msgpack"
@@ -9,22 +14,71 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-const maxPacketSize = 9000
+// Datum size limits
+const (
+	MaxShortDatumSize   = 0xFFFF  // largest datum FramingShort can describe
+	DefaultMaxDatumSize = 1 << 20 // default limit for FramingVarint
+)
+
+// DefaultQueueSize is the number of outgoing packets a Socket buffers before
+// Send starts returning ErrQueueFull.
+const DefaultQueueSize = 256
+
+// How long Close waits for queued packets to be written
+const closeTimeout = time.Second
 
 // Protocol modes
 const (
 	ModeMsgpack = iota
 	ModeText
+	ModeJSON // see json.go
+)
+
+// Datum framings used by ModeMsgpack. The zero value is FramingShort, which
+// every peer understands. FramingVarint is announced with its own header, so
+// it is only used after SetFraming, with peers known to support it.
+const (
+	FramingShort  = iota // type byte, 16-bit big-endian size
+	FramingVarint        // type byte, uvarint size
 )
 
 // Protocol headers
 var (
-	HeaderMsgpack = []byte{'\xa4', 'F', 'L', 'E', 'X'}
-	HeaderText    = []byte{'\x00', 'F', 'L', 'E', 'X'}
+	HeaderMsgpack    = []byte{'\xa4', 'F', 'L', 'E', 'X'} // msgpack, FramingShort
+	HeaderMsgpackExt = []byte{'\xa5', 'F', 'L', 'E', 'X'} // msgpack, FramingVarint
+	HeaderText       = []byte{'\x00', 'F', 'L', 'E', 'X'}
+	HeaderJSON       = []byte{'{', 'F', 'L', 'E', 'X'}
 )
 
+// ErrDatumTooLarge is returned when a datum exceeds the maximum size allowed by
+// the socket. When reading, the stream cannot be resynchronized and the socket
+// is closed.
+var ErrDatumTooLarge = errors.New("Datum too large")
+
+// ErrQueueFull is returned by Send when the peer is not reading fast enough.
+// The datum is dropped, and the connection stays usable.
+var ErrQueueFull = errors.New("Send queue full")
+
+// datumError is returned for a datum that was framed correctly but could not be
+// decoded. The stream is still in sync, so reading can continue.
+type datumError struct {
+	desc string
+	err  error
+}
+
+func (e *datumError) Error() string {
+	return fmt.Sprintf("Error decoding %s: %s", e.desc, e.err)
+}
+
+func (e *datumError) Unwrap() error {
+	return e.err
+}
+
 // Datum Types
 const (
 	DAuth           = 0
@@ -37,42 +91,190 @@ const (
 	DRoomMemberList = 7
 	DRoomMemberJoin = 8
 	DRoomMemberPart = 9
+	DPing           = 10
+	DPong           = 11
+	DHello          = 12
+	DKeyExchange    = 13
+	DAck            = 14
+	DReceipt        = 15
+	DTyping         = 16
+	DEdit           = 17
+	DRetract        = 18
+	DReaction       = 19
+	DFileOffer      = 20
+	DFileAccept     = 21
+	DFileChunk      = 22
+	DFileComplete   = 23
 )
 
 // Datum structures
 type Auth struct {
-	Date      int64  `msgpack:"date"`
-	Challenge string `msgpack:"challenge"` // Encrypted with User's public key.
-	LastSeen  int64  `msgpack:"last_seen"`
+	Date      int64  `msgpack:"date" json:"date"`
+	Challenge string `msgpack:"challenge" json:"challenge"` // Signed by the user's key in AuthResponse.
+	LastSeen  int64  `msgpack:"last_seen" json:"last_seen"`
 }
 
 type AuthResponse struct {
-	Challenge string `msgpack:"challenge"`
+	Challenge string `msgpack:"challenge" json:"challenge"`
+	Key       []byte `msgpack:"key,omitempty" json:"key,omitempty"`             // Ed25519 public key
+	Signature []byte `msgpack:"signature,omitempty" json:"signature,omitempty"` // see Identity.SignAuth
 }
 
 type Command struct {
-	Cmd     string   `msgpack:"cmd"`
-	Payload []string `msgpack:"payload"`
+	Cmd     string   `msgpack:"cmd" json:"cmd"`
+	Payload []string `msgpack:"payload" json:"payload"`
 }
 
 type Message struct {
-	To    string   `msgpack:"to"`
-	From  string   `msgpack:"from"`
-	Flags []string `msgpack:"flags"`
-	Date  int64    `msgpack:"date"`
-	Msg   string   `msgpack:"msg"`
+	ID    string   `msgpack:"id,omitempty" json:"id,omitempty"` // see NewMessageID
+	To    string   `msgpack:"to" json:"to"`
+	From  string   `msgpack:"from" json:"from"`
+	Flags []string `msgpack:"flags" json:"flags"`
+	Date  int64    `msgpack:"date" json:"date"`
+	Msg   string   `msgpack:"msg" json:"msg"`
+
+	Signature []byte `msgpack:"sig,omitempty" json:"sig,omitempty"` // by the key in From, see Identity.SignMessage
+	Encrypted []byte `msgpack:"enc,omitempty" json:"enc,omitempty"` // replaces Msg in encrypted sessions, see Session.Encrypt
+
+	Attachments []Attachment `msgpack:"attachments,omitempty" json:"attachments,omitempty"`
+	Embeds      []Embed      `msgpack:"embeds,omitempty" json:"embeds,omitempty"`
+
+	ReplyTo string `msgpack:"reply_to,omitempty" json:"reply_to,omitempty"` // ID of the message this answers
+}
+
+// Attachment is a file that came with a Message, such as an uploaded image on
+// a network with file hosting.
+type Attachment struct {
+	Name string `msgpack:"name" json:"name"`
+	Type string `msgpack:"type" json:"type"` // MIME type
+	Size int64  `msgpack:"size" json:"size"`
+	URL  string `msgpack:"url" json:"url"`
+}
+
+// Embed is a preview of a link in a Message
+type Embed struct {
+	URL         string `msgpack:"url" json:"url"`
+	Title       string `msgpack:"title" json:"title"`
+	Description string `msgpack:"description" json:"description"`
+	Thumbnail   string `msgpack:"thumbnail" json:"thumbnail"` // URL of an image
+}
+
+// Ack tells the sender of a Message that the next hop took it over, such as a
+// bridge passing it on to its network.
+type Ack struct {
+	ID string `msgpack:"id" json:"id"`
+}
+
+// Receipt states
+const (
+	ReceiptDelivered = 1 // shown in the recipient's chat window
+	ReceiptRead      = 2 // seen by the recipient
+)
+
+// Receipt is sent back to the sender by the recipient's chat window. It is
+// relayed like Message.
+type Receipt struct {
+	To     string   `msgpack:"to" json:"to"`
+	From   string   `msgpack:"from" json:"from"`
+	IDs    []string `msgpack:"ids" json:"ids"`
+	Status int8     `msgpack:"status" json:"status"`
+	Date   int64    `msgpack:"date" json:"date"`
 }
 
+// Typing states
+const (
+	TypingDone   = 0 // stopped typing, or sent the message
+	TypingActive = 1
+	TypingPaused = 2 // has unsent text, but isn't typing right now
+)
+
+// Typing tells the peer whether the user is composing a message. An active
+// state should be refreshed every few seconds; receivers let it expire.
+type Typing struct {
+	To    string `msgpack:"to" json:"to"`
+	From  string `msgpack:"from" json:"from"`
+	State int8   `msgpack:"state" json:"state"`
+}
+
+// Edit replaces the text of an earlier Message from the same sender. It is
+// relayed and signed like Message.
+type Edit struct {
+	ID   string `msgpack:"id" json:"id"` // of the edited Message
+	To   string `msgpack:"to" json:"to"`
+	From string `msgpack:"from" json:"from"`
+	Date int64  `msgpack:"date" json:"date"`
+	Msg  string `msgpack:"msg" json:"msg"`
+
+	Signature []byte `msgpack:"sig,omitempty" json:"sig,omitempty"` // see Identity.SignEdit
+	Encrypted []byte `msgpack:"enc,omitempty" json:"enc,omitempty"` // replaces Msg in encrypted sessions
+}
+
+// Retract withdraws an earlier Message from the same sender. Receivers mark the
+// message as deleted rather than hiding it.
+type Retract struct {
+	ID     string `msgpack:"id" json:"id"` // of the retracted Message
+	To     string `msgpack:"to" json:"to"`
+	From   string `msgpack:"from" json:"from"`
+	Date   int64  `msgpack:"date" json:"date"`
+	Reason string `msgpack:"reason" json:"reason"`
+
+	Signature []byte `msgpack:"sig,omitempty" json:"sig,omitempty"` // see Identity.SignRetract
+}
+
+// Reaction adds or removes an emoji reaction by From to an earlier Message. It
+// is relayed like Message.
+type Reaction struct {
+	ID     string `msgpack:"id" json:"id"` // of the Message reacted to
+	To     string `msgpack:"to" json:"to"`
+	From   string `msgpack:"from" json:"from"`
+	Emoji  string `msgpack:"emoji" json:"emoji"`
+	Remove bool   `msgpack:"remove" json:"remove"`
+
+	// Count is the total number of these reactions, from networks that only
+	// tell totals. 0 means receivers count the reactions themselves.
+	Count int `msgpack:"count,omitempty" json:"count,omitempty"`
+}
+
+// Presence states, for Status
+const (
+	StatusNotice  = 0 // not a presence; Payload is a notice for the user
+	StatusOnline  = 1
+	StatusAway    = 2
+	StatusBusy    = 3 // do not disturb
+	StatusOffline = 4
+)
+
+// Status tells the presence of User, with Payload as their status message. A
+// Status without a User is a notice from the bridge or server. It is relayed
+// to the chat window with User.
 type Status struct {
-	Status  int8   `msgpack:"status"`
-	Payload string `msgpack:"payload"`
+	Status  int8   `msgpack:"status" json:"status"`
+	Payload string `msgpack:"payload" json:"payload"`
+	User    string `msgpack:"user,omitempty" json:"user,omitempty"`
+	Since   int64  `msgpack:"since,omitempty" json:"since,omitempty"` // when the presence began, if known
+}
+
+// Presence names the presence state
+func (s *Status) Presence() string {
+	switch s.Status {
+	case StatusOnline:
+		return "online"
+	case StatusAway:
+		return "away"
+	case StatusBusy:
+		return "busy"
+	case StatusOffline:
+		return "offline"
+	}
+
+	return ""
 }
 
 type Roster []User
 
 type RoomMemberList struct {
-	Room    string   `msgpack:"room"`
-	Members []string `msgpack:"members"`
+	Room    string   `msgpack:"room" json:"room"`
+	Members []string `msgpack:"members" json:"members"`
 }
 
 type RoomMember string
@@ -85,27 +287,53 @@ type RoomMemberPart struct {
 	HasQuit bool
 }
 
+// User is the profile of a user. Name is the one datums use, as in
+// Message.From; chat windows show DisplayName instead when it is known.
 type User struct {
-	Aliases  []string `msgpack:"aliases"`
-	Key      []byte   `msgpack:"key"`
-	LastSeen int64    `msgpack:"last_seen"`
+	Aliases  []string `msgpack:"aliases" json:"aliases"`
+	Key      []byte   `msgpack:"key" json:"key"`
+	LastSeen int64    `msgpack:"last_seen" json:"last_seen"`
+
+	Name        string `msgpack:"name,omitempty" json:"name,omitempty"`
+	DisplayName string `msgpack:"display_name,omitempty" json:"display_name,omitempty"`
+	Avatar      string `msgpack:"avatar,omitempty" json:"avatar,omitempty"` // URL of a picture
 }
 
+// Ping asks the peer to answer with a Pong carrying the same fields.
+type Ping struct {
+	ID   uint64 `msgpack:"id" json:"id"`
+	Date int64  `msgpack:"date" json:"date"` // sender's clock, in unix nanoseconds
+}
+
+type Pong Ping
+
 type Socket struct {
-	conn              net.Conn
-	gotHeader         bool
-	modeSend          int
-	modeRecv          int
-	cb_Message        func(*Message)
-	cb_Command        func(*Command)
-	cb_Text           func(string)
-	cb_Disconnect     func()
-	cb_Status         func(*Status)
-	cb_Roster         func(*Roster)
-	cb_Auth           func(*Auth)
-	CB_RoomMemberList func(*RoomMemberList)
-	CB_RoomMemberJoin func(*RoomMemberJoin)
-	CB_RoomMemberPart func(*RoomMemberPart)
+	// mu guards the connection and everything used to encode outgoing
+	// datums, so packets from different goroutines never interleave.
+	mu           sync.Mutex
+	conn         net.Conn
+	reader       *bufio.Reader // shared by both codecs so the mode can change mid-stream
+	out          chan []byte   // packets waiting for writeLoop
+	writeDone    chan struct{}
+	writeErr     error
+	queueSize    int
+	gotHeader    bool
+	helloPending bool // there is no header to answer, so Serve sends the Hello
+	modeSend     int
+	modeRecv     int
+	framing      int
+	maxDatumSize int
+	handler      Handler
+
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	keepaliveAlways   bool
+	rtt               time.Duration
+
+	agent    string
+	caps     []string
+	commands []string
+	peer     *Hello // nil until the peer's Hello arrives
 }
 
 func printMsgpack(data []byte) {
@@ -113,7 +341,8 @@ func printMsgpack(data []byte) {
 
 	err := msgpack.Unmarshal(data, &unpacked)
 	if err != nil {
-		log.Panic(err)
+		log.Printf("msgpack: %s", err)
+		return
 	}
 
 	fmt.Printf("msgpack: %+v\n", unpacked)
@@ -141,7 +370,7 @@ func (s *Socket) Dial(protocol string, addr string) error {
 		return err
 	}
 
-	s.conn = conn
+	s.setConn(conn)
 
 	fmt.Printf("Connected to: %s://%s\n", protocol, addr)
 	return nil
@@ -149,16 +378,100 @@ func (s *Socket) Dial(protocol string, addr string) error {
 
 func FromConn(sock net.Conn, mode int) *Socket {
 	s := Socket{
-		conn:     sock,
 		modeSend: mode,
 		modeRecv: mode,
 	}
+	s.setConn(sock)
 	return &s
 }
 
 func (s *Socket) UseConn(sock net.Conn) {
 	// Should Socket.conn just be public if we allow this?
-	s.conn = sock
+	s.setConn(sock)
+}
+
+func (s *Socket) setConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := s.queueSize
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	s.out = make(chan []byte, size)
+	s.writeDone = make(chan struct{})
+	s.writeErr = nil
+
+	// nothing is known about a new peer
+	s.gotHeader = false
+	s.helloPending = false
+	s.peer = nil
+	s.rtt = 0
+
+	go s.writeLoop(conn, s.out, s.writeDone)
+}
+
+// writeLoop is the only writer of a connection. It exits once out is closed
+// and drained, or when a write fails.
+func (s *Socket) writeLoop(conn net.Conn, out chan []byte, done chan struct{}) {
+	defer close(done)
+
+	for packet := range out {
+		_, err := conn.Write(packet)
+		if err != nil {
+			fmt.Println("Error sending packet")
+
+			s.mu.Lock()
+			s.writeErr = err
+			s.mu.Unlock()
+
+			// wake up the reader so the disconnect is noticed
+			conn.Close()
+			return
+		}
+	}
+}
+
+// enqueue queues a packet for writeLoop. s.mu must be held.
+func (s *Socket) enqueue(packet []byte) error {
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+
+	select {
+	case s.out <- packet:
+		return nil
+	default:
+		return fmt.Errorf("%w (%d packets waiting)", ErrQueueFull, len(s.out))
+	}
+}
+
+// SetQueueSize sets how many outgoing packets may be waiting to be written.
+// It takes effect on the next connection.
+func (s *Socket) SetQueueSize(size int) {
+	s.mu.Lock()
+	s.queueSize = size
+	s.mu.Unlock()
+}
+
+// QueueLen returns the number of packets waiting to be written, for callers
+// that want to watch the backpressure of a slow peer.
+func (s *Socket) QueueLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.out)
+}
+
+// connected reports whether the socket has a connection that was not closed
+func (s *Socket) connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn != nil
 }
 
 func FromFD(fd int, mode int) (*Socket, error) {
@@ -188,7 +501,7 @@ func (s *Socket) UseFD(fd int) error {
 		return err
 	}
 
-	s.conn = sock
+	s.setConn(sock)
 
 	log.Printf("FromFD: %d\n", fd)
 
@@ -196,121 +509,382 @@ func (s *Socket) UseFD(fd int) error {
 }
 
 func (s *Socket) Read(buffer []byte) (int, error) {
-	conn := s.conn
-	if conn == nil {
+	s.mu.Lock()
+	reader := s.reader
+	s.mu.Unlock()
+
+	if reader == nil {
+		return 0, io.EOF
+	}
+
+	return reader.Read(buffer)
+}
+
+// ReadByte lets binary.ReadUvarint read datum sizes from the socket.
+func (s *Socket) ReadByte() (byte, error) {
+	s.mu.Lock()
+	reader := s.reader
+	s.mu.Unlock()
+
+	if reader == nil {
 		return 0, io.EOF
 	}
 
-	return conn.Read(buffer)
+	return reader.ReadByte()
 }
 
+// Write queues raw bytes for the peer, after anything already sent.
 func (s *Socket) Write(buffer []byte) (int, error) {
-	conn := s.conn
-	if conn == nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
 		return 0, io.EOF
 	}
 
-	return conn.Write(buffer)
+	packet := make([]byte, len(buffer))
+	copy(packet, buffer)
+
+	err := s.enqueue(packet)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(buffer), nil
 }
 
-func (s *Socket) SetCallbacks(message func(*Message), command func(*Command), txt func(string), disconnect func(), status func(*Status), roster func(*Roster), auth func(*Auth)) {
-	s.cb_Message = message
-	s.cb_Command = command
-	s.cb_Text = txt
-	s.cb_Disconnect = disconnect
-	s.cb_Status = status
-	s.cb_Roster = roster
-	s.cb_Auth = auth
-	go s.readSocket()
+// Serve reads datums from the socket and passes them to h until the
+// connection is closed or ctx is done. It returns the error that ended the
+// connection, or nil if the peer disconnected cleanly.
+func (s *Socket) Serve(ctx context.Context, h Handler) error {
+	s.mu.Lock()
+	s.handler = h
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go s.keepalive(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+
+	return s.readSocket()
 }
 
+// h returns the handler given to Serve, or a no-op handler before that
+func (s *Socket) h() Handler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.handler == nil {
+		return BaseHandler{}
+	}
+
+	return s.handler
+}
+
+// Close closes the connection after giving queued packets a moment to be
+// written, and calls the handler's Disconnect.
 func (s *Socket) Close() error {
-	if s == nil || s.conn == nil {
+	if s == nil {
+		return errors.New("Cannot close nil Socket")
+	}
+
+	s.mu.Lock()
+	conn := s.conn
+	if conn == nil {
+		s.mu.Unlock()
 		return errors.New("Cannot close nil Socket")
 	}
 
-	s.cb_Disconnect()
-	err := s.conn.Close()
 	s.conn = nil
+	close(s.out)
+	writeDone := s.writeDone
+	s.mu.Unlock()
+
+	s.h().Disconnect()
+
+	select {
+	case <-writeDone:
+	case <-time.After(closeTimeout):
+		log.Println("Timed out flushing socket")
+	}
 
-	return err
+	return conn.Close()
 }
 
+// Send queues a datum for the peer. It never blocks on the network; if the
+// peer is too slow, it returns ErrQueueFull.
 func (s *Socket) Send(data interface{}) error {
-	if s.modeSend == ModeText {
-		return errors.New("Not implemented")
+	if s == nil {
+		return errors.New("Cannot send datum to nil Socket")
 	}
 
-	return s.sendDatum(data)
-}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-func (s *Socket) sendDatum(msg interface{}) error {
-	if s == nil || s.conn == nil {
+	if s.conn == nil {
 		return errors.New("Cannot send datum to nil Socket")
 	}
 
-	datum, err := msgpack.Marshal(msg)
-	if err != nil {
-		return err
+	return s.send(data)
+}
+
+// send encodes a datum in the current send mode and queues it. s.mu must be
+// held.
+func (s *Socket) send(data interface{}) error {
+	switch s.modeSend {
+	case ModeText:
+		return s.sendText(data)
+	case ModeJSON:
+		return s.sendJSON(data)
 	}
 
-	var dt int
+	return s.sendDatum(data)
+}
 
+func datumType(msg interface{}) (byte, error) {
 	switch msg.(type) {
+	case *Auth:
+		return DAuth, nil
+	case *AuthResponse:
+		return DAuthResponse, nil
 	case *Command:
-		dt = DCommand
+		return DCommand, nil
 	case *Message:
-		dt = DMessage
-	case *Status:
-		dt = DStatus
+		return DMessage, nil
 	case *Roster:
-		dt = DRoster
+		return DRoster, nil
+	case *User:
+		return DUser, nil
+	case *Status:
+		return DStatus, nil
 	case *RoomMemberList:
-		dt = DRoomMemberList
+		return DRoomMemberList, nil
 	case *RoomMemberJoin:
-		dt = DRoomMemberJoin
+		return DRoomMemberJoin, nil
 	case *RoomMemberPart:
-		dt = DRoomMemberPart
-	case *AuthResponse:
-		dt = DAuthResponse
-	default:
-		log.Panicf("Tried to send unknown datum type: %v %T", msg, msg)
+		return DRoomMemberPart, nil
+	case *Ping:
+		return DPing, nil
+	case *Pong:
+		return DPong, nil
+	case *Hello:
+		return DHello, nil
+	case *KeyExchange:
+		return DKeyExchange, nil
+	case *Ack:
+		return DAck, nil
+	case *Receipt:
+		return DReceipt, nil
+	case *Typing:
+		return DTyping, nil
+	case *Edit:
+		return DEdit, nil
+	case *Retract:
+		return DRetract, nil
+	case *Reaction:
+		return DReaction, nil
+	case *FileOffer:
+		return DFileOffer, nil
+	case *FileAccept:
+		return DFileAccept, nil
+	case *FileChunk:
+		return DFileChunk, nil
+	case *FileComplete:
+		return DFileComplete, nil
+	}
+
+	return 0, fmt.Errorf("Unknown datum type: %T", msg)
+}
+
+// sendDatum encodes msg in msgpack and queues it. s.mu must be held.
+func (s *Socket) sendDatum(msg interface{}) error {
+	packet, err := marshalPacket(msg, s.framing, s.maxDatum())
+	if err != nil {
+		return err
+	}
+
+	return s.enqueue(packet)
+}
+
+// marshalPacket encodes a datum for msgpack mode, framed as given
+func marshalPacket(msg interface{}, framing int, max int) ([]byte, error) {
+	dt, err := datumType(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	datum, err := msgpack.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(datum) > max {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrDatumTooLarge, len(datum), max)
 	}
 
 	// make a packet to hold the header+msgpack
-	packet := make([]byte, 0, len(datum)+3)
+	packet := make([]byte, 0, len(datum)+1+binary.MaxVarintLen64)
 
 	// write type and size
-	packet = append(packet, byte(dt), byte(len(datum)>>8), byte(len(datum)&0xFF))
+	packet = append(packet, dt)
+	if framing == FramingShort {
+		packet = append(packet, byte(len(datum)>>8), byte(len(datum)&0xFF))
+	} else {
+		packet = binary.AppendUvarint(packet, uint64(len(datum)))
+	}
 
 	// write the msgpack data
 	packet = append(packet, datum...)
 
-	_, err = s.conn.Write(packet)
+	return packet, nil
+}
+
+// sendText encodes msg in text mode and queues it. s.mu must be held.
+func (s *Socket) sendText(msg interface{}) error {
+	line, err := marshalLine(msg, s.maxDatum(), ModeText)
 	if err != nil {
-		fmt.Println("Error sending packet")
+		return err
 	}
 
-	return err
+	return s.enqueue(line)
+}
+
+// sendJSON encodes msg in JSON mode and queues it. s.mu must be held.
+func (s *Socket) sendJSON(msg interface{}) error {
+	line, err := marshalLine(msg, s.maxDatum(), ModeJSON)
+	if err != nil {
+		return err
+	}
+
+	return s.enqueue(line)
+}
+
+// marshalLine encodes a datum for text or JSON mode, with its line ending
+func marshalLine(msg interface{}, max int, mode int) ([]byte, error) {
+	var line string
+	if mode == ModeJSON {
+		encoded, err := encodeJSON(msg)
+		if err != nil {
+			return nil, err
+		}
+		line = string(encoded)
+	} else {
+		encoded, err := encodeText(msg)
+		if err != nil {
+			return nil, err
+		}
+		line = encoded
+	}
+
+	if len(line) > max {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrDatumTooLarge, len(line), max)
+	}
+
+	return []byte(line + "\n"), nil
+}
+
+// MarshalDatum encodes one datum as it is sent in mode: a packet with
+// FramingVarint in ModeMsgpack, or a line ending in LF in ModeText and
+// ModeJSON. It is meant for tools and other implementations; Socket encodes
+// datums itself.
+func MarshalDatum(datum interface{}, mode int) ([]byte, error) {
+	switch mode {
+	case ModeMsgpack:
+		return marshalPacket(datum, FramingVarint, DefaultMaxDatumSize)
+	case ModeText, ModeJSON:
+		return marshalLine(datum, DefaultMaxDatumSize, mode)
+	}
+
+	return nil, fmt.Errorf("Invalid mode: %d", mode)
+}
+
+// UnmarshalDatum decodes one datum encoded like MarshalDatum does. Malformed
+// input returns an error.
+func UnmarshalDatum(packet []byte, mode int) (interface{}, error) {
+	switch mode {
+	case ModeMsgpack:
+		if len(packet) == 0 {
+			return nil, errors.New("Empty packet")
+		}
+
+		size, n := binary.Uvarint(packet[1:])
+		if n <= 0 {
+			return nil, errors.New("Invalid datum size")
+		}
+		if size != uint64(len(packet)-1-n) {
+			return nil, fmt.Errorf("Datum size %d does not match the %d bytes after it", size, len(packet)-1-n)
+		}
+		if size > DefaultMaxDatumSize {
+			return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrDatumTooLarge, size, DefaultMaxDatumSize)
+		}
+
+		return unmarshalDatum(packet[0], packet[1+n:])
+
+	case ModeText, ModeJSON:
+		line := strings.TrimSuffix(string(packet), "\n")
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			return nil, errors.New("Empty line")
+		}
+		if strings.ContainsAny(line, "\r\n") {
+			return nil, errors.New("More than one line")
+		}
+		if len(line) > DefaultMaxDatumSize {
+			return nil, fmt.Errorf("%w: line longer than %d bytes", ErrDatumTooLarge, DefaultMaxDatumSize)
+		}
+
+		if mode == ModeJSON {
+			return decodeJSON([]byte(line))
+		}
+		return decodeText(line)
+	}
+
+	return nil, fmt.Errorf("Invalid mode: %d", mode)
 }
 
 func (s *Socket) SendHeader() error {
-	if s == nil || s.conn == nil {
+	if s == nil {
+		return errors.New("Cannot send header to nil Socket")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
 		return errors.New("Cannot send header to nil Socket")
 	}
 
 	s.gotHeader = true
 
+	var header []byte
+
 	switch s.modeSend {
 	case ModeText:
-		_, err := s.Write([]byte("\x00FLEX"))
-		return err
+		header = HeaderText
+	case ModeJSON:
+		header = HeaderJSON
 	case ModeMsgpack:
-		_, err := s.Write([]byte("\xa4FLEX"))
+		header = HeaderMsgpackExt
+		if s.framing == FramingShort {
+			header = HeaderMsgpack
+		}
+	default:
+		return errors.New("Invalid send mode is set")
+	}
+
+	if err := s.enqueue(header); err != nil {
 		return err
 	}
 
-	return errors.New("Invalid send mode is set")
+	return s.sendHello()
 }
 
 func (s *Socket) ReceiveHeader() error {
@@ -321,9 +895,19 @@ func (s *Socket) ReceiveHeader() error {
 		return err
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if bytes.Equal(header, HeaderMsgpack) {
 		s.modeRecv = ModeMsgpack
 		s.modeSend = ModeMsgpack
+		s.framing = FramingShort
+		s.gotHeader = true
+
+	} else if bytes.Equal(header, HeaderMsgpackExt) {
+		s.modeRecv = ModeMsgpack
+		s.modeSend = ModeMsgpack
+		s.framing = FramingVarint
 		s.gotHeader = true
 
 	} else if bytes.Equal(header, HeaderText) {
@@ -331,80 +915,83 @@ func (s *Socket) ReceiveHeader() error {
 		s.modeSend = ModeText
 		s.gotHeader = true
 
+	} else if bytes.Equal(header, HeaderJSON) {
+		s.modeRecv = ModeJSON
+		s.modeSend = ModeJSON
+		s.gotHeader = true
+
 	} else {
 		return fmt.Errorf("Invalid Header: %+v", header)
 	}
 
-	return nil
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.sendHello()
 }
 
 func (s *Socket) SendCommand(cmd *Command) error {
-	if s == nil || s.conn == nil {
+	if s == nil {
 		return errors.New("Cannot send command to nil Socket")
 	}
 
-	switch s.modeSend {
-	case ModeText:
-		var payloadStr string
-		if len(cmd.Payload) > 0 {
-			payloadStr = cmd.Payload[0]
-		}
-
-		c := make([]byte, 0, 1+len(cmd.Cmd)+len(payloadStr))
-		c = append(c, 0)
-		c = append(c, []byte(cmd.Cmd)...)
-		c = append(c, []byte(payloadStr)...)
-		_, err := s.Write(c)
-		return err
-	default:
-		return s.sendDatum(cmd)
-	}
+	return s.Send(cmd)
 }
 
 func (s *Socket) SendMessage(msg *Message) error {
-	if s == nil || s.conn == nil {
+	if s == nil {
 		return errors.New("Cannot send message to nil Socket")
 	}
 
-	if s.modeSend == ModeText {
-		_, err := s.Write([]byte(msg.Msg + "\r"))
-		return err
-	} else {
-		return s.sendDatum(msg)
-	}
-
+	return s.Send(msg)
 }
 
 func (s *Socket) SendStatus(status *Status) error {
-	if s == nil || s.conn == nil {
+	if s == nil {
 		return errors.New("Cannot send status to nil Socket")
 	}
 
-	if s.modeSend == ModeText {
-		_, err := s.Write([]byte(fmt.Sprintf("%d %s\r", status.Status, status.Payload)))
-		return err
-	} else {
-		return s.sendDatum(status)
-	}
+	return s.Send(status)
 }
 
 func (s *Socket) SendRoster(roster *Roster) error {
-	if s == nil || s.conn == nil {
+	if s == nil {
 		return errors.New("Cannot send roster to nil Socket")
 	}
 
-	if s.modeSend == ModeText {
-		return errors.New("Not implemented")
-	} else {
-		return s.sendDatum(roster)
-	}
+	return s.Send(roster)
 }
 
 func (s *Socket) SendAuthResponse(resp *AuthResponse) error {
-	return s.sendDatum(resp)
+	return s.Send(resp)
+}
+
+// SendAck acknowledges msg, if it has an ID and the peer wants receipts
+func (s *Socket) SendAck(msg *Message) error {
+	if msg.ID == "" || !s.HasCap(CapReceipts) {
+		return nil
+	}
+
+	return s.Send(&Ack{ID: msg.ID})
+}
+
+// NewMessageID returns a random ID for a Message. IDs are only compared, so
+// any unique string from another network works as well.
+func NewMessageID() string {
+	id := make([]byte, 12)
+	_, err := rand.Read(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return hex.EncodeToString(id)
 }
 
 func (s *Socket) SetMode(mode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.conn != nil {
 		log.Panicln("Cannot set send/recv mode on an active connection")
 	}
@@ -413,6 +1000,57 @@ func (s *Socket) SetMode(mode int) {
 	s.modeRecv = mode
 }
 
+// SetFraming selects the msgpack framing announced by SendHeader. Like
+// SetMode, it must be called before the connection is established.
+func (s *Socket) SetFraming(framing int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		log.Panicln("Cannot set framing on an active connection")
+	}
+
+	switch framing {
+	case FramingVarint, FramingShort:
+	default:
+		log.Panicln("Invalid framing:", framing)
+	}
+
+	s.framing = framing
+}
+
+// SetMaxDatumSize limits the size of datums sent and received. Sizes of 0 or
+// less reset it to DefaultMaxDatumSize. FramingShort is always limited to
+// MaxShortDatumSize.
+func (s *Socket) SetMaxDatumSize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxDatumSize = size
+}
+
+// MaxDatumSize returns the size limit of datums sent and received
+func (s *Socket) MaxDatumSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.maxDatum()
+}
+
+// maxDatum is MaxDatumSize with s.mu held
+func (s *Socket) maxDatum() int {
+	max := s.maxDatumSize
+	if max <= 0 {
+		max = DefaultMaxDatumSize
+	}
+
+	if s.framing == FramingShort && max > MaxShortDatumSize {
+		max = MaxShortDatumSize
+	}
+
+	return max
+}
+
 func (s *Socket) SetSendMode(mode int) {
 	var ctext string
 
@@ -421,6 +1059,8 @@ func (s *Socket) SetSendMode(mode int) {
 		ctext = "TEXT"
 	case ModeMsgpack:
 		ctext = "MPCK"
+	case ModeJSON:
+		ctext = "JSON"
 	default:
 		log.Panicln("Invalid send mode:", mode)
 	}
@@ -429,221 +1069,329 @@ func (s *Socket) SetSendMode(mode int) {
 		Cmd:     ctext,
 		Payload: []string{},
 	}
-	s.SendCommand(&cmd)
+
+	// the switch is announced in the old mode, and nothing may be queued
+	// between the announcement and the switch
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return
+	}
+
+	err := s.send(&cmd)
+	if err != nil {
+		log.Print(err)
+		return
+	}
 
 	s.modeSend = mode
 }
 
 func (s *Socket) processCommand(cmd *Command) {
 	switch cmd.Cmd {
-	case "BYE ":
+	case "BYE ", "BYE":
 		s.Close()
 
-		s.cb_Text("Disconnected: BYE")
+		s.h().Text("Disconnected: BYE")
 	case "TEXT":
 		s.modeRecv = ModeText
 	case "MPCK":
 		s.modeRecv = ModeMsgpack
+	case "JSON":
+		s.modeRecv = ModeJSON
 	default:
-		s.cb_Command(cmd)
+		s.h().Command(cmd)
 	}
 }
 
-func (s *Socket) readSocket() {
+func (s *Socket) readSocket() error {
+	s.mu.Lock()
+	if s.helloPending {
+		s.helloPending = false
+		if err := s.sendHello(); err != nil {
+			log.Print(err)
+		}
+	}
+	s.mu.Unlock()
 
 	if !s.gotHeader {
 		if err := s.ReceiveHeader(); err != nil {
 			s.Close()
 
-			s.cb_Text(fmt.Sprintf("Error reading header: %s", err))
-			return
+			s.h().Text(fmt.Sprintf("Error reading header: %s", err))
+			return err
 		}
 	}
 
 	for {
 		var err error
 
-		if s.modeRecv == ModeMsgpack {
+		s.refreshDeadline()
+
+		switch s.modeRecv {
+		case ModeMsgpack:
 			err = s.readMsgpack()
-		} else {
+		case ModeJSON:
+			err = s.readJSON()
+		default:
 			err = s.readText()
 		}
 
 		if err != nil {
-			if err == io.EOF {
-				s.cb_Text("Disconnected")
-				break
+			var derr *datumError
+			if errors.As(err, &derr) {
+				s.h().Text(err.Error())
+				continue
 			}
 
-			switch t := err.(type) {
-			case *net.OpError:
-				s.cb_Text(t.Error())
-				break
+			if err == io.EOF || !s.connected() {
+				// closed by the peer, or by us
+				s.h().Text("Disconnected")
+				err = nil
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.h().Text(fmt.Sprintf("Connection timed out: nothing received for %s", s.timeout()))
+			} else {
+				s.h().Text(err.Error())
 			}
 
-			s.cb_Text(err.Error())
+			s.Close()
+			return err
 		}
 	}
-
-	s.Close()
 }
 
 func (s *Socket) readMsgpack() error {
-	header := make([]byte, 3)
+	// first byte is datum type
+	dt, err := s.ReadByte()
+	if err != nil {
+		return err
+	}
 
-	_, err := io.ReadFull(s, header)
+	// followed by the datum length in bytes
+	var size uint64
+	if s.framing == FramingShort {
+		header := make([]byte, 2)
+		_, err = io.ReadFull(s, header)
+		size = uint64(binary.BigEndian.Uint16(header))
+	} else {
+		size, err = binary.ReadUvarint(s)
+	}
 	if err != nil {
 		return err
 	}
 
-	// first byte is datum type
-	dt := header[0]
-	// 2nd and 3rd bytes are datum length in bytes
-	size := (int(header[1]) << 8) | int(header[2])
+	if max := s.MaxDatumSize(); size > uint64(max) {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrDatumTooLarge, size, max)
+	}
 
 	datum := make([]byte, size)
 	_, err = io.ReadFull(s, datum)
 	if err != nil {
-		s.cb_Text(err.Error())
 		return err
 	}
 
-	switch dt {
-	case DCommand:
-		var cmd Command
-		err = msgpack.Unmarshal(datum, &cmd)
-		if err != nil {
-			return err
-		}
-
-		s.processCommand(&cmd)
-		if s == nil {
-			return nil
-		}
+	data, err := unmarshalDatum(dt, datum)
+	if err != nil {
+		return &datumError{desc: fmt.Sprintf("datum type %d", dt), err: err}
+	}
 
-	case DMessage:
-		var msg Message
-		err = msgpack.Unmarshal(datum, &msg)
-		if err != nil {
-			return err
-		}
+	if status, ok := data.(*Status); ok && status.Status == 0 && status.Payload == "" && status.User == "" {
+		fmt.Println("Empty status received.")
+		printMsgpack(datum)
+	}
 
-		s.cb_Message(&msg)
+	s.dispatch(data)
 
-	case DStatus:
-		var status Status
-		err = msgpack.Unmarshal(datum, &status)
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		if status.Status == 0 && status.Payload == "" {
-			fmt.Println("Empty status received.")
-			printMsgpack(datum)
-		}
+func unmarshalDatum(dt byte, datum []byte) (interface{}, error) {
+	data, err := newDatum(dt)
+	if err != nil {
+		return nil, err
+	}
 
-		s.cb_Status(&status)
+	err = msgpack.Unmarshal(datum, data)
+	if err != nil {
+		return nil, err
+	}
 
-	case DRoster:
-		var roster Roster
-		err = msgpack.Unmarshal(datum, &roster)
-		if err != nil {
-			return err
-		}
+	return data, nil
+}
 
-		s.cb_Roster(&roster)
+// newDatum returns a new datum of type dt to decode into
+func newDatum(dt byte) (interface{}, error) {
+	var data interface{}
 
+	switch dt {
+	case DAuth:
+		data = &Auth{}
+	case DAuthResponse:
+		data = &AuthResponse{}
+	case DCommand:
+		data = &Command{}
+	case DMessage:
+		data = &Message{}
+	case DRoster:
+		data = &Roster{}
+	case DUser:
+		data = &User{}
+	case DStatus:
+		data = &Status{}
 	case DRoomMemberList:
-		if s.CB_RoomMemberList == nil {
-			return nil
-		}
-
-		var members RoomMemberList
-
-		err = msgpack.Unmarshal(datum, &members)
-		if err != nil {
-			return err
-		}
-
-		s.CB_RoomMemberList(&members)
-
+		data = &RoomMemberList{}
 	case DRoomMemberJoin:
-		if s.CB_RoomMemberJoin == nil {
-			return nil
-		}
-
-		var member RoomMemberJoin
-
-		err = msgpack.Unmarshal(datum, &member)
-		if err != nil {
-			return err
-		}
-
-		s.CB_RoomMemberJoin(&member)
-
+		data = new(RoomMemberJoin)
 	case DRoomMemberPart:
-		if s.CB_RoomMemberPart == nil {
-			return nil
-		}
-
-		var member RoomMemberPart
+		data = &RoomMemberPart{}
+	case DPing:
+		data = &Ping{}
+	case DPong:
+		data = &Pong{}
+	case DHello:
+		data = &Hello{}
+	case DKeyExchange:
+		data = &KeyExchange{}
+	case DAck:
+		data = &Ack{}
+	case DReceipt:
+		data = &Receipt{}
+	case DTyping:
+		data = &Typing{}
+	case DEdit:
+		data = &Edit{}
+	case DRetract:
+		data = &Retract{}
+	case DReaction:
+		data = &Reaction{}
+	case DFileOffer:
+		data = &FileOffer{}
+	case DFileAccept:
+		data = &FileAccept{}
+	case DFileChunk:
+		data = &FileChunk{}
+	case DFileComplete:
+		data = &FileComplete{}
+	default:
+		return nil, errors.New("Unrecognized datum type")
+	}
 
-		err = msgpack.Unmarshal(datum, &member)
-		if err != nil {
-			return err
-		}
+	return data, nil
+}
 
-		s.CB_RoomMemberPart(&member)
+// dispatch hands a decoded datum to the handler
+func (s *Socket) dispatch(data interface{}) {
+	h := s.h()
 
-	// Not currently handled
-	case DAuth:
-		var auth Auth
-		err = msgpack.Unmarshal(datum, &auth)
-		if err != nil {
-			return err
-		}
+	switch datum := data.(type) {
+	case *Command:
+		s.processCommand(datum)
+	case *Message:
+		h.Message(datum)
+	case *Status:
+		h.Status(datum)
+	case *Roster:
+		h.Roster(datum)
+	case *User:
+		h.User(datum)
+	case *RoomMemberList:
+		h.RoomMemberList(datum)
+	case *RoomMemberJoin:
+		h.RoomMemberJoin(datum)
+	case *RoomMemberPart:
+		h.RoomMemberPart(datum)
+	case *Auth:
+		h.Auth(datum)
+	case *AuthResponse:
+		h.AuthResponse(datum)
+	case *Ping:
+		s.processPing(datum)
+	case *Pong:
+		s.processPong(datum)
+	case *Hello:
+		s.processHello(datum)
+	case *KeyExchange:
+		h.KeyExchange(datum)
+	case *Ack:
+		h.Ack(datum)
+	case *Receipt:
+		h.Receipt(datum)
+	case *Typing:
+		h.Typing(datum)
+	case *Edit:
+		h.Edit(datum)
+	case *Retract:
+		h.Retract(datum)
+	case *Reaction:
+		h.Reaction(datum)
+	case *FileOffer:
+		h.FileOffer(datum)
+	case *FileAccept:
+		h.FileAccept(datum)
+	case *FileChunk:
+		h.FileChunk(datum)
+	case *FileComplete:
+		h.FileComplete(datum)
+	}
+}
 
-		s.cb_Auth(&auth)
-	case DAuthResponse:
-		s.cb_Text("AuthResponse datum not handled")
-	case DUser:
-		s.cb_Text("User datum not handled")
+func (s *Socket) readJSON() error {
+	line, err := s.readLine()
+	if err != nil {
+		return err
+	}
 
-	default:
-		s.cb_Text(fmt.Sprintf("Unrecognized datum type: %v", dt))
+	data, err := decodeJSON([]byte(line))
+	if err != nil {
+		return &datumError{desc: "JSON line", err: err}
 	}
 
+	s.dispatch(data)
+
 	return nil
 }
 
 func (s *Socket) readText() error {
-	buffer := make([]byte, 1500)
-	count, err := s.Read(buffer)
+	line, err := s.readLine()
 	if err != nil {
-		s.cb_Text(err.Error())
 		return err
 	}
 
-	if buffer[0] == 0 {
-		// Command
-		if len(buffer) >= 5 {
-			cmd := Command{
-				Cmd:     string(buffer[1:5]),
-				Payload: []string{string(buffer[5:])},
+	data, err := decodeText(line)
+	if err != nil {
+		return &datumError{desc: "text line", err: err}
+	}
+
+	s.dispatch(data)
+
+	return nil
+}
+
+// readLine reads one line of a text mode stream. Lines end in CR, LF or CRLF;
+// blank lines are skipped.
+func (s *Socket) readLine() (string, error) {
+	max := s.MaxDatumSize()
+	var line []byte
+
+	for {
+		b, err := s.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		if b == '\r' || b == '\n' {
+			if len(line) == 0 {
+				continue
 			}
 
-			s.processCommand(&cmd)
+			return string(line), nil
 		}
-	} else {
-		// Message
-		msg := buffer[:count-1]
 
-		fmt.Printf("%d %s\n", count, msg)
-		msgObj := Message{
-			Msg: string(msg),
+		if len(line) >= max {
+			return "", fmt.Errorf("%w: line longer than %d bytes", ErrDatumTooLarge, max)
 		}
-		s.cb_Message(&msgObj)
-	}
 
-	return nil
+		line = append(line, b)
+	}
 }
@@ -0,0 +1,128 @@
+package proto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A peer that doesn't read gets ErrQueueFull instead of blocking Send
+func TestQueueFull(t *testing.T) {
+	const size = 4
+
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+
+	s := &Socket{modeSend: ModeMsgpack, modeRecv: ModeMsgpack}
+	s.SetQueueSize(size)
+	s.UseConn(ours)
+	defer s.Close()
+
+	msg := &Message{To: "bob", From: "alice", Msg: "hello"}
+
+	// writeLoop holds one packet while the write blocks, and size wait
+	var err error
+	sent := 0
+	for ; sent <= size+1; sent++ {
+		if err = s.Send(msg); err != nil {
+			break
+		}
+	}
+
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Send returned %v after %d datums", err, sent)
+	}
+	if sent < size || sent > size+1 {
+		t.Errorf("%d datums were queued, not %d", sent, size+1)
+	}
+	if n := s.QueueLen(); n != size {
+		t.Errorf("%d packets are waiting, not %d", n, size)
+	}
+
+	// once the peer reads, there is room again
+	go io.Copy(io.Discard, theirs)
+	for i := 0; i < 100 && s.QueueLen() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := s.Send(msg); err != nil {
+		t.Errorf("Send still fails after the peer reads: %s", err)
+	}
+}
+
+func TestMaxDatumSize(t *testing.T) {
+	modes := []struct {
+		name    string
+		mode    int
+		framing int
+		set     int
+		max     int
+	}{
+		{"msgpack short", ModeMsgpack, FramingShort, 0, MaxShortDatumSize},
+		{"msgpack short, above its limit", ModeMsgpack, FramingShort, 1 << 20, MaxShortDatumSize},
+		{"msgpack varint", ModeMsgpack, FramingVarint, 0, DefaultMaxDatumSize},
+		{"msgpack varint, limited", ModeMsgpack, FramingVarint, 1000, 1000},
+		{"text", ModeText, FramingVarint, 1000, 1000},
+		{"json", ModeJSON, FramingVarint, 1000, 1000},
+	}
+
+	for _, tt := range modes {
+		ours, theirs := net.Pipe()
+		go io.Copy(io.Discard, theirs)
+
+		s := &Socket{modeSend: tt.mode, modeRecv: tt.mode}
+		s.SetFraming(tt.framing)
+		s.SetMaxDatumSize(tt.set)
+		s.UseConn(ours)
+
+		if max := s.MaxDatumSize(); max != tt.max {
+			t.Errorf("%s: the limit is %d, not %d", tt.name, max, tt.max)
+		}
+
+		if err := s.Send(&Message{Msg: "small"}); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+
+		large := &Message{Msg: strings.Repeat("x", tt.max+1)}
+		if err := s.Send(large); !errors.Is(err, ErrDatumTooLarge) {
+			t.Errorf("%s: sending %d bytes returned %v", tt.name, tt.max, err)
+		}
+
+		s.Close()
+		theirs.Close()
+	}
+}
+
+// The limit may change while other goroutines send
+func TestMaxDatumSizeConcurrent(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	go io.Copy(io.Discard, theirs)
+
+	s := FromConn(ours, ModeText)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.SetMaxDatumSize(100 + i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.Send(&Message{Msg: "hello"})
+		}
+	}()
+	wg.Wait()
+
+	if max := s.MaxDatumSize(); max != 199 {
+		t.Errorf("The limit is %d, not 199", max)
+	}
+}
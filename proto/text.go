@@ -0,0 +1,1107 @@
+package proto
+
+// Text mode carries one datum per line, so a person can talk to a flexim chat
+// or bridge with nc or socat. Lines end in CR, LF or CRLF.
+//
+//	hello there                   Message{Msg: "hello there"}
+//	//hello                       Message{Msg: "/hello"}, also "/=" for a leading "="
+//	/CMD param :trailing param    Command{Cmd: "CMD", Payload: ["param", "trailing param"]}
+//	=MSG to from date flags :msg  Message with metadata; flags are comma separated
+//	=MSG to from date flags id sig :msg    Message with an ID or signature; sig is hex
+//	=MSG to from date flags id sig attachments embeds [reply] :msg
+//	                              Message with attachments, each name;type;size;url,
+//	                              embeds, each url;title;description;thumbnail, or
+//	                              the ID of the message it replies to
+//	=EMSG to from date flags id sig enc    encrypted Message; sig and enc are hex
+//	=EMSG to from date flags id sig enc attachments embeds [reply]
+//	=ACK id
+//	=RECEIPT to from status date id...
+//	=TYPING to from state
+//	=EDIT to from id date sig :msg         Edit; sig is hex
+//	=EEDIT to from id date sig enc         encrypted Edit; sig and enc are hex
+//	=RETRACT to from id date sig :reason
+//	=REACT to from id emoji [count]        Reaction
+//	=UNREACT to from id emoji [count]      Reaction{Remove: true}
+//	=FILE to from id size sha256 :name     FileOffer; sha256 is hex
+//	=FILEACCEPT to from id offset          FileAccept
+//	=FILEREJECT to from id                 FileAccept{Reject: true}
+//	=CHUNK to from id offset data          FileChunk; data is hex
+//	=FILEDONE to from id :error            FileComplete
+//	=STATUS status :payload       Status
+//	=STATUS status user since :payload    presence of user; since is a unix time
+//	=ROSTER user...               Roster; each user is aliases;key;last_seen
+//	                              or aliases;key;last_seen;name;display_name;avatar
+//	=USER aliases key last_seen   User; aliases are comma separated, key is hex
+//	=USER aliases key last_seen name display_name avatar
+//	=MEMBERS room member...       RoomMemberList
+//	=JOIN member                  RoomMemberJoin
+//	=PART member :msg             RoomMemberPart
+//	=QUIT member :msg             RoomMemberPart{HasQuit: true}
+//	=AUTH date last_seen :challenge
+//	=AUTHRESP :challenge
+//	=AUTHRESP key sig :challenge  AuthResponse signed by key; both are hex
+//	=PING id date
+//	=PONG id date
+//	=HELLO version agent caps commands
+//	=KEYX to from name identity ephemeral date reply sig   KeyExchange; keys are hex, reply is 0 or 1
+//
+// Parameters are separated by spaces, and a parameter starting with ":" takes
+// the rest of the line, like in IRC. Inside parameters, "\s" is a space, "\r"
+// and "\n" are line breaks, and a backslash before any of \ ; , : * is that
+// character. An empty parameter is written as "*".
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	paramEscaper = strings.NewReplacer(
+		`\`, `\\`, " ", `\s`, "\r", `\r`, "\n", `\n`, ";", `\;`, ",", `\,`)
+	trailingEscaper = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`)
+)
+
+func escapeParam(param string) string {
+	switch {
+	case param == "":
+		return "*"
+	case param == "*":
+		return `\*`
+	case strings.HasPrefix(param, ":"):
+		return `\` + paramEscaper.Replace(param)
+	}
+
+	return paramEscaper.Replace(param)
+}
+
+func escapeTrailing(param string) string {
+	return ":" + trailingEscaper.Replace(param)
+}
+
+func unescape(param string) string {
+	if !strings.Contains(param, `\`) {
+		return param
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(param); i++ {
+		c := param[i]
+		if c != '\\' || i+1 == len(param) {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch param[i] {
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case '\\', ';', ',', ':', '*':
+			b.WriteByte(param[i])
+		default:
+			// keep unknown escapes, so typed paths and emoticons survive
+			b.WriteByte('\\')
+			b.WriteByte(param[i])
+		}
+	}
+
+	return b.String()
+}
+
+func unescapeParam(param string) string {
+	if param == "*" {
+		return ""
+	}
+
+	return unescape(param)
+}
+
+// splitEscaped splits s around sep, ignoring escaped separators.
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+func joinList(list []string) string {
+	if len(list) == 0 {
+		return "*"
+	}
+
+	escaped := make([]string, len(list))
+	for i, item := range list {
+		escaped[i] = paramEscaper.Replace(item)
+	}
+
+	if len(list) == 1 && list[0] == "*" {
+		escaped[0] = `\*` // a bare "*" is the empty list
+	} else if strings.HasPrefix(escaped[0], ":") {
+		escaped[0] = `\` + escaped[0] // not the trailing parameter
+	}
+
+	return strings.Join(escaped, ",")
+}
+
+func splitList(param string) []string {
+	if param == "*" || param == "" {
+		return nil
+	}
+
+	list := splitEscaped(param, ',')
+	for i, item := range list {
+		list[i] = unescape(item)
+	}
+
+	return list
+}
+
+// textParams holds the raw, still escaped parameters of a line
+type textParams struct {
+	raw      []string
+	trailing bool // the last parameter was written with ":"
+}
+
+// splitParams splits a line into parameters. A trailing parameter is kept
+// without its ":".
+func splitParams(line string) textParams {
+	var params textParams
+
+	for line != "" {
+		if line[0] == ' ' {
+			line = line[1:]
+			continue
+		}
+
+		if line[0] == ':' {
+			params.raw = append(params.raw, line[1:])
+			params.trailing = true
+			break
+		}
+
+		idx := strings.IndexByte(line, ' ')
+		if idx < 0 {
+			params.raw = append(params.raw, line)
+			break
+		}
+
+		params.raw = append(params.raw, line[:idx])
+		line = line[idx+1:]
+	}
+
+	return params
+}
+
+// get returns parameter i unescaped
+func (p *textParams) get(i int) string {
+	if p.trailing && i == len(p.raw)-1 {
+		return unescape(p.raw[i])
+	}
+
+	return unescapeParam(p.raw[i])
+}
+
+func (p *textParams) int64(i int) (int64, error) {
+	return strconv.ParseInt(p.raw[i], 10, 64)
+}
+
+func encodeKey(key []byte) string {
+	if len(key) == 0 {
+		return "*"
+	}
+
+	return hex.EncodeToString(key)
+}
+
+func decodeKey(param string) ([]byte, error) {
+	if param == "*" {
+		return nil, nil
+	}
+
+	return hex.DecodeString(param)
+}
+
+// encodeRecords writes records separated by "," with fields separated by ";"
+func encodeRecords(records [][]string) string {
+	if len(records) == 0 {
+		return "*"
+	}
+
+	items := make([]string, len(records))
+	for i, fields := range records {
+		escaped := make([]string, len(fields))
+		for j, field := range fields {
+			escaped[j] = paramEscaper.Replace(field)
+		}
+		items[i] = strings.Join(escaped, ";")
+	}
+
+	if strings.HasPrefix(items[0], ":") {
+		items[0] = `\` + items[0] // not the trailing parameter
+	}
+
+	return strings.Join(items, ",")
+}
+
+func decodeRecords(param string, n int) ([][]string, error) {
+	if param == "*" || param == "" {
+		return nil, nil
+	}
+
+	var records [][]string
+	for _, item := range splitEscaped(param, ',') {
+		fields := splitEscaped(item, ';')
+		if len(fields) != n {
+			return nil, fmt.Errorf("Expected %d fields, got %d", n, len(fields))
+		}
+
+		for i := range fields {
+			fields[i] = unescape(fields[i])
+		}
+		records = append(records, fields)
+	}
+
+	return records, nil
+}
+
+func encodeAttachments(attachments []Attachment, embeds []Embed) []string {
+	var a, e [][]string
+
+	for _, attachment := range attachments {
+		a = append(a, []string{attachment.Name, attachment.Type, strconv.FormatInt(attachment.Size, 10), attachment.URL})
+	}
+	for _, embed := range embeds {
+		e = append(e, []string{embed.URL, embed.Title, embed.Description, embed.Thumbnail})
+	}
+
+	return []string{encodeRecords(a), encodeRecords(e)}
+}
+
+// decodeAttachments reads the attachments and embeds parameters into msg
+func decodeAttachments(msg *Message, attachments, embeds string) error {
+	records, err := decodeRecords(attachments, 4)
+	if err != nil {
+		return fmt.Errorf("Attachments: %w", err)
+	}
+
+	for _, r := range records {
+		size, err := strconv.ParseInt(r[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Attachment size: %w", err)
+		}
+
+		msg.Attachments = append(msg.Attachments, Attachment{Name: r[0], Type: r[1], Size: size, URL: r[3]})
+	}
+
+	records, err = decodeRecords(embeds, 4)
+	if err != nil {
+		return fmt.Errorf("Embeds: %w", err)
+	}
+
+	for _, r := range records {
+		msg.Embeds = append(msg.Embeds, Embed{URL: r[0], Title: r[1], Description: r[2], Thumbnail: r[3]})
+	}
+
+	return nil
+}
+
+func encodeUser(user *User) []string {
+	fields := []string{joinList(user.Aliases), encodeKey(user.Key), strconv.FormatInt(user.LastSeen, 10)}
+	if user.Name != "" || user.DisplayName != "" || user.Avatar != "" {
+		fields = append(fields, escapeParam(user.Name), escapeParam(user.DisplayName), escapeParam(user.Avatar))
+	}
+
+	return fields
+}
+
+func decodeUser(fields []string) (User, error) {
+	var user User
+
+	if len(fields) != 3 && len(fields) != 6 {
+		return user, fmt.Errorf("Invalid user: %s", strings.Join(fields, ";"))
+	}
+
+	if len(fields) == 6 {
+		user.Name = unescapeParam(fields[3])
+		user.DisplayName = unescapeParam(fields[4])
+		user.Avatar = unescapeParam(fields[5])
+	}
+
+	key, err := decodeKey(fields[1])
+	if err != nil {
+		return user, err
+	}
+	user.Key = key
+
+	lastSeen, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return user, err
+	}
+
+	user.Aliases = splitList(fields[0])
+	user.LastSeen = lastSeen
+
+	return user, nil
+}
+
+// encodeText returns the text mode line for a datum, without a line ending
+func encodeText(msg interface{}) (string, error) {
+	var params []string
+
+	switch datum := msg.(type) {
+	case *Message:
+		rich := len(datum.Attachments) > 0 || len(datum.Embeds) > 0 || datum.ReplyTo != ""
+
+		if len(datum.Encrypted) > 0 {
+			params = []string{"=EMSG", escapeParam(datum.To), escapeParam(datum.From),
+				strconv.FormatInt(datum.Date, 10), joinList(datum.Flags), escapeParam(datum.ID),
+				encodeKey(datum.Signature), encodeKey(datum.Encrypted)}
+			if rich {
+				params = append(params, encodeAttachments(datum.Attachments, datum.Embeds)...)
+				params = append(params, escapeParam(datum.ReplyTo))
+			}
+			break
+		}
+
+		if datum.To == "" && datum.From == "" && datum.Date == 0 && len(datum.Flags) == 0 &&
+			datum.ID == "" && len(datum.Signature) == 0 && !rich && datum.Msg != "" {
+			text := trailingEscaper.Replace(datum.Msg)
+			if strings.HasPrefix(text, "/") || strings.HasPrefix(text, "=") {
+				text = "/" + text
+			}
+			return text, nil
+		}
+
+		params = []string{"=MSG", escapeParam(datum.To), escapeParam(datum.From),
+			strconv.FormatInt(datum.Date, 10), joinList(datum.Flags)}
+		if datum.ID != "" || len(datum.Signature) > 0 || rich {
+			params = append(params, escapeParam(datum.ID), encodeKey(datum.Signature))
+		}
+		if rich {
+			params = append(params, encodeAttachments(datum.Attachments, datum.Embeds)...)
+			params = append(params, escapeParam(datum.ReplyTo))
+		}
+		params = append(params, escapeTrailing(datum.Msg))
+
+	case *Ack:
+		params = []string{"=ACK", escapeParam(datum.ID)}
+
+	case *Typing:
+		params = []string{"=TYPING", escapeParam(datum.To), escapeParam(datum.From),
+			strconv.Itoa(int(datum.State))}
+
+	case *Edit:
+		params = []string{"=EDIT", escapeParam(datum.To), escapeParam(datum.From), escapeParam(datum.ID),
+			strconv.FormatInt(datum.Date, 10), encodeKey(datum.Signature)}
+		if len(datum.Encrypted) > 0 {
+			params[0] = "=EEDIT"
+			params = append(params, encodeKey(datum.Encrypted))
+		} else {
+			params = append(params, escapeTrailing(datum.Msg))
+		}
+
+	case *Retract:
+		params = []string{"=RETRACT", escapeParam(datum.To), escapeParam(datum.From), escapeParam(datum.ID),
+			strconv.FormatInt(datum.Date, 10), encodeKey(datum.Signature), escapeTrailing(datum.Reason)}
+
+	case *Reaction:
+		verb := "=REACT"
+		if datum.Remove {
+			verb = "=UNREACT"
+		}
+
+		params = []string{verb, escapeParam(datum.To), escapeParam(datum.From), escapeParam(datum.ID),
+			escapeParam(datum.Emoji)}
+		if datum.Count != 0 {
+			params = append(params, strconv.Itoa(datum.Count))
+		}
+
+	case *FileOffer:
+		params = []string{"=FILE", escapeParam(datum.To), escapeParam(datum.From), escapeParam(datum.ID),
+			strconv.FormatInt(datum.Size, 10), encodeKey(datum.SHA256), escapeTrailing(datum.Name)}
+
+	case *FileAccept:
+		if datum.Reject {
+			params = []string{"=FILEREJECT", escapeParam(datum.To), escapeParam(datum.From), escapeParam(datum.ID)}
+		} else {
+			params = []string{"=FILEACCEPT", escapeParam(datum.To), escapeParam(datum.From), escapeParam(datum.ID),
+				strconv.FormatInt(datum.Offset, 10)}
+		}
+
+	case *FileChunk:
+		params = []string{"=CHUNK", escapeParam(datum.To), escapeParam(datum.From), escapeParam(datum.ID),
+			strconv.FormatInt(datum.Offset, 10), encodeKey(datum.Data)}
+
+	case *FileComplete:
+		params = []string{"=FILEDONE", escapeParam(datum.To), escapeParam(datum.From), escapeParam(datum.ID),
+			escapeTrailing(datum.Error)}
+
+	case *Receipt:
+		params = []string{"=RECEIPT", escapeParam(datum.To), escapeParam(datum.From),
+			strconv.Itoa(int(datum.Status)), strconv.FormatInt(datum.Date, 10)}
+		for _, id := range datum.IDs {
+			params = append(params, escapeParam(id))
+		}
+
+	case *Command:
+		if datum.Cmd == "" {
+			return "", errors.New("Cannot send a command without a name")
+		} else if !validTextCommand(datum.Cmd) {
+			return "", fmt.Errorf("Command %q can't be sent in text mode", datum.Cmd)
+		}
+
+		name := paramEscaper.Replace(datum.Cmd)
+		if strings.HasPrefix(name, ":") {
+			name = `\` + name // not the trailing parameter
+		}
+		params = append(params, "/"+name)
+		for i, param := range datum.Payload {
+			if i == len(datum.Payload)-1 && strings.Contains(param, " ") {
+				params = append(params, escapeTrailing(param))
+			} else {
+				params = append(params, escapeParam(param))
+			}
+		}
+
+	case *Status:
+		params = []string{"=STATUS", strconv.Itoa(int(datum.Status))}
+		if datum.User != "" || datum.Since != 0 {
+			params = append(params, escapeParam(datum.User), strconv.FormatInt(datum.Since, 10))
+		}
+		params = append(params, escapeTrailing(datum.Payload))
+
+	case *Roster:
+		params = []string{"=ROSTER"}
+		for i := range *datum {
+			params = append(params, strings.Join(encodeUser(&(*datum)[i]), ";"))
+		}
+
+	case *User:
+		params = append([]string{"=USER"}, encodeUser(datum)...)
+
+	case *RoomMemberList:
+		params = []string{"=MEMBERS", escapeParam(datum.Room)}
+		for _, member := range datum.Members {
+			params = append(params, escapeParam(member))
+		}
+
+	case *RoomMemberJoin:
+		params = []string{"=JOIN", escapeParam(string(*datum))}
+
+	case *RoomMemberPart:
+		verb := "=PART"
+		if datum.HasQuit {
+			verb = "=QUIT"
+		}
+		params = []string{verb, escapeParam(string(datum.Member)), escapeTrailing(datum.Msg)}
+
+	case *Auth:
+		params = []string{"=AUTH", strconv.FormatInt(datum.Date, 10),
+			strconv.FormatInt(datum.LastSeen, 10), escapeTrailing(datum.Challenge)}
+
+	case *AuthResponse:
+		params = []string{"=AUTHRESP"}
+		if len(datum.Key) > 0 || len(datum.Signature) > 0 {
+			params = append(params, encodeKey(datum.Key), encodeKey(datum.Signature))
+		}
+		params = append(params, escapeTrailing(datum.Challenge))
+
+	case *Ping:
+		params = []string{"=PING", strconv.FormatUint(datum.ID, 10), strconv.FormatInt(datum.Date, 10)}
+
+	case *Pong:
+		params = []string{"=PONG", strconv.FormatUint(datum.ID, 10), strconv.FormatInt(datum.Date, 10)}
+
+	case *KeyExchange:
+		reply := "0"
+		if datum.Reply {
+			reply = "1"
+		}
+
+		params = []string{"=KEYX", escapeParam(datum.To), escapeParam(datum.From),
+			escapeParam(datum.Name), encodeKey(datum.Identity), encodeKey(datum.Ephemeral),
+			strconv.FormatInt(datum.Date, 10), reply, encodeKey(datum.Signature)}
+
+	case *Hello:
+		params = []string{"=HELLO", strconv.Itoa(datum.Version), escapeParam(datum.Agent),
+			joinList(datum.Caps), joinList(datum.Commands)}
+
+	default:
+		return "", fmt.Errorf("Unknown datum type: %T", msg)
+	}
+
+	return strings.Join(params, " "), nil
+}
+
+// decodeText parses one text mode line into a datum
+func decodeText(line string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(line, "//"), strings.HasPrefix(line, "/="):
+		return &Message{Msg: unescape(line[1:])}, nil
+	case strings.HasPrefix(line, "/"):
+		return decodeTextCommand(line[1:])
+	case strings.HasPrefix(line, "="):
+		return decodeTextDatum(line[1:])
+	}
+
+	return &Message{Msg: unescape(line)}, nil
+}
+
+// validTextCommand reports whether a command name can be written after the
+// "/", which it can't if the line would read as a Message
+func validTextCommand(name string) bool {
+	return !strings.HasPrefix(name, "/") && !strings.HasPrefix(name, "=")
+}
+
+func decodeTextCommand(line string) (interface{}, error) {
+	params := splitParams(line)
+	if len(params.raw) == 0 {
+		return nil, errors.New("Empty command")
+	}
+
+	cmd := Command{
+		Cmd:     unescape(params.raw[0]),
+		Payload: []string{},
+	}
+	if cmd.Cmd == "" || !validTextCommand(cmd.Cmd) {
+		return nil, fmt.Errorf("Invalid command name: %q", cmd.Cmd)
+	}
+
+	for i := 1; i < len(params.raw); i++ {
+		cmd.Payload = append(cmd.Payload, params.get(i))
+	}
+
+	return &cmd, nil
+}
+
+func decodeTextDatum(line string) (interface{}, error) {
+	params := splitParams(line)
+	if len(params.raw) == 0 {
+		return nil, errors.New("Empty datum")
+	}
+
+	verb := params.raw[0]
+	params.raw = params.raw[1:]
+	n := len(params.raw)
+
+	// wantParams checks the parameter count against the allowed ones
+	wantParams := func(want ...int) error {
+		for _, w := range want {
+			if n == w {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: expected %d parameters, got %d", verb, want[0], n)
+	}
+
+	switch verb {
+	case "MSG":
+		if err := wantParams(5, 7, 9, 10); err != nil {
+			return nil, err
+		}
+
+		date, err := params.int64(2)
+		if err != nil {
+			return nil, err
+		}
+
+		msg := Message{
+			To:    params.get(0),
+			From:  params.get(1),
+			Date:  date,
+			Flags: splitList(params.raw[3]),
+			Msg:   params.get(n - 1),
+		}
+
+		if n >= 7 {
+			msg.ID = params.get(4)
+			msg.Signature, err = decodeKey(params.raw[5])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if n >= 9 {
+			err = decodeAttachments(&msg, params.raw[6], params.raw[7])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if n == 10 {
+			msg.ReplyTo = params.get(8)
+		}
+
+		return &msg, nil
+
+	case "EMSG":
+		if err := wantParams(7, 9, 10); err != nil {
+			return nil, err
+		}
+
+		date, err := params.int64(2)
+		if err != nil {
+			return nil, err
+		}
+
+		msg := Message{
+			To:    params.get(0),
+			From:  params.get(1),
+			Date:  date,
+			Flags: splitList(params.raw[3]),
+			ID:    params.get(4),
+		}
+
+		msg.Signature, err = decodeKey(params.raw[5])
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Encrypted, err = decodeKey(params.raw[6])
+		if err != nil {
+			return nil, err
+		}
+
+		if n >= 9 {
+			err = decodeAttachments(&msg, params.raw[7], params.raw[8])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if n == 10 {
+			msg.ReplyTo = params.get(9)
+		}
+
+		return &msg, nil
+
+	case "ACK":
+		if err := wantParams(1); err != nil {
+			return nil, err
+		}
+
+		return &Ack{ID: params.get(0)}, nil
+
+	case "TYPING":
+		if err := wantParams(3); err != nil {
+			return nil, err
+		}
+
+		state, err := strconv.ParseInt(params.raw[2], 10, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Typing{
+			To:    params.get(0),
+			From:  params.get(1),
+			State: int8(state),
+		}, nil
+
+	case "EDIT", "EEDIT", "RETRACT":
+		if err := wantParams(6); err != nil {
+			return nil, err
+		}
+
+		date, err := params.int64(3)
+		if err != nil {
+			return nil, err
+		}
+
+		sig, err := decodeKey(params.raw[4])
+		if err != nil {
+			return nil, err
+		}
+
+		if verb == "RETRACT" {
+			return &Retract{
+				To:        params.get(0),
+				From:      params.get(1),
+				ID:        params.get(2),
+				Date:      date,
+				Signature: sig,
+				Reason:    params.get(5),
+			}, nil
+		}
+
+		edit := Edit{
+			To:        params.get(0),
+			From:      params.get(1),
+			ID:        params.get(2),
+			Date:      date,
+			Signature: sig,
+		}
+
+		if verb == "EEDIT" {
+			edit.Encrypted, err = decodeKey(params.raw[5])
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			edit.Msg = params.get(5)
+		}
+
+		return &edit, nil
+
+	case "REACT", "UNREACT":
+		if err := wantParams(4, 5); err != nil {
+			return nil, err
+		}
+
+		reaction := Reaction{
+			To:     params.get(0),
+			From:   params.get(1),
+			ID:     params.get(2),
+			Emoji:  params.get(3),
+			Remove: verb == "UNREACT",
+		}
+
+		if n == 5 {
+			count, err := strconv.Atoi(params.raw[4])
+			if err != nil {
+				return nil, err
+			}
+			reaction.Count = count
+		}
+
+		return &reaction, nil
+
+	case "FILE":
+		if err := wantParams(6); err != nil {
+			return nil, err
+		}
+
+		size, err := params.int64(3)
+		if err != nil {
+			return nil, err
+		}
+
+		sum, err := decodeKey(params.raw[4])
+		if err != nil {
+			return nil, err
+		}
+
+		return &FileOffer{
+			To:     params.get(0),
+			From:   params.get(1),
+			ID:     params.get(2),
+			Size:   size,
+			SHA256: sum,
+			Name:   params.get(5),
+		}, nil
+
+	case "FILEACCEPT":
+		if err := wantParams(4); err != nil {
+			return nil, err
+		}
+
+		offset, err := params.int64(3)
+		if err != nil {
+			return nil, err
+		}
+
+		return &FileAccept{
+			To:     params.get(0),
+			From:   params.get(1),
+			ID:     params.get(2),
+			Offset: offset,
+		}, nil
+
+	case "FILEREJECT":
+		if err := wantParams(3); err != nil {
+			return nil, err
+		}
+
+		return &FileAccept{
+			To:     params.get(0),
+			From:   params.get(1),
+			ID:     params.get(2),
+			Reject: true,
+		}, nil
+
+	case "CHUNK":
+		if err := wantParams(5); err != nil {
+			return nil, err
+		}
+
+		offset, err := params.int64(3)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := decodeKey(params.raw[4])
+		if err != nil {
+			return nil, err
+		}
+
+		return &FileChunk{
+			To:     params.get(0),
+			From:   params.get(1),
+			ID:     params.get(2),
+			Offset: offset,
+			Data:   data,
+		}, nil
+
+	case "FILEDONE":
+		if err := wantParams(4); err != nil {
+			return nil, err
+		}
+
+		return &FileComplete{
+			To:    params.get(0),
+			From:  params.get(1),
+			ID:    params.get(2),
+			Error: params.get(3),
+		}, nil
+
+	case "RECEIPT":
+		if n < 4 {
+			return nil, fmt.Errorf("%s: expected at least 4 parameters, got %d", verb, n)
+		}
+
+		status, err := strconv.ParseInt(params.raw[2], 10, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		date, err := params.int64(3)
+		if err != nil {
+			return nil, err
+		}
+
+		receipt := Receipt{
+			To:     params.get(0),
+			From:   params.get(1),
+			Status: int8(status),
+			Date:   date,
+		}
+
+		for i := 4; i < n; i++ {
+			receipt.IDs = append(receipt.IDs, params.get(i))
+		}
+
+		return &receipt, nil
+
+	case "KEYX":
+		if err := wantParams(8); err != nil {
+			return nil, err
+		}
+
+		kx := KeyExchange{
+			To:    params.get(0),
+			From:  params.get(1),
+			Name:  params.get(2),
+			Reply: params.raw[6] == "1",
+		}
+
+		var err error
+		kx.Identity, err = decodeKey(params.raw[3])
+		if err != nil {
+			return nil, err
+		}
+
+		kx.Ephemeral, err = decodeKey(params.raw[4])
+		if err != nil {
+			return nil, err
+		}
+
+		kx.Date, err = params.int64(5)
+		if err != nil {
+			return nil, err
+		}
+
+		kx.Signature, err = decodeKey(params.raw[7])
+		if err != nil {
+			return nil, err
+		}
+
+		return &kx, nil
+
+	case "STATUS":
+		if err := wantParams(2, 4); err != nil {
+			return nil, err
+		}
+
+		status, err := strconv.ParseInt(params.raw[0], 10, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		if n == 2 {
+			return &Status{
+				Status:  int8(status),
+				Payload: params.get(1),
+			}, nil
+		}
+
+		since, err := params.int64(2)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Status{
+			Status:  int8(status),
+			User:    params.get(1),
+			Since:   since,
+			Payload: params.get(3),
+		}, nil
+
+	case "ROSTER":
+		roster := make(Roster, 0, n)
+		for _, param := range params.raw {
+			user, err := decodeUser(splitEscaped(param, ';'))
+			if err != nil {
+				return nil, err
+			}
+			roster = append(roster, user)
+		}
+
+		return &roster, nil
+
+	case "USER":
+		if err := wantParams(3, 6); err != nil {
+			return nil, err
+		}
+
+		user, err := decodeUser(params.raw)
+		if err != nil {
+			return nil, err
+		}
+
+		return &user, nil
+
+	case "MEMBERS":
+		if n < 1 {
+			return nil, fmt.Errorf("%s: missing room", verb)
+		}
+
+		list := RoomMemberList{
+			Room:    params.get(0),
+			Members: []string{},
+		}
+		for i := 1; i < n; i++ {
+			list.Members = append(list.Members, params.get(i))
+		}
+
+		return &list, nil
+
+	case "JOIN":
+		if err := wantParams(1); err != nil {
+			return nil, err
+		}
+
+		member := RoomMemberJoin(params.get(0))
+		return &member, nil
+
+	case "PART", "QUIT":
+		if err := wantParams(2); err != nil {
+			return nil, err
+		}
+
+		return &RoomMemberPart{
+			Member:  RoomMember(params.get(0)),
+			Msg:     params.get(1),
+			HasQuit: verb == "QUIT",
+		}, nil
+
+	case "AUTH":
+		if err := wantParams(3); err != nil {
+			return nil, err
+		}
+
+		date, err := params.int64(0)
+		if err != nil {
+			return nil, err
+		}
+
+		lastSeen, err := params.int64(1)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Auth{
+			Date:      date,
+			LastSeen:  lastSeen,
+			Challenge: params.get(2),
+		}, nil
+
+	case "AUTHRESP":
+		if err := wantParams(1, 3); err != nil {
+			return nil, err
+		}
+
+		resp := AuthResponse{Challenge: params.get(n - 1)}
+		if n == 3 {
+			var err error
+			resp.Key, err = decodeKey(params.raw[0])
+			if err != nil {
+				return nil, err
+			}
+
+			resp.Signature, err = decodeKey(params.raw[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return &resp, nil
+
+	case "PING", "PONG":
+		if err := wantParams(2); err != nil {
+			return nil, err
+		}
+
+		id, err := strconv.ParseUint(params.raw[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		date, err := params.int64(1)
+		if err != nil {
+			return nil, err
+		}
+
+		ping := Ping{ID: id, Date: date}
+		if verb == "PONG" {
+			pong := Pong(ping)
+			return &pong, nil
+		}
+
+		return &ping, nil
+
+	case "HELLO":
+		if err := wantParams(4); err != nil {
+			return nil, err
+		}
+
+		version, err := strconv.Atoi(params.raw[0])
+		if err != nil {
+			return nil, err
+		}
+
+		return &Hello{
+			Version:  version,
+			Agent:    params.get(1),
+			Caps:     splitList(params.raw[2]),
+			Commands: splitList(params.raw[3]),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unrecognized datum: %s", verb)
+}
@@ -0,0 +1,57 @@
+package proto
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Datums whose text mode lines need escaping to come back the same
+var textRoundTrips = []struct {
+	name  string
+	datum interface{}
+}{
+	{"flag with colon", &Message{To: "a", From: "b", Flags: []string{":x"}, Date: 1, Msg: "m"}},
+	{"flags with colons", &Message{To: "a", From: "b", Flags: []string{":x", ":y"}, Date: 1, Msg: "m"}},
+	{"command with colon", &Command{Cmd: ":x", Payload: []string{":y", "z"}}},
+	{"flag star", &Message{To: "a", From: "b", Flags: []string{"*"}, Date: 1, Msg: "m"}},
+	{"hello caps with colon", &Hello{Version: ProtocolVersion, Agent: "a", Caps: []string{":c"}, Commands: []string{":NICK"}}},
+	{"attachment name with colon", &Message{To: "a", From: "b", Flags: []string{"f"}, Date: 1, Msg: "m",
+		Attachments: []Attachment{{Name: ":n", Type: "t", Size: 1, URL: "u"}}}},
+	{"embed url with colon", &Message{To: "a", From: "b", Flags: []string{"f"}, Date: 1, Msg: "m",
+		Embeds: []Embed{{URL: ":u", Title: "t", Description: "d", Thumbnail: "th"}}}},
+	{"roster alias with colon", &Roster{{Aliases: []string{":a"}, LastSeen: 1}, {Aliases: []string{"b"}, LastSeen: 2}}},
+	{"user alias with colon", &User{Aliases: []string{":a", "b"}, LastSeen: 1}},
+}
+
+func TestTextRoundTrip(t *testing.T) {
+	for _, tt := range textRoundTrips {
+		line, err := MarshalDatum(tt.datum, ModeText)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		decoded, err := UnmarshalDatum(line, ModeText)
+		if err != nil {
+			t.Errorf("%s: %q: %s", tt.name, line, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(decoded, tt.datum) {
+			t.Errorf("%s: %q decodes to %+v, not %+v", tt.name, line, decoded, tt.datum)
+		}
+	}
+}
+
+// Command names that would read as a Message can't be sent in text mode
+func TestTextCommandNames(t *testing.T) {
+	for _, name := range []string{"/x", "=x"} {
+		if line, err := MarshalDatum(&Command{Cmd: name}, ModeText); err == nil {
+			t.Errorf("%q encodes as %q", name, line)
+		}
+	}
+
+	if datum, err := UnmarshalDatum([]byte("/:/x\n"), ModeText); err == nil {
+		t.Errorf("/:/x decodes to %+v", datum)
+	}
+}
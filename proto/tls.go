@@ -0,0 +1,319 @@
+package proto
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// TLSOptions configures TLS for Socket connections. Without a CA file, peer
+// certificates are pinned: the first certificate seen from a peer is recorded
+// in the pin file, and a different one is refused from then on.
+type TLSOptions struct {
+	CertFile string // our certificate; required to accept connections
+	KeyFile  string
+	CAFile   string // verify peers against these CAs instead of pinning
+
+	// RequireClientCert makes accepted connections present a certificate,
+	// which is verified against CAFile or pinned by its common name.
+	RequireClientCert bool
+
+	PinFile string // defaults to DefaultPinFile()
+}
+
+// How long a TLS handshake may take
+const handshakeTimeout = 30 * time.Second
+
+// DefaultPinFile returns the file peer certificate pins are stored in
+func DefaultPinFile() string {
+	return filepath.Join(xdg.ConfigHome, "flexim", "known_peers")
+}
+
+// Fingerprint returns the hex SHA-256 of a DER encoded certificate
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// TLSFlags registers the -tls-* flags shared by the flexim programs
+func TLSFlags(fs *flag.FlagSet) *TLSOptions {
+	var o TLSOptions
+
+	fs.StringVar(&o.CertFile, "tls-cert", "", "TLS certificate file (PEM)")
+	fs.StringVar(&o.KeyFile, "tls-key", "", "TLS private key file (PEM)")
+	fs.StringVar(&o.CAFile, "tls-ca", "", "verify peers against the CA certificates in this file instead of pinning them")
+	fs.BoolVar(&o.RequireClientCert, "tls-require-client-cert", false, "only accept TLS clients that present a certificate")
+	fs.StringVar(&o.PinFile, "tls-pins", "", "file of pinned peer certificates (default "+DefaultPinFile()+")")
+
+	return &o
+}
+
+// Args returns the flags that recreate these options, for passing them on to
+// a child process.
+func (o *TLSOptions) Args() []string {
+	var args []string
+
+	if o.CertFile != "" {
+		args = append(args, "--tls-cert", o.CertFile)
+	}
+	if o.KeyFile != "" {
+		args = append(args, "--tls-key", o.KeyFile)
+	}
+	if o.CAFile != "" {
+		args = append(args, "--tls-ca", o.CAFile)
+	}
+	if o.RequireClientCert {
+		args = append(args, "--tls-require-client-cert")
+	}
+	if o.PinFile != "" {
+		args = append(args, "--tls-pins", o.PinFile)
+	}
+
+	return args
+}
+
+func (o *TLSOptions) pinFile() string {
+	if o.PinFile != "" {
+		return o.PinFile
+	}
+
+	return DefaultPinFile()
+}
+
+// checkPin compares a certificate with the one pinned for name, and pins it if
+// name is new.
+func checkPin(path string, name string, der []byte) error {
+	fingerprint := Fingerprint(der)
+
+	pinMu.Lock()
+	defer pinMu.Unlock()
+
+	pinned, found, err := lookupPin(path, name)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		if pinned != fingerprint {
+			return fmt.Errorf("Certificate for %s does not match the pinned one (got %s, pinned %s in %s)",
+				name, fingerprint, pinned, path)
+		}
+
+		return nil
+	}
+
+	err = savePin(path, name, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pinned new certificate for %s: %s\n", name, fingerprint)
+	return nil
+}
+
+func loadCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+func (o *TLSOptions) certificates() ([]tls.Certificate, error) {
+	if o.CertFile == "" && o.KeyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return []tls.Certificate{cert}, nil
+}
+
+// ClientConfig returns the configuration for dialing addr. The address is
+// also the name its certificate is pinned under.
+func (o *TLSOptions) ClientConfig(addr string) (*tls.Config, error) {
+	certs, err := o.certificates()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	config := &tls.Config{
+		Certificates: certs,
+		ServerName:   host,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if o.CAFile != "" {
+		config.RootCAs, err = loadCAs(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return config, nil
+	}
+
+	// The pin replaces chain verification
+	pinFile := o.pinFile()
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("Peer sent no certificate")
+		}
+
+		return checkPin(pinFile, addr, rawCerts[0])
+	}
+
+	return config, nil
+}
+
+// ServerConfig returns the configuration for accepting connections
+func (o *TLSOptions) ServerConfig() (*tls.Config, error) {
+	certs, err := o.certificates()
+	if err != nil {
+		return nil, err
+	}
+	if certs == nil {
+		return nil, errors.New("A certificate and key are needed to accept TLS connections")
+	}
+
+	config := &tls.Config{
+		Certificates: certs,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if o.CAFile != "" {
+		config.ClientCAs, err = loadCAs(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if o.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+
+		return config, nil
+	}
+
+	if !o.RequireClientCert {
+		return config, nil
+	}
+
+	pinFile := o.pinFile()
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("Peer sent no certificate")
+		}
+
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if cert.Subject.CommonName == "" {
+			return errors.New("Client certificate has no common name to pin")
+		}
+
+		return checkPin(pinFile, "client:"+cert.Subject.CommonName, rawCerts[0])
+	}
+
+	return config, nil
+}
+
+// DialTLS connects like Dial, then performs a TLS handshake
+func DialTLS(protocol string, addr string, mode int, opts *TLSOptions) (*Socket, error) {
+	s := Socket{
+		modeSend: mode,
+		modeRecv: mode,
+	}
+
+	err := s.DialTLS(protocol, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (s *Socket) DialTLS(protocol string, addr string, opts *TLSOptions) error {
+	config, err := opts.ClientConfig(addr)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: handshakeTimeout}
+	conn, err := tls.DialWithDialer(&dialer, protocol, addr, config)
+	if err != nil {
+		return err
+	}
+
+	s.setConn(conn)
+
+	fmt.Printf("Connected with TLS to: %s://%s\n", protocol, addr)
+	return nil
+}
+
+// UseFDTLS takes over an accepted connection like UseFD, and performs the
+// server side of a TLS handshake on it.
+func (s *Socket) UseFDTLS(fd int, opts *TLSOptions) error {
+	config, err := opts.ServerConfig()
+	if err != nil {
+		return err
+	}
+
+	file := os.NewFile(uintptr(fd), "")
+	if file == nil {
+		return errors.New("Invalid file descriptor")
+	}
+	defer file.Close()
+
+	sock, err := net.FileConn(file)
+	if err != nil {
+		return err
+	}
+
+	conn := tls.Server(sock, config)
+	sock.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = conn.Handshake()
+	if err != nil {
+		sock.Close()
+		return err
+	}
+	sock.SetDeadline(time.Time{})
+
+	s.setConn(conn)
+
+	return nil
+}
+
+// IsTLSRecord reports whether the first bytes of a connection are a TLS
+// handshake rather than a FLEX header, so listeners can serve both on one
+// port.
+func IsTLSRecord(header []byte) bool {
+	return len(header) >= 3 && header[0] == 0x16 && header[1] == 0x03
+}
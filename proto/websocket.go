@@ -0,0 +1,145 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn is a WebSocket seen as the stream of lines JSON mode reads, with
+// each text message as one line
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader // the message being read
+	eol    bool      // the end of the message was read, but not its line break
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for {
+		if c.eol {
+			c.eol = false
+			b[0] = '\n'
+			return 1, nil
+		}
+
+		if c.reader == nil {
+			_, reader, err := c.ws.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			} else if err != nil {
+				return 0, err
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(b)
+
+		// a line break would end the datum early, and JSON takes spaces as well
+		for i := range b[:n] {
+			if b[i] == '\r' || b[i] == '\n' {
+				b[i] = ' '
+			}
+		}
+
+		if err == io.EOF {
+			c.reader = nil
+			c.eol = true
+			err = nil
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Write sends one packet from writeLoop as a text message
+func (c *wsConn) Write(b []byte) (int, error) {
+	err := c.ws.WriteMessage(websocket.TextMessage, bytes.TrimRight(b, "\r\n"))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// FromWebSocket returns a Socket in ModeJSON carrying each datum in a text
+// message. No header is exchanged; the Hello is sent when Serve starts, so
+// set the capabilities before.
+func FromWebSocket(ws *websocket.Conn) *Socket {
+	s := Socket{
+		modeSend: ModeJSON,
+		modeRecv: ModeJSON,
+	}
+	s.setConn(&wsConn{ws: ws})
+	s.gotHeader = true
+	s.helloPending = true
+
+	return &s
+}
+
+// WebSocketHandler accepts WebSocket connections, and passes each to accept
+// as a Socket from FromWebSocket. Browsers may connect from pages on the same
+// host, or from the given origins, like "http://localhost:8000".
+func WebSocketHandler(origins []string, accept func(*Socket)) http.Handler {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || contains(origins, origin) {
+				return true
+			}
+
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket from %s: %s", r.RemoteAddr, err)
+			return
+		}
+
+		accept(FromWebSocket(ws))
+	})
+}